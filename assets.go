@@ -1,6 +1,14 @@
 package main
 
-import _ "embed"
+import "embed"
 
 //go:embed iterm2.plist
 var iterm2Plist []byte
+
+//go:embed status.html
+var statusPage []byte
+
+// embeddedLocks holds the pip lockfiles shipped with the binary, locks/<pyenv name>.txt.
+//
+//go:embed locks
+var embeddedLocks embed.FS
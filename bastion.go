@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// bastionInventory is ~/.chs-onboard/bastions.json: the bastions of each region and
+// the hosts reached through them. Fields left empty use the defaults below.
+type bastionInventory struct {
+	User           string          `json:"user,omitempty"`
+	IdentityFile   string          `json:"identity_file,omitempty"`
+	PKCS11         *bool           `json:"pkcs11,omitempty"`
+	ControlPersist string          `json:"control_persist,omitempty"`
+	Regions        []bastionRegion `json:"regions"`
+}
+
+// bastionRegion is a chain of bastions, hopped through in order. Via names a
+// bastion (usually of another region) the first one is reached through; Hosts are
+// Host patterns reached through the last one.
+type bastionRegion struct {
+	Name     string    `json:"name"`
+	Via      string    `json:"via,omitempty"`
+	Bastions []bastion `json:"bastions"`
+	Hosts    []string  `json:"hosts,omitempty"`
+}
+
+type bastion struct {
+	Alias    string `json:"alias"`
+	HostName string `json:"hostname"`
+	Port     int    `json:"port,omitempty"`
+	User     string `json:"user,omitempty"`
+}
+
+const bastionBlockName = "bastions"
+
+var errNoBastionInventory = errors.New("no bastion inventory")
+
+func bastionInventoryPath() string {
+	return filepath.Join(os.Getenv("HOME"), ".chs-onboard", "bastions.json")
+}
+
+func loadBastionInventory() (*bastionInventory, error) {
+	path := bastionInventoryPath()
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w at %s; ask your trainer for your team's bastions.json", errNoBastionInventory, path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var inv bastionInventory
+	if err := json.Unmarshal(data, &inv); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := inv.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if inv.IdentityFile == "" {
+		inv.IdentityFile = sshKeyPath()
+	}
+	if inv.PKCS11 == nil {
+		yes := true
+		inv.PKCS11 = &yes
+	}
+	if inv.ControlPersist == "" {
+		inv.ControlPersist = "10m"
+	}
+	return &inv, nil
+}
+
+// validate checks aliases are unique and every region's chain of Via hops ends.
+func (inv *bastionInventory) validate() error {
+	if len(inv.Regions) == 0 {
+		return fmt.Errorf("no regions")
+	}
+	regionOf := map[string]int{}
+	for i, r := range inv.Regions {
+		if r.Name == "" || len(r.Bastions) == 0 {
+			return fmt.Errorf("region %d needs a name and at least one bastion", i+1)
+		}
+		for _, b := range r.Bastions {
+			if b.Alias == "" || b.HostName == "" {
+				return fmt.Errorf("region %s: every bastion needs an alias and a hostname", r.Name)
+			}
+			if strings.ContainsAny(b.Alias, "*?! \t") {
+				return fmt.Errorf("region %s: bastion alias %q must be a plain name", r.Name, b.Alias)
+			}
+			if _, dup := regionOf[b.Alias]; dup {
+				return fmt.Errorf("bastion alias %q is used twice", b.Alias)
+			}
+			regionOf[b.Alias] = i
+		}
+	}
+	for i, r := range inv.Regions {
+		seen := map[int]bool{i: true}
+		for via := r.Via; via != ""; via = inv.Regions[regionOf[via]].Via {
+			j, ok := regionOf[via]
+			if !ok {
+				return fmt.Errorf("region %s: via %q is not a bastion alias", r.Name, via)
+			}
+			if seen[j] {
+				return fmt.Errorf("region %s: via chain loops back through %s", r.Name, inv.Regions[j].Name)
+			}
+			seen[j] = true
+		}
+	}
+	return nil
+}
+
+// render returns the ~/.ssh/config entries for the inventory and what ssh -G must
+// resolve for each bastion and host pattern.
+func (inv *bastionInventory) render() (string, []sshExpect) {
+	var b strings.Builder
+	var expect []sshExpect
+	var names []string
+	for _, r := range inv.Regions {
+		fmt.Fprintf(&b, "# %s\n", r.Name)
+		jump := r.Via
+		for _, h := range r.Bastions {
+			user := h.User
+			if user == "" {
+				user = inv.User
+			}
+			opts := map[string]string{"hostname": h.HostName}
+			fmt.Fprintf(&b, "Host %s\n    HostName %s\n", h.Alias, h.HostName)
+			if h.Port != 0 {
+				fmt.Fprintf(&b, "    Port %d\n", h.Port)
+				opts["port"] = strconv.Itoa(h.Port)
+			}
+			if user != "" {
+				fmt.Fprintf(&b, "    User %s\n", user)
+				opts["user"] = user
+			}
+			if jump != "" {
+				fmt.Fprintf(&b, "    ProxyJump %s\n", jump)
+				opts["proxyjump"] = jump
+			}
+			expect = append(expect, sshExpect{Host: h.Alias, Options: opts})
+			names = append(names, h.Alias)
+			jump = h.Alias
+		}
+		if len(r.Hosts) > 0 {
+			fmt.Fprintf(&b, "Host %s\n    ProxyJump %s\n", strings.Join(r.Hosts, " "), jump)
+			if inv.User != "" {
+				fmt.Fprintf(&b, "    User %s\n", inv.User)
+			}
+			for _, p := range r.Hosts {
+				if sample := sshPatternSample(p); sample != "" {
+					expect = append(expect, sshExpect{Host: sample, Options: map[string]string{"proxyjump": jump}})
+				}
+			}
+			names = append(names, r.Hosts...)
+		}
+		b.WriteString("\n")
+	}
+	// Shared options last: ssh keeps the first value it finds, so the per-host
+	// entries above win where they overlap.
+	fmt.Fprintf(&b, "Host %s\n", strings.Join(names, " "))
+	fmt.Fprintf(&b, "    IdentityFile %s\n", inv.IdentityFile)
+	if *inv.PKCS11 {
+		fmt.Fprintf(&b, "    PKCS11Provider %s\n", openscPKCS11)
+	}
+	b.WriteString("    ControlMaster auto\n    ControlPath ~/.ssh/cm-%C\n")
+	fmt.Fprintf(&b, "    ControlPersist %s\n", inv.ControlPersist)
+	return b.String(), expect
+}
+
+func checkBastion() toolCheck {
+	inv, err := loadBastionInventory()
+	if err != nil {
+		return missingCheck(err.Error())
+	}
+	data, _ := os.ReadFile(sshConfigPath())
+	current := managedBlock(string(data), bastionBlockName)
+	if current == "" {
+		return missingCheck("no bastion block in ~/.ssh/config")
+	}
+	body, expect := inv.render()
+	if current != sshConfigBlock(bastionBlockName, body) {
+		return outdatedCheck("bastion block in ~/.ssh/config differs from " + bastionInventoryPath())
+	}
+	if err := checkSSHConfig(sshConfigPath(), expect); err != nil {
+		return outdatedCheck(err.Error())
+	}
+	n := 0
+	for _, r := range inv.Regions {
+		n += len(r.Bastions)
+	}
+	return installedCheck(fmt.Sprintf("%d bastions in ~/.ssh/config", n)).withVersion(fmt.Sprintf("%d regions", len(inv.Regions)))
+}
+
+// bastionSteps writes the inventory's ssh config. Without an inventory there is
+// nothing to write, so the tool only warns; adding bastions.json later changes the
+// steps, and the next run picks the bastions up.
+func bastionSteps() []step {
+	inv, err := loadBastionInventory()
+	if errors.Is(err, errNoBastionInventory) {
+		return []step{noteStep("bastion", "skipping bastion ssh config: "+err.Error())}
+	}
+	if err != nil {
+		s := sshConfigStep("bastion", bastionBlockName, "", nil)
+		s.Block, s.Message = "", err.Error()
+		return []step{s}
+	}
+	body, expect := inv.render()
+	return []step{sshConfigStep("bastion", bastionBlockName, body, expect)}
+}
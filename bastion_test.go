@@ -0,0 +1,173 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// chainedInventory has two regions; the second is reached through the first's
+// last bastion.
+func chainedInventory() *bastionInventory {
+	no := false
+	return &bastionInventory{
+		User:           "guid",
+		IdentityFile:   "~/.ssh/id_ed25519",
+		PKCS11:         &no,
+		ControlPersist: "10m",
+		Regions: []bastionRegion{
+			{
+				Name: "r1",
+				Bastions: []bastion{
+					{Alias: "a1", HostName: "a1.example", Port: 2222, User: "ops"},
+					{Alias: "a2", HostName: "a2.example"},
+				},
+				Hosts: []string{"*.r1.example"},
+			},
+			{
+				Name:     "r2",
+				Via:      "a2",
+				Bastions: []bastion{{Alias: "b1", HostName: "b1.example"}},
+				Hosts:    []string{"db-?.r2"},
+			},
+		},
+	}
+}
+
+func TestBastionRenderProxyJumpChain(t *testing.T) {
+	body, expect := chainedInventory().render()
+	want := `# r1
+Host a1
+    HostName a1.example
+    Port 2222
+    User ops
+Host a2
+    HostName a2.example
+    User guid
+    ProxyJump a1
+Host *.r1.example
+    ProxyJump a2
+    User guid
+
+# r2
+Host b1
+    HostName b1.example
+    User guid
+    ProxyJump a2
+Host db-?.r2
+    ProxyJump b1
+    User guid
+
+Host a1 a2 *.r1.example b1 db-?.r2
+    IdentityFile ~/.ssh/id_ed25519
+    ControlMaster auto
+    ControlPath ~/.ssh/cm-%C
+    ControlPersist 10m
+`
+	if body != want {
+		t.Errorf("render() body:\n%s\nwant:\n%s", body, want)
+	}
+	wantExpect := []sshExpect{
+		{Host: "a1", Options: map[string]string{"hostname": "a1.example", "port": "2222", "user": "ops"}},
+		{Host: "a2", Options: map[string]string{"hostname": "a2.example", "user": "guid", "proxyjump": "a1"}},
+		{Host: "chs-probe.r1.example", Options: map[string]string{"proxyjump": "a2"}},
+		{Host: "b1", Options: map[string]string{"hostname": "b1.example", "user": "guid", "proxyjump": "a2"}},
+		{Host: "db-x.r2", Options: map[string]string{"proxyjump": "b1"}},
+	}
+	if !reflect.DeepEqual(expect, wantExpect) {
+		t.Errorf("render() expect = %+v, want %+v", expect, wantExpect)
+	}
+}
+
+func TestBastionRenderPKCS11(t *testing.T) {
+	inv := chainedInventory()
+	yes := true
+	inv.PKCS11 = &yes
+	body, _ := inv.render()
+	if !strings.Contains(body, "    PKCS11Provider "+openscPKCS11+"\n") {
+		t.Errorf("PKCS11Provider missing from:\n%s", body)
+	}
+}
+
+// TestBastionRenderResolvesWithSSH checks the rendered config with the real ssh -G.
+func TestBastionRenderResolvesWithSSH(t *testing.T) {
+	if _, err := exec.LookPath("ssh"); err != nil {
+		t.Skip("ssh not installed")
+	}
+	body, expect := chainedInventory().render()
+	path := filepath.Join(t.TempDir(), "config")
+	if err := os.WriteFile(path, []byte(sshConfigBlock(bastionBlockName, body)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkSSHConfig(path, expect); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestBastionValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		mutate  func(inv *bastionInventory)
+		wantErr string
+	}{
+		{"valid chain", func(*bastionInventory) {}, ""},
+		{"no regions", func(inv *bastionInventory) { inv.Regions = nil }, "no regions"},
+		{"region without bastions", func(inv *bastionInventory) { inv.Regions[1].Bastions = nil }, "at least one bastion"},
+		{"bastion without hostname", func(inv *bastionInventory) { inv.Regions[0].Bastions[1].HostName = "" }, "alias and a hostname"},
+		{"pattern alias", func(inv *bastionInventory) { inv.Regions[0].Bastions[0].Alias = "a*" }, "plain name"},
+		{"duplicate alias", func(inv *bastionInventory) { inv.Regions[1].Bastions[0].Alias = "a1" }, "used twice"},
+		{"unknown via", func(inv *bastionInventory) { inv.Regions[1].Via = "nope" }, "not a bastion alias"},
+		{"via loop", func(inv *bastionInventory) { inv.Regions[0].Via = "b1" }, "loops back"},
+		{"via own region", func(inv *bastionInventory) { inv.Regions[1].Via = "b1" }, "loops back"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inv := chainedInventory()
+			tt.mutate(inv)
+			err := inv.validate()
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("validate() = %v, want nil", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Errorf("validate() = %v, want error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadBastionInventoryDefaults(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	path := bastionInventoryPath()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	data := `{"regions": [{"name": "r1", "bastions": [{"alias": "a1", "hostname": "a1.example"}]}]}`
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	inv, err := loadBastionInventory()
+	if err != nil {
+		t.Fatalf("loadBastionInventory: %v", err)
+	}
+	if inv.IdentityFile != sshKeyPath() || inv.PKCS11 == nil || !*inv.PKCS11 || inv.ControlPersist != "10m" {
+		t.Errorf("defaults not applied: identity %q, pkcs11 %v, control persist %q", inv.IdentityFile, inv.PKCS11, inv.ControlPersist)
+	}
+}
+
+func TestBastionStepsWithoutInventory(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	steps := bastionSteps()
+	if len(steps) != 1 || steps[0].Kind != stepNote {
+		t.Fatalf("bastionSteps() = %+v, want a single note", steps)
+	}
+	if err := runSteps(steps); err != nil {
+		t.Errorf("running the steps without an inventory: %v", err)
+	}
+	if c := checkBastion(); c.State != checkMissing {
+		t.Errorf("checkBastion() = %+v, want missing", c)
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// bitbucketClient calls the Bitbucket Server REST API with a personal access token.
+// BaseURL is the server root, e.g. https://bitbucket.example.com.
+type bitbucketClient struct {
+	BaseURL string
+	Token   string
+	Client  *http.Client
+}
+
+func newBitbucketClient(token string) *bitbucketClient {
+	return &bitbucketClient{BaseURL: bitbucketURL(), Token: token, Client: &http.Client{Timeout: 30 * time.Second}}
+}
+
+// bitbucketURL is CHS_BITBUCKET_URL, or the HTTPS root of the Bitbucket SSH host.
+func bitbucketURL() string {
+	if u := strings.TrimSpace(os.Getenv("CHS_BITBUCKET_URL")); u != "" {
+		return strings.TrimSuffix(u, "/")
+	}
+	return "https://" + sshHosts["bitbucket"].HostName
+}
+
+func bitbucketTokenPath() string {
+	return filepath.Join(os.Getenv("HOME"), ".chs-onboard", "bitbucket_token")
+}
+
+// bitbucketToken returns the personal access token from CHS_BITBUCKET_TOKEN or
+// ~/.chs-onboard/bitbucket_token, or "" when neither is set. The file must not be
+// readable by others.
+func bitbucketToken() (string, error) {
+	if t := strings.TrimSpace(os.Getenv("CHS_BITBUCKET_TOKEN")); t != "" {
+		return t, nil
+	}
+	path := bitbucketTokenPath()
+	fi, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if fi.Mode().Perm()&0077 != 0 {
+		return "", fmt.Errorf("%s is readable by others; chmod 600 it", path)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// bitbucketSSHKey is a key as /rest/ssh/1.0/keys returns it.
+type bitbucketSSHKey struct {
+	ID    int    `json:"id,omitempty"`
+	Text  string `json:"text"`
+	Label string `json:"label,omitempty"`
+}
+
+// bitbucketAPIError is a non-2xx response; Message is the server's first error.
+type bitbucketAPIError struct {
+	Status  int
+	Message string
+}
+
+func (e *bitbucketAPIError) Error() string {
+	switch e.Status {
+	case http.StatusUnauthorized:
+		return "Bitbucket rejected the access token (expired or revoked?)"
+	case http.StatusForbidden:
+		return "the access token may not manage SSH keys; create one with account write permission"
+	}
+	if e.Message != "" {
+		return fmt.Sprintf("Bitbucket returned %d: %s", e.Status, e.Message)
+	}
+	return fmt.Sprintf("Bitbucket returned %d", e.Status)
+}
+
+// do sends a JSON request to path and decodes the response into out, if given.
+func (c *bitbucketClient) do(method, path string, in, out any) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, c.BaseURL+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.Token)
+	req.Header.Set("Accept", "application/json")
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		apiErr := &bitbucketAPIError{Status: resp.StatusCode}
+		var e struct {
+			Errors []struct {
+				Message string `json:"message"`
+			} `json:"errors"`
+		}
+		if json.Unmarshal(data, &e) == nil && len(e.Errors) > 0 {
+			apiErr.Message = e.Errors[0].Message
+		}
+		return apiErr
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("%s %s: %w", method, path, err)
+	}
+	return nil
+}
+
+// sshKeys lists the token owner's SSH keys, following the API's paging.
+func (c *bitbucketClient) sshKeys() ([]bitbucketSSHKey, error) {
+	var keys []bitbucketSSHKey
+	start := 0
+	for {
+		var page struct {
+			Values        []bitbucketSSHKey `json:"values"`
+			IsLastPage    bool              `json:"isLastPage"`
+			NextPageStart int               `json:"nextPageStart"`
+		}
+		q := url.Values{"start": {strconv.Itoa(start)}, "limit": {"100"}}
+		if err := c.do(http.MethodGet, "/rest/ssh/1.0/keys?"+q.Encode(), nil, &page); err != nil {
+			return nil, err
+		}
+		keys = append(keys, page.Values...)
+		if page.IsLastPage || page.NextPageStart <= start {
+			return keys, nil
+		}
+		start = page.NextPageStart
+	}
+}
+
+func (c *bitbucketClient) addSSHKey(text, label string) (bitbucketSSHKey, error) {
+	var added bitbucketSSHKey
+	err := c.do(http.MethodPost, "/rest/ssh/1.0/keys", bitbucketSSHKey{Text: text, Label: label}, &added)
+	return added, err
+}
+
+// sameSSHKey compares two public keys by type and key material; comments differ
+// freely between copies of the same key.
+func sameSSHKey(a, b string) bool {
+	fa, fb := strings.Fields(a), strings.Fields(b)
+	return len(fa) >= 2 && len(fb) >= 2 && fa[0] == fb[0] && fa[1] == fb[1]
+}
+
+func findBitbucketSSHKey(keys []bitbucketSSHKey, pubKey string) *bitbucketSSHKey {
+	for i := range keys {
+		if sameSSHKey(keys[i].Text, pubKey) {
+			return &keys[i]
+		}
+	}
+	return nil
+}
+
+// registerSSHKey makes sure pubKey is one of the token owner's Bitbucket SSH keys,
+// uploading it under a label naming this Mac when it is not, and reads the list
+// back to confirm.
+func registerSSHKey(c *bitbucketClient, pubKey string) error {
+	keys, err := c.sshKeys()
+	if err != nil {
+		return err
+	}
+	if k := findBitbucketSSHKey(keys, pubKey); k != nil {
+		logInfo("ssh_key", "SSH key already registered in Bitbucket", map[string]string{"label": k.Label})
+		return nil
+	}
+	host, _ := os.Hostname()
+	label := fmt.Sprintf("%s (chs-onboard %s)", strings.TrimSuffix(host, ".local"), time.Now().Format("2006-01-02"))
+	if _, err := c.addSSHKey(pubKey, label); err != nil {
+		return err
+	}
+	keys, err = c.sshKeys()
+	if err != nil {
+		return err
+	}
+	if findBitbucketSSHKey(keys, pubKey) == nil {
+		return fmt.Errorf("Bitbucket accepted the SSH key but does not list it")
+	}
+	logInfo("ssh_key", "SSH key added to Bitbucket", map[string]string{"label": label, "url": c.BaseURL})
+	// The host key may not be in known_hosts yet; only a rejected key fails here,
+	// anything else is checked again before the first clone.
+	switch err := bitbucketProbe(); {
+	case errors.Is(err, errSSHKeyNotAdded):
+		return fmt.Errorf("Bitbucket lists the SSH key but still rejects it: %w", err)
+	case err != nil:
+		logWarn("ssh_key", "could not verify SSH access to Bitbucket yet", map[string]string{"error": err.Error()})
+	default:
+		logInfo("ssh_key", "Bitbucket accepts the SSH key", nil)
+	}
+	return nil
+}
+
+// bitbucketProbe checks that Bitbucket accepts the SSH key over SSH.
+var bitbucketProbe = func() error { return probeSSH(sshHosts["bitbucket"]) }
+
+// registerSSHKeyWithPrompt asks for a personal access token and registers the key
+// with it; the token is used for this run only.
+func registerSSHKeyWithPrompt(pubKey string) error {
+	token, err := uiPassword("Bitbucket Access Token", "Paste a Bitbucket personal access token with account write permission (create one under Manage account → HTTP access tokens):")
+	if err != nil {
+		return err
+	}
+	if token = strings.TrimSpace(token); token == "" {
+		return fmt.Errorf("no access token entered")
+	}
+	return registerSSHKey(newBitbucketClient(token), pubKey)
+}
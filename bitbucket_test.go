@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeBitbucket serves /rest/ssh/1.0/keys like Bitbucket Server, in pages of at
+// most pageSize keys. With status set every request fails with it.
+type fakeBitbucket struct {
+	mu       sync.Mutex
+	keys     []bitbucketSSHKey
+	pageSize int
+	status   int
+	gets     int
+	posts    []bitbucketSSHKey
+	auth     []string
+}
+
+func (f *fakeBitbucket) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.auth = append(f.auth, r.Header.Get("Authorization"))
+	if r.URL.Path != "/rest/ssh/1.0/keys" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if f.status != 0 {
+		w.WriteHeader(f.status)
+		fmt.Fprintf(w, `{"errors":[{"message":"status %d"}]}`, f.status)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		f.gets++
+		start, _ := strconv.Atoi(r.URL.Query().Get("start"))
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+		size := min(limit, f.pageSize)
+		end := min(start+size, len(f.keys))
+		page := map[string]any{
+			"values":     f.keys[min(start, end):end],
+			"isLastPage": end >= len(f.keys),
+		}
+		if end < len(f.keys) {
+			page["nextPageStart"] = end
+		}
+		_ = json.NewEncoder(w).Encode(page)
+	case http.MethodPost:
+		var k bitbucketSSHKey
+		if err := json.NewDecoder(r.Body).Decode(&k); err != nil || k.Text == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"errors":[{"message":"text is required"}]}`)
+			return
+		}
+		if findBitbucketSSHKey(f.keys, k.Text) != nil {
+			w.WriteHeader(http.StatusConflict)
+			fmt.Fprint(w, `{"errors":[{"message":"This SSH key is already in use"}]}`)
+			return
+		}
+		k.ID = len(f.keys) + 1
+		f.posts = append(f.posts, k)
+		f.keys = append(f.keys, k)
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(k)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func newFakeBitbucket(t *testing.T, n int) (*fakeBitbucket, *bitbucketClient) {
+	t.Helper()
+	f := &fakeBitbucket{pageSize: 25}
+	for i := 0; i < n; i++ {
+		f.keys = append(f.keys, bitbucketSSHKey{ID: i + 1, Text: fmt.Sprintf("ssh-ed25519 AAAAkey%d other@host", i), Label: fmt.Sprintf("key %d", i)})
+	}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	return f, &bitbucketClient{BaseURL: srv.URL, Token: "secret-token", Client: srv.Client()}
+}
+
+// stubBitbucketProbe replaces the SSH probe and counts its calls.
+func stubBitbucketProbe(t *testing.T, err error) *int {
+	t.Helper()
+	calls := 0
+	old := bitbucketProbe
+	bitbucketProbe = func() error { calls++; return err }
+	t.Cleanup(func() { bitbucketProbe = old })
+	return &calls
+}
+
+func TestBitbucketSSHKeysFollowsPaging(t *testing.T) {
+	f, c := newFakeBitbucket(t, 60)
+	keys, err := c.sshKeys()
+	if err != nil {
+		t.Fatalf("sshKeys: %v", err)
+	}
+	if len(keys) != 60 {
+		t.Fatalf("got %d keys, want 60", len(keys))
+	}
+	if keys[59].Label != "key 59" {
+		t.Errorf("last key = %+v", keys[59])
+	}
+	if f.gets != 3 {
+		t.Errorf("%d requests for 60 keys in pages of 25, want 3", f.gets)
+	}
+	for _, a := range f.auth {
+		if a != "Bearer secret-token" {
+			t.Errorf("Authorization = %q", a)
+		}
+	}
+}
+
+func TestRegisterSSHKeyAlreadyRegistered(t *testing.T) {
+	f, c := newFakeBitbucket(t, 40)
+	probes := stubBitbucketProbe(t, nil)
+	// the same key with another comment, on the second page
+	if err := registerSSHKey(c, "ssh-ed25519 AAAAkey33 me@laptop"); err != nil {
+		t.Fatalf("registerSSHKey: %v", err)
+	}
+	if len(f.posts) != 0 {
+		t.Errorf("uploaded %d keys, want none", len(f.posts))
+	}
+	if *probes != 0 {
+		t.Errorf("probed %d times without an upload", *probes)
+	}
+}
+
+func TestRegisterSSHKeyUploads(t *testing.T) {
+	f, c := newFakeBitbucket(t, 30)
+	probes := stubBitbucketProbe(t, nil)
+	pub := "ssh-ed25519 AAAAnewkey me@laptop"
+	if err := registerSSHKey(c, pub); err != nil {
+		t.Fatalf("registerSSHKey: %v", err)
+	}
+	if len(f.posts) != 1 || f.posts[0].Text != pub {
+		t.Fatalf("uploads = %+v, want the new key", f.posts)
+	}
+	if !strings.Contains(f.posts[0].Label, "chs-onboard") {
+		t.Errorf("label %q does not name chs-onboard", f.posts[0].Label)
+	}
+	if *probes != 1 {
+		t.Errorf("probed %d times after the upload, want 1", *probes)
+	}
+}
+
+func TestRegisterSSHKeyProbe(t *testing.T) {
+	tests := []struct {
+		name    string
+		probe   error
+		wantErr bool
+	}{
+		{"accepted", nil, false},
+		{"still rejected", fmt.Errorf("%w: bitbucket rejected the key", errSSHKeyNotAdded), true},
+		{"host key not seeded yet", errors.New("host key of bitbucket is missing"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, c := newFakeBitbucket(t, 0)
+			stubBitbucketProbe(t, tt.probe)
+			err := registerSSHKey(c, "ssh-ed25519 AAAAnewkey me@laptop")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("registerSSHKey = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr && !errors.Is(err, errSSHKeyNotAdded) {
+				t.Errorf("error %v does not wrap errSSHKeyNotAdded", err)
+			}
+		})
+	}
+}
+
+func TestBitbucketAPIErrors(t *testing.T) {
+	tests := []struct {
+		status int
+		want   string
+	}{
+		{http.StatusUnauthorized, "rejected the access token"},
+		{http.StatusForbidden, "may not manage SSH keys"},
+		{http.StatusInternalServerError, "500: status 500"},
+	}
+	for _, tt := range tests {
+		t.Run(strconv.Itoa(tt.status), func(t *testing.T) {
+			f, c := newFakeBitbucket(t, 0)
+			f.status = tt.status
+			probes := stubBitbucketProbe(t, nil)
+			err := registerSSHKey(c, "ssh-ed25519 AAAAnewkey me@laptop")
+			var apiErr *bitbucketAPIError
+			if !errors.As(err, &apiErr) || apiErr.Status != tt.status {
+				t.Fatalf("registerSSHKey = %v, want a %d API error", err, tt.status)
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error %q does not contain %q", err, tt.want)
+			}
+			if *probes != 0 {
+				t.Error("probed after a failed request")
+			}
+		})
+	}
+}
+
+func TestSameSSHKey(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"ssh-ed25519 AAAA one@host", "ssh-ed25519 AAAA two@host", true},
+		{"ssh-ed25519 AAAA", "ssh-ed25519 AAAA comment", true},
+		{"ssh-ed25519 AAAA", "ssh-rsa AAAA", false},
+		{"ssh-ed25519 AAAA", "ssh-ed25519 BBBB", false},
+		{"ssh-ed25519", "ssh-ed25519", false},
+	}
+	for _, tt := range tests {
+		if got := sameSSHKey(tt.a, tt.b); got != tt.want {
+			t.Errorf("sameSSHKey(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
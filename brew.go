@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+type brewKind string
+
+const (
+	brewTap     brewKind = "tap"
+	brewFormula brewKind = "brew"
+	brewCask    brewKind = "cask"
+)
+
+// brewPackage is one Brewfile entry. Optional packages are reported but do not fail the step.
+type brewPackage struct {
+	Kind     brewKind `json:"kind"`
+	Name     string   `json:"name"`
+	Optional bool     `json:"optional,omitempty"`
+}
+
+// baseBrewfile declares the Homebrew packages every laptop gets, in Brewfile syntax.
+// Use canonical formula names (openssl@3, not the openssl alias): they are matched
+// against `brew list --versions`, which only reports canonical names.
+const baseBrewfile = `tap "hudochenkov/sshpass"
+brew "openssl@3"
+brew "xz"
+brew "yubico-piv-tool"
+brew "jq"
+brew "pyenv"
+brew "pyenv-virtualenv"
+cask "opensc"
+`
+
+// sshpassBrewfile is installed on top of the base packages for gnoc-helper.
+const sshpassBrewfile = `tap "hudochenkov/sshpass"
+brew "hudochenkov/sshpass/sshpass"
+`
+
+var (
+	brewfile        = mustParseBrewfile(baseBrewfile)
+	sshpassPackages = mustParseBrewfile(sshpassBrewfile)
+)
+
+var brewfileLineRe = regexp.MustCompile(`^(tap|brew|cask)\s+"([^"]+)"\s*(?:,\s*(.*))?$`)
+
+// parseBrewfile reads the subset of Brewfile syntax chs-onboard uses: tap, brew and
+// cask lines with an optional `optional: true`.
+func parseBrewfile(text string) ([]brewPackage, error) {
+	var pkgs []brewPackage
+	for i, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		m := brewfileLineRe.FindStringSubmatch(line)
+		if m == nil {
+			return nil, fmt.Errorf("Brewfile line %d: cannot parse %q", i+1, line)
+		}
+		p := brewPackage{Kind: brewKind(m[1]), Name: m[2]}
+		switch opts := strings.TrimSpace(m[3]); opts {
+		case "":
+		case "optional: true":
+			p.Optional = true
+		default:
+			return nil, fmt.Errorf("Brewfile line %d: unsupported options %q", i+1, opts)
+		}
+		pkgs = append(pkgs, p)
+	}
+	return pkgs, nil
+}
+
+func mustParseBrewfile(text string) []brewPackage {
+	pkgs, err := parseBrewfile(text)
+	if err != nil {
+		panic(err)
+	}
+	return pkgs
+}
+
+func (p brewPackage) String() string { return string(p.Kind) + " " + p.Name }
+
+// shortName is the name brew lists the package under (tap formulae drop the tap prefix).
+func (p brewPackage) shortName() string {
+	if p.Kind == brewTap {
+		return p.Name
+	}
+	return path.Base(p.Name)
+}
+
+func (p brewPackage) installArgs() []string {
+	switch p.Kind {
+	case brewTap:
+		return []string{"tap", p.Name}
+	case brewCask:
+		return []string{"install", "--cask", p.Name}
+	}
+	return []string{"install", p.Name}
+}
+
+// brewInventory is what Homebrew reports as installed.
+type brewInventory struct {
+	Formulae map[string][]string
+	Casks    map[string][]string
+	Taps     map[string]bool
+	// Outdated maps formula and cask names to the newer version available.
+	Outdated map[string]string
+}
+
+// brewInventoryCache is the last inventory read from brew. Every check and step
+// guard shares it until a step that may install something forgets it.
+var brewInventoryCache *brewInventory
+
+// loadBrewInventory asks brew what is installed, once per run unless forgotten.
+// It makes no changes; a missing brew yields an empty inventory, which is not cached.
+func loadBrewInventory() brewInventory {
+	if brewInventoryCache != nil {
+		return *brewInventoryCache
+	}
+	inv := readBrewInventory()
+	if pathExists(platform.brewBin()) {
+		brewInventoryCache = &inv
+	}
+	return inv
+}
+
+// forgetBrewInventory drops the cached inventory after brew may have changed.
+func forgetBrewInventory() { brewInventoryCache = nil }
+
+func readBrewInventory() brewInventory {
+	inv := brewInventory{Formulae: map[string][]string{}, Casks: map[string][]string{}, Taps: map[string]bool{}, Outdated: map[string]string{}}
+	brew := platform.brewBin()
+	if !pathExists(brew) {
+		return inv
+	}
+	inv.Formulae = parseBrewVersions(cmdOutput(brew, "list", "--versions", "--formula"))
+	inv.Casks = parseBrewVersions(cmdOutput(brew, "list", "--versions", "--cask"))
+	for _, line := range strings.Split(cmdOutput(brew, "tap"), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			inv.Taps[line] = true
+		}
+	}
+	inv.Outdated = parseBrewOutdated(cmdOutput(brew, "outdated", "--json=v2"))
+	return inv
+}
+
+// parseBrewVersions parses `brew list --versions` lines of the form "name v1 [v2...]".
+func parseBrewVersions(out string) map[string][]string {
+	versions := map[string][]string{}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		versions[fields[0]] = fields[1:]
+	}
+	return versions
+}
+
+// parseBrewOutdated parses `brew outdated --json=v2`.
+func parseBrewOutdated(out string) map[string]string {
+	var doc struct {
+		Formulae []struct {
+			Name           string `json:"name"`
+			CurrentVersion string `json:"current_version"`
+		} `json:"formulae"`
+		Casks []struct {
+			Name           string `json:"name"`
+			CurrentVersion string `json:"current_version"`
+		} `json:"casks"`
+	}
+	outdated := map[string]string{}
+	if err := json.Unmarshal([]byte(out), &doc); err != nil {
+		return outdated
+	}
+	for _, f := range doc.Formulae {
+		outdated[f.Name] = f.CurrentVersion
+	}
+	for _, c := range doc.Casks {
+		outdated[c.Name] = c.CurrentVersion
+	}
+	return outdated
+}
+
+// installed reports whether p is present, with its installed version if brew lists one.
+func (inv brewInventory) installed(p brewPackage) (bool, string) {
+	var versions []string
+	var ok bool
+	switch p.Kind {
+	case brewTap:
+		return inv.Taps[p.Name], ""
+	case brewCask:
+		versions, ok = inv.Casks[p.shortName()]
+	default:
+		versions, ok = inv.Formulae[p.shortName()]
+	}
+	return ok, strings.Join(versions, " ")
+}
+
+// missing returns the packages in pkgs that are not installed.
+func (inv brewInventory) missing(pkgs []brewPackage) []brewPackage {
+	var out []brewPackage
+	for _, p := range pkgs {
+		if ok, _ := inv.installed(p); !ok {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+type brewResult struct {
+	Package brewPackage
+	Status  string // present, outdated, installed, failed
+	Version string
+	Newer   string
+	Err     error
+}
+
+// brewSync installs the missing packages in pkgs, leaves installed ones alone (reporting
+// any that are outdated) and prints a per-package result.
+func brewSync(log string, pkgs []brewPackage) ([]brewResult, error) {
+	inv := loadBrewInventory()
+	results := make([]brewResult, 0, len(pkgs))
+	for _, p := range pkgs {
+		r := brewResult{Package: p}
+		if ok, version := inv.installed(p); ok {
+			r.Status, r.Version = "present", version
+			if newer, ok := inv.Outdated[p.shortName()]; ok {
+				r.Status, r.Newer = "outdated", newer
+			}
+			results = append(results, r)
+			continue
+		}
+		argv := platform.brewCommand(p.installArgs()...)
+		forgetBrewInventory()
+		if _, err := runCmd(log, nil, argv[0], argv[1:]...); err != nil {
+			r.Status, r.Err = "failed", err
+		} else {
+			r.Status = "installed"
+		}
+		results = append(results, r)
+	}
+
+	var failed []string
+	fmt.Println("      Homebrew packages:")
+	for _, r := range results {
+		switch r.Status {
+		case "present":
+			fmt.Printf("      [✓] %-38s %s\n", r.Package, r.Version)
+		case "outdated":
+			fmt.Printf("      [↑] %-38s %s (%s available, not upgraded)\n", r.Package, r.Version, r.Newer)
+			logWarn(log, fmt.Sprintf("%s is outdated: %s installed, %s available", r.Package, r.Version, r.Newer), nil)
+		case "installed":
+			fmt.Printf("      [+] %-38s installed\n", r.Package)
+		case "failed":
+			fmt.Printf("      [✗] %-38s %s\n", r.Package, firstLine(r.Err.Error()))
+			if r.Package.Optional {
+				logWarn(log, fmt.Sprintf("optional %s failed to install", r.Package), nil)
+			} else {
+				failed = append(failed, r.Package.String())
+			}
+		}
+	}
+	if len(failed) > 0 {
+		return results, fmt.Errorf("brew packages failed: %s", strings.Join(failed, ", "))
+	}
+	return results, nil
+}
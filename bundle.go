@@ -0,0 +1,487 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// An offline bundle is a tar.gz holding what the selected tools fetch over the
+// network: a git bundle per repository, pip wheels per Python environment and
+// downloaded files, with a manifest of SHA-256 checksums. Homebrew, pyenv and the
+// Python builds in phase 1 still need public internet.
+const (
+	bundleFormat       = 1
+	bundleManifestName = "manifest.json"
+)
+
+type bundleEntry struct {
+	Path string `json:"path"`
+	// Kind is git, pip or file; Source is the git remote, pyenv version name or download URL.
+	Kind   string `json:"kind"`
+	Source string `json:"source"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+type bundleManifest struct {
+	Format  int           `json:"format"`
+	Created time.Time     `json:"created"`
+	Host    string        `json:"host"`
+	Arch    string        `json:"arch"`
+	Tools   []string      `json:"tools"`
+	Entries []bundleEntry `json:"entries"`
+}
+
+// installBundle is an extracted and verified bundle used by --from-bundle.
+type installBundle struct {
+	Dir      string
+	Manifest bundleManifest
+}
+
+// activeBundle is set by --from-bundle; steps then fetch from it instead of the network.
+var activeBundle *installBundle
+
+// runBundleCommand implements `chs-onboard bundle create`.
+func runBundleCommand(args []string) {
+	if len(args) == 0 || args[0] != "create" {
+		fmt.Fprintln(os.Stderr, "usage: chs-onboard bundle create [--out file] [--gnoc] [--only ids]")
+		os.Exit(2)
+	}
+	fs := flag.NewFlagSet("bundle create", flag.ExitOnError)
+	outFlag := fs.String("out", "chs-onboard-bundle.tar.gz", "bundle file to write")
+	gnocFlag := fs.Bool("gnoc", false, "include GNOC-specific tools")
+	onlyFlag := fs.String("only", "", "comma-separated tool IDs to bundle")
+	_ = fs.Parse(args[1:])
+
+	tools := planToolSelection(*onlyFlag, *gnocFlag)
+	if len(tools) == 0 {
+		fmt.Fprintln(os.Stderr, "No valid tool IDs provided. Use --list to see available tools.")
+		os.Exit(1)
+	}
+	if err := createBundle(tools, *outFlag); err != nil {
+		fmt.Fprintf(os.Stderr, "bundle create failed: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// bundleRepoName names a repository's git bundle after its project and repo.
+func bundleRepoName(remote string) string {
+	parts := strings.Split(strings.TrimSuffix(remote, ".git"), "/")
+	name := parts[len(parts)-1]
+	if len(parts) >= 2 {
+		name = strings.TrimPrefix(parts[len(parts)-2], "~") + "_" + name
+	}
+	return name
+}
+
+// pipEnvOf returns the Python environment a pip executable belongs to.
+func pipEnvOf(pip string) (pythonEnv, bool) {
+	for _, e := range pythonMatrix {
+		if pip == pyenvVersionDir(e.Name)+"/bin/pip" {
+			return e, true
+		}
+	}
+	return pythonEnv{}, false
+}
+
+// pipDownloadArgs turns `pip install` arguments into a `pip download` into dir.
+func pipDownloadArgs(install []string, dir string, mapPath func(string) (string, error)) ([]string, error) {
+	out := []string{"download", "--dest", dir}
+	for _, a := range install {
+		switch a {
+		case "install", "-U", "--upgrade", "--force-reinstall", "--user", "-e", "--editable":
+			continue
+		}
+		p, err := mapPath(a)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, p)
+	}
+	return out, nil
+}
+
+// createBundle fetches everything the steps of tools download and writes the bundle to out.
+func createBundle(tools []toolID, out string) error {
+	stage, err := os.MkdirTemp("", "chs-bundle-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(stage)
+	work, err := os.MkdirTemp("", "chs-bundle-work-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(work)
+
+	sources := map[string]bundleEntry{} // staged path → kind and source
+	mirrors := map[string]string{}      // remote → mirror clone
+	checkouts := map[string]string{}    // install dir → work tree cloned from the mirror
+	gitDirs := map[string]gitRepo{}     // install dir → repository
+	locks := map[string]string{}        // lockfile install path → work copy
+	envs := map[string]bool{}
+
+	mapPath := func(a string) (string, error) {
+		if p, ok := locks[a]; ok {
+			return p, nil
+		}
+		for dir, remote := range gitDirs {
+			rest, ok := strings.CutPrefix(a, dir)
+			if !ok || (rest != "" && !strings.HasPrefix(rest, "/")) {
+				continue
+			}
+			src, ok := checkouts[dir]
+			if !ok {
+				src = filepath.Join(work, "src-"+bundleRepoName(remote.Remote))
+				if _, err := runCmd("bundle", nil, "git", "clone", "--quiet", mirrors[remote.Remote], src); err != nil {
+					return "", fmt.Errorf("checking out %s for %s: %w", remote.Remote, a, err)
+				}
+				if rev := repoTarget(remote, src); remote.Branch+remote.Tag+remote.Commit != "" {
+					if _, err := runCmd("bundle", nil, "git", "-C", src, "checkout", "--quiet", "--detach", rev); err != nil {
+						return "", fmt.Errorf("checking out %s of %s for %s: %w", rev, remote.Remote, a, err)
+					}
+				}
+				checkouts[dir] = src
+			}
+			return src + rest, nil
+		}
+		return a, nil
+	}
+
+	for _, t := range tools {
+		steps, err := toolSteps(t, scriptGUIDPlaceholder)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("\n  [→] %s\n", t)
+		for _, s := range steps {
+			switch {
+			case s.Kind == stepGit:
+				gitDirs[s.Dst] = s.repo()
+				if _, done := mirrors[s.Remote]; done {
+					continue
+				}
+				name := bundleRepoName(s.Remote)
+				mirror := filepath.Join(work, "mirror-"+name)
+				rel := "git/" + name + ".bundle"
+				if err := os.MkdirAll(filepath.Join(stage, "git"), 0755); err != nil {
+					return err
+				}
+				if _, err := runCmd("bundle", nil, "git", "clone", "--quiet", "--mirror", s.Remote, mirror); err != nil {
+					return err
+				}
+				if _, err := runCmd("bundle", nil, "git", "-C", mirror, "bundle", "create", filepath.Join(stage, rel), "--all"); err != nil {
+					return err
+				}
+				mirrors[s.Remote] = mirror
+				sources[rel] = bundleEntry{Kind: "git", Source: s.Remote}
+				fmt.Printf("      [+] %s\n", rel)
+			case s.Kind == stepFile && strings.HasPrefix(s.Asset, "pip-lock/"):
+				p := filepath.Join(work, "locks", filepath.Base(s.Dst))
+				if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+					return err
+				}
+				data, err := s.fileData()
+				if err != nil {
+					return err
+				}
+				if err := os.WriteFile(p, data, 0644); err != nil {
+					return err
+				}
+				locks[s.Dst] = p
+			case s.Kind == stepFetch:
+				cached, err := newDownloader().fetch(download{URL: s.URL, SHA256: s.SHA256})
+				if err != nil {
+					return err
+				}
+				rel := "files/" + filepath.Base(cached)
+				if err := os.MkdirAll(filepath.Join(stage, "files"), 0755); err != nil {
+					return err
+				}
+				data, err := os.ReadFile(cached)
+				if err != nil {
+					return err
+				}
+				if err := os.WriteFile(filepath.Join(stage, rel), data, 0644); err != nil {
+					return err
+				}
+				sources[rel] = bundleEntry{Kind: "file", Source: s.URL}
+				fmt.Printf("      [+] %s (%s)\n", rel, s.URL)
+			case s.Kind == stepExec:
+				e, ok := pipEnvOf(s.Args[0])
+				if !ok || len(s.Args) < 2 || s.Args[1] != "install" {
+					continue
+				}
+				if !pathExists(s.Args[0]) {
+					return fmt.Errorf("%s is not installed here; install it before bundling its packages", e.Name)
+				}
+				dir := filepath.Join(stage, "pip", e.Name)
+				env := baseEnv
+				if s.Venv != "" {
+					env = pyenvEnv(s.Venv)
+				}
+				env = append(append([]string(nil), env...), s.Env...)
+				if !envs[e.Name] {
+					// Build backends for source installs, which pip does not download with the requirements.
+					if _, err := runCmd("bundle", env, s.Args[0], "download", "--dest", dir, "setuptools", "wheel"); err != nil {
+						return err
+					}
+					envs[e.Name] = true
+				}
+				args, err := pipDownloadArgs(s.Args[1:], dir, mapPath)
+				if err != nil {
+					return err
+				}
+				if _, err := runCmd("bundle", env, s.Args[0], args...); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	for name := range envs {
+		fmt.Printf("      [+] pip/%s\n", name)
+	}
+	return writeBundleArchive(stage, out, tools, sources)
+}
+
+// writeBundleArchive checksums the staged files into a manifest and writes stage as a tar.gz.
+func writeBundleArchive(stage, out string, tools []toolID, sources map[string]bundleEntry) error {
+	host, _ := os.Hostname()
+	m := bundleManifest{Format: bundleFormat, Created: time.Now().UTC(), Host: host, Arch: platform.Arch, Tools: toolIDsToNames(tools)}
+	err := filepath.Walk(stage, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, _ := filepath.Rel(stage, p)
+		rel = filepath.ToSlash(rel)
+		sum, err := fileSHA256(p)
+		if err != nil {
+			return err
+		}
+		e := sources[rel]
+		if strings.HasPrefix(rel, "pip/") {
+			e = bundleEntry{Kind: "pip", Source: strings.Split(rel, "/")[1]}
+		}
+		e.Path, e.Size, e.SHA256 = rel, info.Size(), sum
+		m.Entries = append(m.Entries, e)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Slice(m.Entries, func(i, j int) bool { return m.Entries[i].Path < m.Entries[j].Path })
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(stage, bundleManifestName), append(data, '\n'), 0644); err != nil {
+		return err
+	}
+
+	f, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	files := append([]string{bundleManifestName}, entryPaths(m.Entries)...)
+	for _, rel := range files {
+		if err := addTarFile(tw, filepath.Join(stage, filepath.FromSlash(rel)), rel); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	fmt.Printf("\nWrote %s: %d files for %d tools.\n", out, len(m.Entries), len(tools))
+	return nil
+}
+
+func entryPaths(entries []bundleEntry) []string {
+	paths := make([]string, 0, len(entries))
+	for _, e := range entries {
+		paths = append(paths, e.Path)
+	}
+	return paths
+}
+
+func addTarFile(tw *tar.Writer, src, name string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: info.Size(), ModTime: info.ModTime(), Typeflag: tar.TypeReg}); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+func fileSHA256(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// openBundle extracts a bundle under ~/.chs-onboard/bundles (once per archive) and
+// verifies every file against the manifest.
+func openBundle(archive string) (*installBundle, error) {
+	sum, err := fileSHA256(archive)
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Join(os.Getenv("HOME"), ".chs-onboard", "bundles", sum[:16])
+	if !pathExists(filepath.Join(dir, bundleManifestName)) {
+		_ = os.RemoveAll(dir)
+		if err := extractTarGz(archive, dir); err != nil {
+			_ = os.RemoveAll(dir)
+			return nil, fmt.Errorf("extracting %s: %w", archive, err)
+		}
+	}
+	data, err := os.ReadFile(filepath.Join(dir, bundleManifestName))
+	if err != nil {
+		return nil, err
+	}
+	b := &installBundle{Dir: dir}
+	if err := json.Unmarshal(data, &b.Manifest); err != nil {
+		return nil, fmt.Errorf("reading manifest: %w", err)
+	}
+	if b.Manifest.Format != bundleFormat {
+		return nil, fmt.Errorf("bundle format %d is not supported by this build (want %d)", b.Manifest.Format, bundleFormat)
+	}
+	if b.Manifest.Arch != platform.Arch {
+		return nil, fmt.Errorf("bundle was made on an %s Mac and this one is %s; its Python packages would not install here", b.Manifest.Arch, platform.Arch)
+	}
+	for _, e := range b.Manifest.Entries {
+		got, err := fileSHA256(b.path(e.Path))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", e.Path, err)
+		}
+		if got != e.SHA256 {
+			return nil, fmt.Errorf("%s: checksum mismatch (bundle corrupt or modified)", e.Path)
+		}
+	}
+	return b, nil
+}
+
+// extractTarGz extracts regular files from archive into dst, refusing paths that
+// would land outside it.
+func extractTarGz(archive, dst string) error {
+	f, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(gz)
+	for {
+		h, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if h.Typeflag != tar.TypeReg {
+			continue
+		}
+		name := path.Clean(h.Name)
+		if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return fmt.Errorf("unsafe path %q in bundle", h.Name)
+		}
+		target := filepath.Join(dst, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(out, tr)
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (b *installBundle) path(rel string) string {
+	return filepath.Join(b.Dir, filepath.FromSlash(rel))
+}
+
+// entry returns the bundle file of the given kind fetched from source.
+func (b *installBundle) entry(kind, source string) (string, bool) {
+	for _, e := range b.Manifest.Entries {
+		if e.Kind == kind && e.Source == source {
+			return b.path(e.Path), true
+		}
+	}
+	return "", false
+}
+
+// gitBundle returns the bundle file of a repository. A bundle made while remotes
+// pointed elsewhere (another git base or mirror) still matches by project and
+// repository name.
+func (b *installBundle) gitBundle(remote string) (string, bool) {
+	if p, ok := b.entry("git", remote); ok {
+		return p, true
+	}
+	rel := "git/" + bundleRepoName(remote) + ".bundle"
+	for _, e := range b.Manifest.Entries {
+		if e.Kind == "git" && e.Path == rel {
+			return b.path(e.Path), true
+		}
+	}
+	return "", false
+}
+
+// rewrite points a pip install step at the bundle's wheels instead of the index.
+// Downloads and git steps look up their bundle files when they run.
+func (b *installBundle) rewrite(s step) step {
+	if s.Kind != stepExec || len(s.Args) < 2 {
+		return s
+	}
+	if e, ok := pipEnvOf(s.Args[0]); ok && s.Args[1] == "install" {
+		if _, ok := b.entry("pip", e.Name); ok {
+			args := []string{s.Args[0], "install", "--no-index", "--find-links", b.path("pip/" + e.Name)}
+			s.Args = append(args, s.Args[2:]...)
+		} else {
+			logWarn(s.Log, "bundle has no wheels for "+e.Name+"; pip will use the network", nil)
+		}
+	}
+	return s
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+)
+
+type doctorLevel int
+
+const (
+	doctorOK doctorLevel = iota
+	doctorWarn
+	doctorFail
+)
+
+func (l doctorLevel) mark() string {
+	switch l {
+	case doctorWarn:
+		return "[!]"
+	case doctorFail:
+		return "[✗]"
+	}
+	return "[✓]"
+}
+
+// doctorFinding is one line of `chs-onboard doctor` output.
+type doctorFinding struct {
+	Level   doctorLevel
+	Message string
+}
+
+// runDoctorCommand implements `chs-onboard doctor`: health checks on what earlier
+// runs installed that can go bad over time. It exits 1 when a check fails.
+func runDoctorCommand(args []string) {
+	fs := flag.NewFlagSet("doctor", flag.ExitOnError)
+	days := fs.Int("days", int(trustRootExpiryWarning.Hours()/24), "warn about certificates expiring within this many days")
+	_ = fs.Parse(args)
+
+	checks := []struct {
+		name string
+		run  func() []doctorFinding
+	}{
+		{"Sparta trust roots", func() []doctorFinding { return doctorTrustRoots(time.Duration(*days) * 24 * time.Hour) }},
+	}
+	worst := doctorOK
+	for _, c := range checks {
+		fmt.Printf("\n── %s\n", c.name)
+		for _, f := range c.run() {
+			fmt.Printf("  %s %s\n", f.Level.mark(), f.Message)
+			worst = max(worst, f.Level)
+		}
+	}
+	if worst == doctorFail {
+		os.Exit(1)
+	}
+}
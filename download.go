@@ -0,0 +1,435 @@
+package main
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// download is a file fetched over HTTP. With SHA256 set the download is pinned:
+// a mismatching file is rejected and a cached copy is used without the network.
+type download struct {
+	URL    string `json:"url"`
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// defaultDownloads is the download manifest. Entries name a versioned release, never
+// a "latest" URL, so the file behind them does not change; a newer release is
+// taken by bumping the URL and sha256 here or in ~/.chs-onboard/downloads.json.
+var defaultDownloads = map[string]download{
+	// The sha256 of this release has not been recorded yet; until it is, the
+	// download is verified by TLS only and installDownload warns.
+	"iterm2": {URL: "https://iterm2.com/downloads/stable/iTerm2-3_5_11.zip"},
+}
+
+// downloads is defaultDownloads with entries from ~/.chs-onboard/downloads.json applied.
+var downloads = loadDownloads()
+
+func loadDownloads() map[string]download {
+	m := map[string]download{}
+	for name, d := range defaultDownloads {
+		m[name] = d
+	}
+	path := filepath.Join(os.Getenv("HOME"), ".chs-onboard", "downloads.json")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return m
+	}
+	var override map[string]download
+	if err := json.Unmarshal(data, &override); err != nil {
+		fmt.Fprintf(os.Stderr, "  [!] ignoring %s: %v\n", path, err)
+		return m
+	}
+	for name, d := range override {
+		if d.URL == "" {
+			fmt.Fprintf(os.Stderr, "  [!] ignoring %s entry %q: url is required\n", path, name)
+			continue
+		}
+		m[name] = d
+	}
+	return m
+}
+
+// downloader fetches downloads into a content-addressed cache: finished files are
+// stored under their SHA-256, partial ones under a hash of their URL so an
+// interrupted download resumes with a range request. The SHA-256 each URL last
+// downloaded to is recorded too, so unpinned downloads are reused like pinned ones;
+// manifest URLs name versioned releases, so the file behind them does not change.
+type downloader struct {
+	Client   *http.Client
+	CacheDir string
+	// Progress is called as bytes arrive; total is -1 when the server does not say.
+	Progress func(url string, done, total int64)
+}
+
+func newDownloader() *downloader {
+	return &downloader{
+		Client:   &http.Client{Timeout: 30 * time.Minute},
+		CacheDir: filepath.Join(os.Getenv("HOME"), ".chs-onboard", "cache"),
+		Progress: printDownloadProgress(),
+	}
+}
+
+func (d *downloader) cachedPath(sum string) string {
+	return filepath.Join(d.CacheDir, "sha256", sum)
+}
+
+func (d *downloader) partialPath(url string) string {
+	sum := sha256.Sum256([]byte(url))
+	return filepath.Join(d.CacheDir, "partial", hex.EncodeToString(sum[:12]))
+}
+
+// urlPath records the SHA-256 of the file url last downloaded to.
+func (d *downloader) urlPath(url string) string {
+	sum := sha256.Sum256([]byte(url))
+	return filepath.Join(d.CacheDir, "url", hex.EncodeToString(sum[:12]))
+}
+
+// fetch returns the path of dl's content in the cache, downloading what is missing.
+func (d *downloader) fetch(dl download) (string, error) {
+	want := dl.SHA256
+	if want == "" {
+		if data, err := os.ReadFile(d.urlPath(dl.URL)); err == nil {
+			want = strings.TrimSpace(string(data))
+		}
+	}
+	if want != "" && pathExists(d.cachedPath(want)) {
+		return d.cachedPath(want), nil
+	}
+	part := d.partialPath(dl.URL)
+	if err := os.MkdirAll(filepath.Dir(part), 0755); err != nil {
+		return "", err
+	}
+	if err := d.resume(dl.URL, part); err != nil {
+		return "", err
+	}
+	sum, err := fileSHA256(part)
+	if err != nil {
+		return "", err
+	}
+	if dl.SHA256 != "" && !strings.EqualFold(sum, dl.SHA256) {
+		_ = os.Remove(part)
+		_ = os.Remove(part + ".etag")
+		return "", fmt.Errorf("%s: sha256 %s does not match the pinned %s", dl.URL, sum, dl.SHA256)
+	}
+	dst := d.cachedPath(sum)
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return "", err
+	}
+	if err := os.Rename(part, dst); err != nil {
+		return "", err
+	}
+	_ = os.Remove(part + ".etag")
+	if err := os.MkdirAll(filepath.Dir(d.urlPath(dl.URL)), 0755); err == nil {
+		_ = os.WriteFile(d.urlPath(dl.URL), []byte(sum+"\n"), 0644)
+	}
+	return dst, nil
+}
+
+// resume downloads url into part, continuing from its current size. The ETag of
+// the first response is kept beside it and sent as If-Range, so a changed file
+// restarts from the beginning instead of being spliced.
+func (d *downloader) resume(url, part string) error {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	var offset int64
+	if info, err := os.Stat(part); err == nil && info.Size() > 0 {
+		offset = info.Size()
+		req.Header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+		if etag, err := os.ReadFile(part + ".etag"); err == nil {
+			req.Header.Set("If-Range", string(etag))
+		}
+	}
+	resp, err := d.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	flags := os.O_CREATE | os.O_WRONLY
+	total := resp.ContentLength
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		flags |= os.O_APPEND
+		if total >= 0 {
+			total += offset
+		}
+	case http.StatusOK:
+		flags |= os.O_TRUNC
+		offset = 0
+	case http.StatusRequestedRangeNotSatisfiable:
+		// The partial file is already complete (or longer than the file now is);
+		// the checksum decides which.
+		return nil
+	default:
+		return fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		_ = os.WriteFile(part+".etag", []byte(etag), 0644)
+	} else {
+		_ = os.Remove(part + ".etag")
+	}
+
+	f, err := os.OpenFile(part, flags, 0644)
+	if err != nil {
+		return err
+	}
+	done := offset
+	buf := make([]byte, 256*1024)
+	for {
+		n, rerr := resp.Body.Read(buf)
+		if n > 0 {
+			if _, werr := f.Write(buf[:n]); werr != nil {
+				f.Close()
+				return werr
+			}
+			done += int64(n)
+			if d.Progress != nil {
+				d.Progress(url, done, total)
+			}
+		}
+		if errors.Is(rerr, io.EOF) {
+			break
+		}
+		if rerr != nil {
+			f.Close()
+			return fmt.Errorf("%s: %w (rerun to resume)", url, rerr)
+		}
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if total >= 0 && done != total {
+		return fmt.Errorf("%s: got %d of %d bytes (rerun to resume)", url, done, total)
+	}
+	return nil
+}
+
+// printDownloadProgress returns a Progress func that prints at most once a second.
+func printDownloadProgress() func(string, int64, int64) {
+	var last time.Time
+	return func(url string, done, total int64) {
+		finished := total >= 0 && done >= total
+		if !finished && time.Since(last) < time.Second {
+			return
+		}
+		last = time.Now()
+		line := fmt.Sprintf("      [↓] %.1f MB", float64(done)/1e6)
+		if total > 0 {
+			line = fmt.Sprintf("      [↓] %.1f/%.1f MB (%d%%)", float64(done)/1e6, float64(total)/1e6, done*100/total)
+		}
+		if attended() {
+			fmt.Printf("\r%s", line)
+			if finished {
+				fmt.Println()
+			}
+			return
+		}
+		fmt.Println(line)
+	}
+}
+
+// extractZip extracts src into dir, keeping file modes and symlinks. Entries and
+// symlink targets that would resolve outside dir are rejected, as are symlink
+// targets with .. in them and entries under a symlink the archive created, so
+// chained links cannot walk out of dir either.
+func extractZip(src, dir string) error {
+	r, err := zip.OpenReader(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	root, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	inside := func(p string) bool {
+		rel, err := filepath.Rel(root, p)
+		return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+	}
+	for _, f := range r.File {
+		if filepath.IsAbs(f.Name) || strings.HasPrefix(f.Name, "/") {
+			return fmt.Errorf("unsafe path %q in %s", f.Name, src)
+		}
+		target := filepath.Join(root, filepath.FromSlash(f.Name))
+		if !inside(target) {
+			return fmt.Errorf("unsafe path %q in %s", f.Name, src)
+		}
+		if err := noSymlinkParents(root, target); err != nil {
+			return fmt.Errorf("unsafe path %q in %s: %w", f.Name, src, err)
+		}
+		mode := f.Mode()
+		switch {
+		case mode.IsDir():
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+			continue
+		case mode&os.ModeSymlink != 0:
+			link, err := readZipEntry(f)
+			if err != nil {
+				return err
+			}
+			dest := string(link)
+			for _, elem := range strings.Split(filepath.ToSlash(dest), "/") {
+				if elem == ".." {
+					return fmt.Errorf("symlink %q in %s has .. in its target %q", f.Name, src, dest)
+				}
+			}
+			if !filepath.IsAbs(dest) {
+				dest = filepath.Join(filepath.Dir(target), dest)
+			}
+			if !inside(dest) {
+				return fmt.Errorf("symlink %q in %s points outside the archive", f.Name, src)
+			}
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			_ = os.Remove(target)
+			if err := os.Symlink(string(link), target); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		if err := writeZipFile(f, target, mode.Perm()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// noSymlinkParents returns an error if any directory between root and target is a symlink.
+func noSymlinkParents(root, target string) error {
+	rel, err := filepath.Rel(root, filepath.Dir(target))
+	if err != nil || rel == "." {
+		return err
+	}
+	p := root
+	for _, elem := range strings.Split(rel, string(filepath.Separator)) {
+		p = filepath.Join(p, elem)
+		info, err := os.Lstat(p)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("%s is a symlink", p)
+		}
+	}
+	return nil
+}
+
+// unzipInto extracts src into a temporary directory beside dst's contents and then
+// moves each top-level entry into dst, replacing what is there, so a failed or
+// refused extraction leaves nothing half-written in dst.
+func unzipInto(src, dst string) error {
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		return err
+	}
+	tmp, err := os.MkdirTemp(dst, ".chs-unzip-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	if err := extractZip(src, tmp); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(tmp)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		target := filepath.Join(dst, e.Name())
+		if err := os.RemoveAll(target); err != nil {
+			return err
+		}
+		if err := os.Rename(filepath.Join(tmp, e.Name()), target); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readZipEntry(f *zip.File) ([]byte, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+func writeZipFile(f *zip.File, target string, perm os.FileMode) error {
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	// A symlink left by an earlier extraction must not redirect the write.
+	if info, err := os.Lstat(target); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		if err := os.Remove(target); err != nil {
+			return err
+		}
+	}
+	out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm|0200)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, rc); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// installDownload fetches dl (from the active bundle when it has the file) and
+// unzips it into dst, or copies it to dst.
+func installDownload(log string, dl download, dst string, unzip bool) error {
+	src, ok := "", false
+	if activeBundle != nil {
+		src, ok = activeBundle.entry("file", dl.URL)
+	}
+	if ok && dl.SHA256 != "" {
+		if sum, err := fileSHA256(src); err != nil || !strings.EqualFold(sum, dl.SHA256) {
+			return fmt.Errorf("bundle copy of %s does not match the pinned sha256; rebuild the bundle", dl.URL)
+		}
+	}
+	if !ok {
+		if dl.SHA256 == "" {
+			logWarn(log, dl.URL+" is not pinned to a sha256; downloading without verification", nil)
+		}
+		var err error
+		if src, err = newDownloader().fetch(dl); err != nil {
+			return err
+		}
+	}
+	logInfo(log, "downloaded "+dl.URL, map[string]string{"path": src})
+	if unzip {
+		return unzipInto(src, dst)
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(dst, data, 0644)
+}
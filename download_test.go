@@ -0,0 +1,313 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fileServer serves content with an ETag, honouring Range and If-Range, and
+// records the Range and If-Range headers of each request.
+type fileServer struct {
+	content []byte
+	etag    string
+
+	mu      sync.Mutex
+	ranges  []string
+	ifRange []string
+}
+
+func (s *fileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.ranges = append(s.ranges, r.Header.Get("Range"))
+	s.ifRange = append(s.ifRange, r.Header.Get("If-Range"))
+	s.mu.Unlock()
+	w.Header().Set("ETag", s.etag)
+	http.ServeContent(w, r, "file.zip", time.Time{}, bytes.NewReader(s.content))
+}
+
+func testContent() []byte {
+	return bytes.Repeat([]byte("chs-onboard download test\n"), 4096)
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func newTestDownloader(t *testing.T, srv *httptest.Server) *downloader {
+	t.Helper()
+	return &downloader{Client: srv.Client(), CacheDir: t.TempDir()}
+}
+
+func TestFetchResumesWithRange(t *testing.T) {
+	fs := &fileServer{content: testContent(), etag: `"v1"`}
+	srv := httptest.NewServer(fs)
+	defer srv.Close()
+	d := newTestDownloader(t, srv)
+	url := srv.URL + "/file.zip"
+
+	part := d.partialPath(url)
+	half := len(fs.content) / 2
+	if err := os.MkdirAll(filepath.Dir(part), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(part, fs.content[:half], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(part+".etag", []byte(fs.etag), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := d.fetch(download{URL: url, SHA256: sha256Hex(fs.content)})
+	if err != nil {
+		t.Fatalf("fetch: %v", err)
+	}
+	data, err := os.ReadFile(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, fs.content) {
+		t.Fatalf("resumed file differs from the original (%d bytes, want %d)", len(data), len(fs.content))
+	}
+	if want := "bytes=" + strconv.Itoa(half) + "-"; len(fs.ranges) != 1 || fs.ranges[0] != want {
+		t.Errorf("Range headers = %q, want [%q]", fs.ranges, want)
+	}
+	if len(fs.ifRange) != 1 || fs.ifRange[0] != fs.etag {
+		t.Errorf("If-Range headers = %q, want [%q]", fs.ifRange, fs.etag)
+	}
+	if pathExists(part) || pathExists(part+".etag") {
+		t.Error("partial download left behind")
+	}
+}
+
+func TestFetchRestartsWhenIfRangeDoesNotMatch(t *testing.T) {
+	fs := &fileServer{content: testContent(), etag: `"v2"`}
+	srv := httptest.NewServer(fs)
+	defer srv.Close()
+	d := newTestDownloader(t, srv)
+	url := srv.URL + "/file.zip"
+
+	// a partial download of an older version of the file
+	part := d.partialPath(url)
+	if err := os.MkdirAll(filepath.Dir(part), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(part, bytes.Repeat([]byte("x"), 1000), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(part+".etag", []byte(`"v1"`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := d.fetch(download{URL: url, SHA256: sha256Hex(fs.content)})
+	if err != nil {
+		t.Fatalf("fetch: %v", err)
+	}
+	data, err := os.ReadFile(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, fs.content) {
+		t.Fatal("stale partial file was spliced into the new download")
+	}
+	if len(fs.ifRange) != 1 || fs.ifRange[0] != `"v1"` {
+		t.Errorf("If-Range headers = %q, want the stale ETag", fs.ifRange)
+	}
+}
+
+func TestFetchRejectsChecksumMismatch(t *testing.T) {
+	fs := &fileServer{content: testContent(), etag: `"v1"`}
+	srv := httptest.NewServer(fs)
+	defer srv.Close()
+	d := newTestDownloader(t, srv)
+	url := srv.URL + "/file.zip"
+
+	_, err := d.fetch(download{URL: url, SHA256: sha256Hex([]byte("something else"))})
+	if err == nil || !strings.Contains(err.Error(), "does not match the pinned") {
+		t.Fatalf("fetch error = %v, want a checksum mismatch", err)
+	}
+	if part := d.partialPath(url); pathExists(part) || pathExists(part+".etag") {
+		t.Error("mismatching download kept for resuming")
+	}
+	if entries, _ := os.ReadDir(filepath.Join(d.CacheDir, "sha256")); len(entries) > 0 {
+		t.Errorf("mismatching download cached: %v", entries)
+	}
+}
+
+func TestFetchUsesPinnedCacheWithoutNetwork(t *testing.T) {
+	content := testContent()
+	d := &downloader{Client: &http.Client{}, CacheDir: t.TempDir()}
+	sum := sha256Hex(content)
+	if err := os.MkdirAll(filepath.Dir(d.cachedPath(sum)), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(d.cachedPath(sum), content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	got, err := d.fetch(download{URL: "http://127.0.0.1:0/unreachable.zip", SHA256: sum})
+	if err != nil {
+		t.Fatalf("fetch: %v", err)
+	}
+	if got != d.cachedPath(sum) {
+		t.Errorf("fetch = %s, want the cached %s", got, d.cachedPath(sum))
+	}
+}
+
+// zipEntry is a file, directory (name ending in /) or symlink (Link set) in a test zip.
+type zipEntry struct {
+	Name string
+	Body string
+	Link string
+}
+
+func writeTestZip(t *testing.T, entries []zipEntry) string {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, e := range entries {
+		h := &zip.FileHeader{Name: e.Name, Method: zip.Deflate}
+		body := e.Body
+		switch {
+		case e.Link != "":
+			h.SetMode(os.ModeSymlink | 0777)
+			body = e.Link
+		case strings.HasSuffix(e.Name, "/"):
+			h.SetMode(os.ModeDir | 0755)
+		default:
+			h.SetMode(0644)
+		}
+		w, err := zw.CreateHeader(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "test.zip")
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestExtractZip(t *testing.T) {
+	src := writeTestZip(t, []zipEntry{
+		{Name: "App.app/"},
+		{Name: "App.app/Contents/Versions/A/App", Body: "binary"},
+		{Name: "App.app/Contents/Versions/Current", Link: "A"},
+		{Name: "App.app/Contents/App", Link: "Versions/Current/App"},
+	})
+	dir := t.TempDir()
+	if err := extractZip(src, dir); err != nil {
+		t.Fatalf("extractZip: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "App.app/Contents/App"))
+	if err != nil || string(data) != "binary" {
+		t.Errorf("reading through the archive's symlinks: %q, %v", data, err)
+	}
+}
+
+func TestExtractZipRejectsTraversal(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []zipEntry
+	}{
+		{"dot-dot path", []zipEntry{{Name: "../pwned.txt", Body: "x"}}},
+		{"absolute path", []zipEntry{{Name: "/tmp/pwned.txt", Body: "x"}}},
+		{"symlink outside", []zipEntry{{Name: "out", Link: "/tmp"}}},
+		{"symlink with dot-dot", []zipEntry{{Name: "deep/a", Link: ".."}}},
+		{"chained symlinks", []zipEntry{
+			{Name: "deep/"},
+			{Name: "deep/a", Link: ".."},
+			{Name: "b", Link: "deep/a/.."},
+			{Name: "b/pwned.txt", Body: "x"},
+		}},
+		{"file under a symlink", []zipEntry{
+			{Name: "sub/"},
+			{Name: "link", Link: "sub"},
+			{Name: "link/pwned.txt", Body: "x"},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parent := t.TempDir()
+			dir := filepath.Join(parent, "dst")
+			src := writeTestZip(t, tt.entries)
+			if err := extractZip(src, dir); err == nil {
+				t.Fatal("extractZip accepted an unsafe archive")
+			}
+			if pathExists(filepath.Join(parent, "pwned.txt")) {
+				t.Fatal("archive wrote outside the destination")
+			}
+		})
+	}
+}
+
+func TestUnzipIntoLeavesNothingOnFailure(t *testing.T) {
+	dst := t.TempDir()
+	src := writeTestZip(t, []zipEntry{
+		{Name: "App.app/Contents/Info.plist", Body: "plist"},
+		{Name: "App.app/out", Link: "/etc"},
+	})
+	if err := unzipInto(src, dst); err == nil {
+		t.Fatal("unzipInto accepted an unsafe archive")
+	}
+	if entries, _ := os.ReadDir(dst); len(entries) > 0 {
+		t.Errorf("failed extraction left %v in the destination", entries)
+	}
+
+	good := writeTestZip(t, []zipEntry{{Name: "App.app/Contents/Info.plist", Body: "new"}})
+	if err := os.MkdirAll(filepath.Join(dst, "App.app/Contents"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dst, "App.app/Contents/Stale"), []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := unzipInto(good, dst); err != nil {
+		t.Fatalf("unzipInto: %v", err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dst, "App.app/Contents/Info.plist")); string(data) != "new" {
+		t.Errorf("Info.plist = %q, want the extracted one", data)
+	}
+	if pathExists(filepath.Join(dst, "App.app/Contents/Stale")) {
+		t.Error("the old app was not replaced")
+	}
+}
+
+func TestFetchReusesUnpinnedDownload(t *testing.T) {
+	fs := &fileServer{content: testContent(), etag: `"v1"`}
+	srv := httptest.NewServer(fs)
+	defer srv.Close()
+	d := newTestDownloader(t, srv)
+	url := srv.URL + "/file.zip"
+
+	first, err := d.fetch(download{URL: url})
+	if err != nil {
+		t.Fatalf("first fetch: %v", err)
+	}
+	second, err := d.fetch(download{URL: url})
+	if err != nil {
+		t.Fatalf("second fetch: %v", err)
+	}
+	if first != second || first != d.cachedPath(sha256Hex(fs.content)) {
+		t.Errorf("fetches returned %s and %s, want the cached file", first, second)
+	}
+	if len(fs.ranges) != 1 {
+		t.Errorf("%d requests for an unpinned download fetched twice, want 1", len(fs.ranges))
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// failureHint explains a recognised command failure and how to fix it.
+type failureHint struct {
+	ID      string
+	Pattern *regexp.Regexp
+	Explain string
+	Fix     string
+	// fixSteps, if set, returns steps that repair the problem automatically. cmd is
+	// the failed command line; an empty result means no automatic fix applies.
+	fixSteps func(cmd []string) []step
+}
+
+// failureCatalog lists known failures, checked in order against failed command output.
+var failureCatalog = []*failureHint{
+	{
+		ID:      "setuptools_api",
+		Pattern: regexp.MustCompile(`(?i)no module named '?pkg_resources|cannot import name '\w+' from 'setuptools|module 'setuptools[.\w]*' has no attribute`),
+		Explain: "the installed setuptools dropped APIs that this package's build still uses (known hops-cli issue).",
+		Fix:     "pin setuptools in the same Python: pip install --force-reinstall setuptools==" + hopsSetuptoolsVersion(),
+		fixSteps: func(cmd []string) []step {
+			if len(cmd) == 0 || !strings.HasPrefix(filepath.Base(cmd[0]), "pip") {
+				return nil
+			}
+			return []step{execStep("fix_setuptools", cmd[0], "install", "--no-cache-dir", "--force-reinstall", "setuptools=="+hopsSetuptoolsVersion())}
+		},
+	},
+	{
+		ID:      "openssl11_missing",
+		Pattern: regexp.MustCompile(`(?i)openssl/\w+\.h'?:? (no such file|file not found)|openssl@1\.1[^\n]*(no such file|not found)|could not find openssl|library not found for -l(ssl|crypto)`),
+		Explain: "the build needs OpenSSL 1.1 headers and libraries, which are not installed (needed by ncpcli).",
+		Fix:     "brew install rbenv/tap/openssl@1.1, then retry",
+		fixSteps: func([]string) []step {
+			argv := platform.brewCommand("install", "rbenv/tap/openssl@1.1")
+			return []step{execStep("fix_openssl", argv[0], argv[1:]...)}
+		},
+	},
+	{
+		ID:      "bitbucket_denied",
+		Pattern: regexp.MustCompile(`(?i)permission denied \(publickey\)|repository access denied|could not read from remote repository`),
+		Explain: "Bitbucket rejected the SSH key, usually because it has not been added to your Bitbucket account yet.",
+		Fix:     "add " + sshKeyPath() + ".pub at https://bitbucket.oci.oraclecorp.com/plugins/servlet/ssh/account/keys, make sure VPN is connected, then retry (with CHS_BITBUCKET_TOKEN set to a personal access token, chs-onboard adds the key itself)",
+	},
+	{
+		ID:      "python_no_lzma",
+		Pattern: regexp.MustCompile(`(?i)no module named '?_lzma|lzma extension was not compiled|lzma\.h: no such file`),
+		Explain: "Python was built without xz (lzma) support because xz was not installed.",
+		Fix:     "brew install xz, then rebuild the Python version with pyenv install --force",
+		fixSteps: func([]string) []step {
+			argv := platform.brewCommand("install", "xz")
+			return []step{execStep("fix_xz", argv[0], argv[1:]...)}
+		},
+	},
+	{
+		ID:      "xcode_clt_missing",
+		Pattern: regexp.MustCompile(`(?i)xcrun: error: invalid active developer path|no developer tools were found`),
+		Explain: "the Xcode Command Line Tools are missing or were removed by a macOS update.",
+		Fix:     "run xcode-select --install, finish the installer, then retry",
+	},
+}
+
+// matchFailure returns the first catalog entry matching output, or nil.
+func matchFailure(output string) *failureHint {
+	for _, h := range failureCatalog {
+		if h.Pattern.MatchString(output) {
+			return h
+		}
+	}
+	return nil
+}
+
+// hintedError is a command failure recognised by the failure catalog.
+type hintedError struct {
+	err  error
+	hint *failureHint
+	cmd  []string
+}
+
+func (e *hintedError) Error() string {
+	return fmt.Sprintf("%v\nknown issue (%s): %s\nfix: %s", e.err, e.hint.ID, e.hint.Explain, e.hint.Fix)
+}
+
+func (e *hintedError) Unwrap() error { return e.err }
+
+// failureHintFor returns the hint attached to err, if any.
+func failureHintFor(err error) (*failureHint, []string, bool) {
+	var he *hintedError
+	if !errors.As(err, &he) {
+		return nil, nil, false
+	}
+	return he.hint, he.cmd, true
+}
+
+// offerFailureFix asks whether to apply the catalog's automatic fix for err and runs
+// it. It reports whether the fix ran, so the caller can retry the tool.
+func offerFailureFix(t toolID, err error) bool {
+	h, cmd, ok := failureHintFor(err)
+	if !ok || h.fixSteps == nil || dryRun || !attended() {
+		return false
+	}
+	steps := h.fixSteps(cmd)
+	if len(steps) == 0 {
+		return false
+	}
+	descs := make([]string, 0, len(steps))
+	for _, s := range steps {
+		descs = append(descs, s.describe())
+	}
+	msg := fmt.Sprintf("%s failed: %s\n\nApply the automatic fix and retry?\n\n%s", t, h.Explain, strings.Join(descs, "\n"))
+	if ok, _ := uiConfirm("Known Issue", msg); !ok {
+		return false
+	}
+	if ferr := runSteps(steps); ferr != nil {
+		logWarn(string(t), fmt.Sprintf("automatic fix %s failed: %v", h.ID, ferr), nil)
+		return false
+	}
+	logInfo(string(t), fmt.Sprintf("applied automatic fix %s; retrying %s", h.ID, t), nil)
+	return true
+}
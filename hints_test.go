@@ -0,0 +1,29 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSetuptoolsFixFollowsThePin(t *testing.T) {
+	h := matchFailure("ModuleNotFoundError: No module named 'pkg_resources'")
+	if h == nil || h.ID != "setuptools_api" {
+		t.Fatalf("matchFailure = %+v, want setuptools_api", h)
+	}
+	if !strings.HasSuffix(h.Fix, "setuptools=="+hopsSetuptoolsVersion()) {
+		t.Errorf("Fix = %q, want setuptools==%s", h.Fix, hopsSetuptoolsVersion())
+	}
+
+	l, err := parsePipLock("3.13.2", "setuptools==75.8.0 --hash=sha256:00\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := pipLocks
+	pipLocks = map[string]*pipLock{"3.13.2": l}
+	t.Cleanup(func() { pipLocks = old })
+
+	steps := h.fixSteps([]string{"/p/bin/pip", "install", "hops-cli"})
+	if len(steps) != 1 || steps[0].Args[len(steps[0].Args)-1] != "setuptools==75.8.0" {
+		t.Errorf("fix steps = %+v, want setuptools==75.8.0 from the lockfile", steps)
+	}
+}
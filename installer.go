@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"sort"
 	"strings"
 	"time"
 )
@@ -26,6 +27,8 @@ const (
 	toolSilencer     toolID = "silencer"
 	toolNCPCLI       toolID = "ncpcli"
 	toolJITPass      toolID = "jit_pass"
+	toolBastion      toolID = "bastion"
+	toolBitbucketSSH toolID = "bitbucket_ssh"
 )
 
 // depMap maps each tool to its required prerequisites.
@@ -35,16 +38,18 @@ var depMap = map[toolID][]toolID{
 	toolPyenv:        {toolHomebrew},
 	toolPython313:    {toolPyenv},
 	toolPython396:    {toolPyenv},
-	toolPyenvVenvNCP: {toolPython396},
+	toolPyenvVenvNCP: {pythonBaseTool(toolPyenvVenvNCP)},
 	toolITerm2:       {},
-	toolAllProxy:     {toolPython313, toolHomebrew},
-	toolSpartaPKI:    {},
+	toolAllProxy:     {toolPython313, toolHomebrew, toolBitbucketSSH},
+	toolSpartaPKI:    {toolBitbucketSSH},
 	toolHopsCLI:      {toolPython313, toolSpartaPKI},
-	toolGNOCHelper:   {toolPyenvVenvNCP},
-	toolStencil:      {toolPyenvVenvNCP},
-	toolSilencer:     {},
+	toolGNOCHelper:   {toolPyenvVenvNCP, toolBitbucketSSH},
+	toolStencil:      {toolPyenvVenvNCP, toolBitbucketSSH},
+	toolSilencer:     {toolBitbucketSSH},
 	toolNCPCLI:       {toolPyenvVenvNCP},
-	toolJITPass:      {},
+	toolJITPass:      {toolBitbucketSSH},
+	toolBastion:      {},
+	toolBitbucketSSH: {},
 }
 
 // validToolIDs maps string names (used in --only flag) to toolID constants.
@@ -64,6 +69,8 @@ var validToolIDs = map[string]toolID{
 	"silencer":          toolSilencer,
 	"ncpcli":            toolNCPCLI,
 	"jit_pass":          toolJITPass,
+	"bastion":           toolBastion,
+	"bitbucket_ssh":     toolBitbucketSSH,
 }
 
 // phase1Tools are installed before VPN is required.
@@ -75,6 +82,7 @@ var phase1Tools = map[toolID]bool{
 	toolPython313:    true,
 	toolPython396:    true,
 	toolPyenvVenvNCP: true,
+	toolBastion:      true,
 }
 
 var phase4Tools = map[toolID]bool{
@@ -84,6 +92,10 @@ var phase4Tools = map[toolID]bool{
 
 const defaultOCNACheckTarget = "ocna-placeholder.oraclecorp.com:443"
 
+// vpnCheckHosts are internal endpoints that only answer once myaccess VPN is up:
+// Artifactory and the git server the repository registry points at.
+var vpnCheckHosts = append([]string{"artifactory.oci.oraclecorp.com:443"}, gitRemoteHosts()...)
+
 // resolveTools returns a deduplicated, dependency-ordered list for the requested tools.
 func resolveTools(requested []toolID) []toolID {
 	visited := map[toolID]bool{}
@@ -105,6 +117,70 @@ func resolveTools(requested []toolID) []toolID {
 	return order
 }
 
+// dependentsOf returns every tool that directly or transitively depends on one of targets.
+func dependentsOf(targets []toolID) []toolID {
+	affected := map[toolID]bool{}
+	for _, t := range targets {
+		affected[t] = true
+	}
+	var out []toolID
+	for changed := true; changed; {
+		changed = false
+		for t, deps := range depMap {
+			if affected[t] {
+				continue
+			}
+			for _, d := range deps {
+				if affected[d] {
+					affected[t] = true
+					out = append(out, t)
+					changed = true
+					break
+				}
+			}
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i] < out[j] })
+	return out
+}
+
+// toolPhase returns the run phase a tool is installed in.
+func toolPhase(t toolID) string {
+	switch {
+	case phase1Tools[t]:
+		return "phase1"
+	case phase4Tools[t]:
+		return "phase4"
+	}
+	return "phase3"
+}
+
+// splitPhases partitions tools into phase 1, phase 3 and phase 4 (OCNA-gated), preserving order.
+func splitPhases(tools []toolID) (p1, p3, p4 []toolID) {
+	for _, t := range tools {
+		switch toolPhase(t) {
+		case "phase1":
+			p1 = append(p1, t)
+		case "phase4":
+			p4 = append(p4, t)
+		default:
+			p3 = append(p3, t)
+		}
+	}
+	return p1, p3, p4
+}
+
+// withoutTool returns tools with target left out.
+func withoutTool(tools []toolID, target toolID) []toolID {
+	var out []toolID
+	for _, t := range tools {
+		if t != target {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
 func allTools() []toolID {
 	return resolveTools([]toolID{
 		toolITerm2, toolXcode, toolHomebrew,
@@ -132,54 +208,93 @@ func gnocTools() []toolID {
 	})
 }
 
+type checkState string
+
+const (
+	checkInstalled checkState = "installed"
+	checkMissing   checkState = "missing"
+	checkOutdated  checkState = "outdated"
+)
+
+// toolCheck is the side-effect-free verdict on whether a tool is present on this machine.
+type toolCheck struct {
+	State   checkState `json:"state"`
+	Reason  string     `json:"reason"`
+	Version string     `json:"version,omitempty"`
+}
+
+func installedCheck(reason string) toolCheck { return toolCheck{State: checkInstalled, Reason: reason} }
+func missingCheck(reason string) toolCheck   { return toolCheck{State: checkMissing, Reason: reason} }
+func outdatedCheck(reason string) toolCheck  { return toolCheck{State: checkOutdated, Reason: reason} }
+
+func (c toolCheck) withVersion(v string) toolCheck { c.Version = v; return c }
+
+// toolDef pairs a tool's check with the steps that install it.
+type toolDef struct {
+	check func() toolCheck
+	steps func(guid string) []step
+}
+
+var toolDefs = map[toolID]toolDef{
+	toolITerm2:       {checkITerm2, func(string) []step { return iterm2Steps() }},
+	toolXcode:        {checkXcode, func(string) []step { return xcodeSteps() }},
+	toolHomebrew:     {checkHomebrew, func(string) []step { return homebrewSteps() }},
+	toolPyenv:        {checkPyenv, func(string) []step { return pyenvSteps() }},
+	toolPython313:    pythonToolDef(toolPython313),
+	toolPython396:    pythonToolDef(toolPython396),
+	toolPyenvVenvNCP: pythonToolDef(toolPyenvVenvNCP),
+	toolAllProxy:     {checkAllProxy, func(string) []step { return allProxySteps() }},
+	toolSpartaPKI:    {checkSpartaPKI, func(string) []step { return spartaPKISteps() }},
+	toolHopsCLI:      {checkHopsCLI, func(string) []step { return hopsCLISteps() }},
+	toolGNOCHelper:   {checkGNOCHelper, gnocHelperSteps},
+	toolStencil:      {checkStencil, func(string) []step { return stencilSteps() }},
+	toolSilencer:     {checkSilencer, func(string) []step { return silencerSteps() }},
+	toolNCPCLI:       {checkNCPCLI, func(string) []step { return ncpcliSteps() }},
+	toolJITPass:      {checkJITPass, func(string) []step { return jitPassSteps() }},
+	toolBastion:      {checkBastion, func(string) []step { return bastionSteps() }},
+	toolBitbucketSSH: {checkBitbucketSSH, func(string) []step { return bitbucketSSHSteps() }},
+}
+
+// checkTool reports whether t is already present. It never changes the system.
+func checkTool(t toolID) toolCheck {
+	def, ok := toolDefs[t]
+	if !ok {
+		return missingCheck("unknown tool")
+	}
+	return def.check()
+}
+
+// toolSteps returns the steps that install t for the given GUID, or the
+// planned steps when running `apply`.
+func toolSteps(t toolID, guid string) ([]step, error) {
+	if steps, ok := plannedSteps[t]; ok {
+		return steps, nil
+	}
+	def, ok := toolDefs[t]
+	if !ok {
+		return nil, fmt.Errorf("unknown tool: %s", t)
+	}
+	return def.steps(guid), nil
+}
+
 // runTool installs a single tool. All installers are idempotent.
 func runTool(t toolID, guid string) error {
-	logInfo(string(t), fmt.Sprintf("installing: %s", t), nil)
+	steps, err := toolSteps(t, guid)
+	if err != nil {
+		return err
+	}
 	if dryRun {
-		logInfo(string(t), fmt.Sprintf("dry-run mode: would install %s", t), nil)
+		fmt.Printf("  [plan] %s would run:\n", t)
+		printStepPlan(steps)
 		return nil
 	}
-	var err error
-	switch t {
-	case toolITerm2:
-		err = installITerm2()
-	case toolXcode:
-		err = installXcode()
-	case toolHomebrew:
-		err = installHomebrew()
-	case toolPyenv:
-		err = installPyenv()
-	case toolPython313:
-		err = installPythonVersion("3.13.2")
-	case toolPython396:
-		err = installPythonVersion("3.9.6")
-	case toolPyenvVenvNCP:
-		err = installPyenvVenv("ncpcli", "3.9.6")
-	case toolAllProxy:
-		err = installAllProxy()
-	case toolSpartaPKI:
-		err = installSpartaPKI()
-	case toolHopsCLI:
-		err = installHopsCLI()
-	case toolGNOCHelper:
-		err = installGNOCHelper(guid)
-	case toolStencil:
-		err = installStencil()
-	case toolSilencer:
-		err = installSilencer()
-	case toolNCPCLI:
-		err = installNCPCLI()
-	case toolJITPass:
-		err = installJITPass()
-	default:
-		err = fmt.Errorf("unknown tool: %s", t)
-	}
-	if err != nil {
+	logInfo(string(t), fmt.Sprintf("installing: %s", t), nil)
+	if err := runSteps(steps); err != nil {
 		logError(string(t), fmt.Sprintf("failed: %v", err), nil)
-	} else {
-		logInfo(string(t), "done", nil)
+		return err
 	}
-	return err
+	logInfo(string(t), "done", nil)
+	return nil
 }
 
 // waitForVPN polls internal Oracle hosts until TCP connects. Blocks until VPN is up.
@@ -188,10 +303,7 @@ func waitForVPN() {
 		logInfo("vpn_wait", "dry-run mode: would poll internal hosts for VPN connectivity", nil)
 		return
 	}
-	hosts := []string{
-		"artifactory.oci.oraclecorp.com:443",
-		"bitbucket.oci.oraclecorp.com:7999",
-	}
+	hosts := vpnCheckHosts
 	logInfo("vpn_wait", "polling for VPN connectivity", nil)
 	for {
 		allUp := true
@@ -242,246 +354,283 @@ func waitForOCNA() error {
 	}
 }
 
-// writeBaseZshrcBlocks appends Homebrew and pyenv init blocks if not present.
-func writeBaseZshrcBlocks() error {
-	blocks := []struct{ guard, block string }{
-		{
-			"# BEGIN: Homebrew",
-			`# BEGIN: Homebrew
-eval "$(/opt/homebrew/bin/brew shellenv)"
-# END: Homebrew`,
-		},
-		{
-			"# BEGIN: pyenv",
-			`# BEGIN: pyenv
+func baseZshrcSteps() []step {
+	return []step{
+		zshrcStep("# BEGIN: Homebrew", "# BEGIN: Homebrew\n"+platform.shellenvLine()+"\n# END: Homebrew"),
+		zshrcStep("# BEGIN: pyenv", pyenvZshrcBlock),
+	}
+}
+
+// runHooks are the steps a run takes around the tools: Start before phase 1,
+// AfterPhase1 once it is done, and VPN at the VPN handover. Plans carry them so
+// apply runs exactly what was planned.
+type runHooks struct {
+	Start       []step `json:"start,omitempty"`
+	AfterPhase1 []step `json:"after_phase1,omitempty"`
+	VPN         []step `json:"vpn,omitempty"`
+}
+
+func buildRunHooks(tools []toolID) runHooks {
+	h := runHooks{
+		Start:       baseZshrcSteps(),
+		AfterPhase1: []step{execStep("pyenv_global", "pyenv", append([]string{"global"}, pythonGlobals()...)...).ignoreErr()},
+		VPN:         []step{sshKeyAddStep("ssh_key")},
+	}
+	if hasTool(tools, toolGNOCHelper) {
+		// sshpass is required for gnoc-helper; the core formula is the fallback when the tap fails
+		sshpass := platform.brewPath("sshpass")
+		argv := platform.brewCommand("install", "sshpass")
+		h.AfterPhase1 = append(h.AfterPhase1,
+			brewStep("sshpass", sshpassPackages).ignoreErr(),
+			execStep("sshpass", argv[0], argv[1:]...).creates(sshpass),
+		)
+	}
+	return h
+}
+
+// ── Phase 1 installers ────────────────────────────────────────────────────────
+
+const pyenvZshrcBlock = `# BEGIN: pyenv
 export PYENV_ROOT="$HOME/.pyenv"
 export PATH="$PYENV_ROOT/bin:$PATH"
 eval "$(pyenv init -)"
 eval "$(pyenv virtualenv-init -)"
-# END: pyenv`,
-		},
+# END: pyenv`
+
+func checkITerm2() toolCheck {
+	if pathExists("/Applications/iTerm.app") {
+		version := cmdOutput("defaults", "read", "/Applications/iTerm.app/Contents/Info", "CFBundleShortVersionString")
+		return installedCheck("/Applications/iTerm.app present").withVersion(version)
 	}
-	for _, b := range blocks {
-		if err := appendToZshrc(b.guard, b.block); err != nil {
-			return err
-		}
+	return missingCheck("/Applications/iTerm.app not found")
+}
+
+func iterm2Steps() []step {
+	app := "/Applications/iTerm.app"
+	plist := os.Getenv("HOME") + "/Library/Preferences/com.googlecode.iterm2.plist"
+	return []step{
+		downloadStep("iterm2", "iterm2", "/Applications").unzip().creates(app),
+		fileStep("iterm2", "iterm2.plist", plist).creates(plist),
+		execStep("iterm2", "defaults", "read", "com.googlecode.iterm2").ignoreErr(),
+		noteStep("iterm2", "iTerm installed. You can continue in Terminal, or switch to iTerm after this run."),
 	}
-	return nil
 }
 
-// ── Phase 1 installers ────────────────────────────────────────────────────────
+// setupMarker records the commit of a tool's repository its setup last completed
+// at, for tools whose setup leaves nothing else to inspect.
+func setupMarker(tool toolID) string {
+	return os.Getenv("HOME") + "/.chs-onboard/setup/" + string(tool)
+}
 
-func installITerm2() error {
-	if pathExists("/Applications/iTerm.app") {
-		logInfo("iterm2", "already installed, skipping", nil)
-		return nil
-	}
-	tmpZip := "/tmp/iterm2.zip"
-	if _, err := runCmd("iterm2", nil, "curl", "-L", "-o", tmpZip, "https://iterm2.com/downloads/stable/latest"); err != nil {
-		return err
-	}
-	if _, err := runCmd("iterm2", nil, "unzip", "-o", tmpZip, "-d", "/Applications"); err != nil {
-		return err
-	}
-	_ = os.Remove(tmpZip)
+// setupMarkerStep writes tool's setup marker; it goes last in the tool's steps.
+func setupMarkerStep(tool toolID, repo string) step {
+	return execStep(string(tool), "sh", "-c", `mkdir -p "$(dirname "$1")" && git -C "$2" rev-parse HEAD > "$1"`,
+		"sh", setupMarker(tool), repoDir(repo))
+}
 
-	home := os.Getenv("HOME")
-	plistDir := home + "/Library/Preferences"
-	_ = os.MkdirAll(plistDir, 0755)
-	if err := os.WriteFile(plistDir+"/com.googlecode.iterm2.plist", iterm2Plist, 0644); err != nil {
-		return fmt.Errorf("writing iterm2 plist: %w", err)
+// setupMarkerCheck reports tool installed when its setup completed at the commit
+// its repository is checked out at now.
+func setupMarkerCheck(tool toolID, repo string) toolCheck {
+	short := gitHead(repoDir(repo))
+	data, err := os.ReadFile(setupMarker(tool))
+	if err != nil {
+		return missingCheck("repo present, but setup has not completed").withVersion(short)
 	}
-	_, _ = runCmd("iterm2", nil, "defaults", "read", "com.googlecode.iterm2")
-	logInfo("iterm2", "iTerm installed. You can continue in Terminal, or switch to iTerm after this run.", nil)
-	return nil
+	head := cmdOutput("git", "-C", repoDir(repo), "rev-parse", "HEAD")
+	if strings.TrimSpace(string(data)) != head {
+		return outdatedCheck("repo has moved since setup last completed").withVersion(short)
+	}
+	return installedCheck("setup completed at the current commit").withVersion(short)
 }
 
-func installXcode() error {
+func checkXcode() toolCheck {
 	if pathExists("/Library/Developer/CommandLineTools") {
-		logInfo("xcode", "Xcode CLI tools already installed", nil)
-		return nil
-	}
-	fmt.Println("  [!] Heads up: installer dialogs can appear behind/fullscreen terminal windows.")
-	fmt.Println("  [→] Installing Xcode Command Line Tools (a system dialog will appear)...")
-	_ = runInteractive("xcode", "xcode-select", "--install")
-	ok, _ := uiConfirm("Xcode CLI Tools", "Click OK once the Xcode Command Line Tools installation is complete.")
-	if !ok {
-		return fmt.Errorf("xcode CLI tools installation not confirmed")
+		return installedCheck("Command Line Tools present").withVersion(pkgutilVersion("com.apple.pkg.CLTools_Executables"))
 	}
-	return nil
+	return missingCheck("/Library/Developer/CommandLineTools not found")
 }
 
-func ensureSSHPass() error {
-	if pathExists("/opt/homebrew/bin/sshpass") || pathExists("/usr/local/bin/sshpass") {
-		logInfo("sshpass", "sshpass already installed", nil)
-		return nil
+func xcodeSteps() []step {
+	clt := "/Library/Developer/CommandLineTools"
+	return []step{
+		noteStep("xcode", "Heads up: installer dialogs can appear behind/fullscreen terminal windows.").creates(clt),
+		execStep("xcode", "xcode-select", "--install").interactive().ignoreErr().creates(clt),
+		confirmStep("xcode", "Xcode CLI Tools", "Click OK once the Xcode Command Line Tools installation is complete.").creates(clt),
 	}
+}
 
-	brew := "/opt/homebrew/bin/brew"
+func checkHomebrew() toolCheck {
+	brew := platform.brewBin()
 	if !pathExists(brew) {
-		return fmt.Errorf("homebrew not found at %s; required for sshpass install", brew)
+		return missingCheck(brew + " not found")
 	}
-
-	if _, err := runCmd("sshpass", nil, brew, "install", "hudochenkov/sshpass/sshpass"); err != nil {
-		if _, fallbackErr := runCmd("sshpass", nil, brew, "install", "sshpass"); fallbackErr != nil {
-			return fmt.Errorf("sshpass install failed: tap formula error: %v; fallback error: %v", err, fallbackErr)
+	inv := loadBrewInventory()
+	if missing := inv.missing(brewfile); len(missing) > 0 {
+		names := make([]string, 0, len(missing))
+		for _, p := range missing {
+			names = append(names, p.String())
 		}
+		return outdatedCheck("missing packages: " + strings.Join(names, ", "))
 	}
-
-	if !pathExists("/opt/homebrew/bin/sshpass") && !pathExists("/usr/local/bin/sshpass") {
-		return fmt.Errorf("sshpass install completed but binary not found")
+	if pathExists("/Library/OpenSC/lib/opensc-pkcs11.so") && !pathExists("/usr/local/lib/opensc-pkcs11.so") {
+		return outdatedCheck("/usr/local/lib/opensc-pkcs11.so link missing")
 	}
-	return nil
+	return installedCheck("brew and all packages present").withVersion(firstLine(cmdOutput(brew, "--version")))
 }
 
-func installHomebrew() error {
-	if pathExists("/opt/homebrew/bin/brew") {
-		logInfo("homebrew", "Homebrew already installed", nil)
-		return ensureBrewPackages()
+func homebrewSteps() []step {
+	install := []string{"/bin/bash", "-c",
+		`NONINTERACTIVE=1 curl -fsSL https://raw.githubusercontent.com/Homebrew/install/HEAD/install.sh | bash`}
+	if platform.Rosetta && platform.BrewPrefix == armBrewPrefix {
+		// the installer picks /usr/local when it sees an x86_64 shell
+		install = append([]string{"arch", "-arm64"}, install...)
 	}
-	fmt.Println("  [→] Installing Homebrew...")
-	_, err := runCmd("homebrew", nil, "/bin/bash", "-c",
-		`NONINTERACTIVE=1 curl -fsSL https://raw.githubusercontent.com/Homebrew/install/HEAD/install.sh | bash`)
-	if err != nil {
-		return err
-	}
-	return ensureBrewPackages()
-}
-
-func ensureBrewPackages() error {
-	brew := "/opt/homebrew/bin/brew"
-	for _, pkg := range []string{"openssl", "xz", "yubico-piv-tool", "jq", "pyenv", "pyenv-virtualenv"} {
-		if _, err := runCmd("homebrew", nil, brew, "install", pkg); err != nil {
-			return fmt.Errorf("brew install %s: %w", pkg, err)
-		}
-	}
-	if _, err := runCmd("homebrew", nil, brew, "install", "--cask", "opensc"); err != nil {
-		logWarn("homebrew", "opensc cask install failed (may already be installed)", nil)
+	steps := []step{
+		execStep("homebrew", install[0], install[1:]...).creates(platform.brewBin()),
 	}
-	return ensureOpenSCSymlinks()
+	steps = append(steps, brewStep("homebrew", brewfile))
+	return append(steps, openSCSymlinkSteps()...)
 }
 
-func ensureOpenSCSymlinks() error {
+func openSCSymlinkSteps() []step {
 	src := "/Library/OpenSC/lib/opensc-pkcs11.so"
 	dst := "/usr/local/lib/opensc-pkcs11.so"
-	if !pathExists(src) {
-		logWarn("opensc", "source opensc-pkcs11.so not found, skipping symlink", nil)
-		return nil
+	return []step{
+		execStep("opensc", "mkdir", "-pv", "/usr/local/lib").sudo().requires(src).creates(dst),
+		execStep("opensc", "ln", "-v", src, dst).sudo().requires(src).creates(dst),
 	}
-	if pathExists(dst) {
-		logInfo("opensc", "symlink already exists", nil)
-		return nil
+}
+
+func checkPyenv() toolCheck {
+	pyenv := platform.brewPath("pyenv")
+	if !pathExists(pyenv) {
+		return missingCheck("pyenv binary not found")
 	}
-	if _, err := sudoCmd("opensc", nil, "mkdir", "-pv", "/usr/local/lib"); err != nil {
-		return err
+	if !fileContains(os.Getenv("HOME")+"/.zshrc", "# BEGIN: pyenv") {
+		return outdatedCheck("pyenv block missing from ~/.zshrc")
 	}
-	_, err := sudoCmd("opensc", nil, "ln", "-v", src, dst)
-	return err
+	return installedCheck("pyenv present and configured in ~/.zshrc").withVersion(cmdOutput(pyenv, "--version"))
 }
 
-func installPyenv() error {
+func pyenvSteps() []step {
 	// pyenv binary is installed via homebrew; this step just ensures .zshrc is configured.
-	if _, err := runCmd("pyenv", nil, "pyenv", "--version"); err != nil {
-		return err
+	return []step{
+		execStep("pyenv", "pyenv", "--version"),
+		zshrcStep("# BEGIN: pyenv", pyenvZshrcBlock),
 	}
-	return appendToZshrc("# BEGIN: pyenv",
-		`# BEGIN: pyenv
-export PYENV_ROOT="$HOME/.pyenv"
-export PATH="$PYENV_ROOT/bin:$PATH"
-eval "$(pyenv init -)"
-eval "$(pyenv virtualenv-init -)"
-# END: pyenv`)
 }
 
-func installPythonVersion(version string) error {
-	versionDir := os.Getenv("HOME") + "/.pyenv/versions/" + version
-	if pathExists(versionDir) {
-		logInfo("pyenv", fmt.Sprintf("Python %s already installed", version), nil)
-		return nil
-	}
-	_, err := runCmd("pyenv", nil, "pyenv", "install", version)
-	return err
-}
+// ── Phase 3 installers ────────────────────────────────────────────────────────
 
-func installPyenvVenv(venvName, pythonVersion string) error {
-	venvDir := os.Getenv("HOME") + "/.pyenv/versions/" + venvName
-	if pathExists(venvDir) {
-		logInfo("pyenv", fmt.Sprintf("virtualenv %s already exists", venvName), nil)
-		return nil
+// pipPackageVersion returns the installed version of pkg, or "" if it is not installed.
+func pipPackageVersion(pip, pkg string) string {
+	if !pathExists(pip) {
+		return ""
+	}
+	for _, line := range strings.Split(cmdOutput(pip, "show", pkg), "\n") {
+		if v, ok := strings.CutPrefix(line, "Version:"); ok {
+			return strings.TrimSpace(v)
+		}
 	}
-	_, err := runCmd("pyenv_venv", nil, "pyenv", "virtualenv", pythonVersion, venvName)
-	return err
+	return ""
 }
 
-func setPyenvGlobal(versions ...string) error {
-	args := append([]string{"global"}, versions...)
-	_, err := runCmd("pyenv_global", nil, "pyenv", args...)
-	return err
+func checkAllProxy() toolCheck {
+	if !pathExists(repoDir("misc-tools") + "/.git") {
+		return missingCheck("~/misc-tools not cloned")
+	}
+	py := pythonEnvFor(toolPython313).Name
+	version := pipPackageVersion(pythonBin(toolPython313, "pip"), "allproxy")
+	if version == "" {
+		return missingCheck("allproxy not installed in Python " + py)
+	}
+	if c, drifted := pipDriftCheck(toolPython313); drifted {
+		return c
+	}
+	return installedCheck("allproxy installed in Python " + py).withVersion(version)
 }
 
-// ── Phase 3 installers ────────────────────────────────────────────────────────
-
-func installAllProxy() error {
-	logInfo("allproxy", "allproxy can take several minutes depending on network and pip index reachability", nil)
-	home := os.Getenv("HOME")
-	dir := home + "/misc-tools"
-	if err := gitCloneOrPull("allproxy", "ssh://git@bitbucket.oci.oraclecorp.com:7999/~rralliso/misc-tools.git", dir); err != nil {
-		return err
+func allProxySteps() []step {
+	dir := repoDir("misc-tools")
+	steps := []step{
+		noteStep("allproxy", "allproxy can take several minutes depending on network and pip index reachability"),
+		gitStep("allproxy", "misc-tools"),
+		pipConfStep("allproxy", toolPython313),
 	}
-	_, err := runCmd("allproxy", nil, home+"/.pyenv/versions/3.13.2/bin/pip", "install", "-e", dir+"/allproxy")
-	return err
+	steps = append(steps, pipInstallSteps("allproxy", toolPython313, nil)...)
+	args := append(append([]string{"install"}, pipSourceArgs(toolPython313)...), "-e", dir+"/allproxy")
+	return append(steps, execStep("allproxy", pythonBin(toolPython313, "pip"), args...))
 }
 
-func installSpartaPKI() error {
-	home := os.Getenv("HOME")
-	rootsDir := home + "/sparta_roots"
-	if err := os.MkdirAll(rootsDir, 0750); err != nil {
-		return err
+func checkHopsCLI() toolCheck {
+	pip := pythonBin(toolPython313, "pip")
+	version := pipPackageVersion(pip, "hops-cli")
+	if version == "" {
+		return missingCheck("hops-cli not installed in Python " + pythonEnvFor(toolPython313).Name)
 	}
-	tmpClone := home + "/sparta-pki"
-	if err := gitCloneOrPull("sparta_pki", "ssh://git@bitbucket.oci.oraclecorp.com:7999/secinf/sparta-pki.git", tmpClone); err != nil {
-		return err
+	want := hopsSetuptoolsVersion()
+	if v := pipPackageVersion(pip, "setuptools"); v != want {
+		return outdatedCheck(fmt.Sprintf("setuptools is %q, want %s", v, want))
 	}
-	entries, err := os.ReadDir(tmpClone + "/trustroots")
-	if err != nil {
-		return fmt.Errorf("sparta-pki trustroots dir not found: %w", err)
+	if c, drifted := pipDriftCheck(toolPython313); drifted {
+		return c
 	}
-	for _, e := range entries {
-		data, err := os.ReadFile(tmpClone + "/trustroots/" + e.Name())
-		if err != nil {
-			return err
-		}
-		if err := os.WriteFile(rootsDir+"/"+e.Name(), data, 0644); err != nil {
-			return err
+	return installedCheck("hops-cli installed with setuptools " + want).withVersion(version)
+}
+
+// hopsSetuptoolsVersion is the setuptools hops-cli needs: the lockfile's pin when
+// Python 3.13 is locked, else the known-good 81.0.0 hopsCLISteps installs.
+func hopsSetuptoolsVersion() string {
+	if l, locked := pipLockFor(toolPython313); locked {
+		if p, ok := l.pin("setuptools"); ok {
+			return p.Version
 		}
 	}
-	return os.RemoveAll(tmpClone)
+	return "81.0.0"
 }
 
-func installHopsCLI() error {
-	logInfo("hops_cli", "hops-cli installation can take up to 5 minutes", nil)
-	pip := os.Getenv("HOME") + "/.pyenv/versions/3.13.2/bin/pip"
-	_, _ = runCmd("hops_cli", nil, pip, "cache", "purge")
-	if _, err := runCmd("hops_cli", nil, pip, "install", "--upgrade", "pip"); err != nil {
-		return err
-	}
-	if _, err := runCmd("hops_cli", nil, pip,
-		"install", "--default-timeout=100", "-U",
-		"--index-url", "https://artifactory.oci.oraclecorp.com/api/pypi/global-release-pypi/simple",
-		"hops-cli"); err != nil {
-		return err
+func hopsCLISteps() []step {
+	pip := pythonBin(toolPython313, "pip")
+	steps := []step{
+		noteStep("hops_cli", "hops-cli installation can take up to 5 minutes"),
+		pipConfStep("hops_cli", toolPython313),
+		execStep("hops_cli", pip, "cache", "purge").ignoreErr(),
+		execStep("hops_cli", pip, "install", "--upgrade", "pip"),
+	}
+	steps = append(steps, pipInstallSteps("hops_cli", toolPython313, []string{"hops-cli"}, "-U")...)
+	if l, locked := pipLockFor(toolPython313); locked {
+		if _, pinned := l.pin("setuptools"); pinned {
+			return steps
+		}
 	}
-	// Known bug fix as of Feb 2026: downgrade setuptools
-	_, err := runCmd("hops_cli", nil, pip, "install", "--no-cache-dir", "--force-reinstall", "setuptools==81.0.0")
-	return err
+	// Known bug fix as of Feb 2026: downgrade setuptools (lockfiles pin it instead)
+	return append(steps, execStep("hops_cli", pip, "install", "--no-cache-dir", "--force-reinstall", "setuptools=="+hopsSetuptoolsVersion()))
 }
 
-func installGNOCHelper(guid string) error {
+var gnocHelperSymlinks = [][2]string{
+	{"/gnoc-helper.sh", "/usr/local/bin/gnoc-helper"},
+	{"/scripts/rack-finder.sh", "/usr/local/bin/rack-finder"},
+	{"/scripts/console-finder.sh", "/usr/local/bin/console-finder"},
+}
+
+func checkGNOCHelper() toolCheck {
 	home := os.Getenv("HOME")
-	dir := home + "/gnoc-helper"
-	if err := gitCloneOrPull("gnoc_helper", "ssh://git@bitbucket.oci.oraclecorp.com:7999/gnoc/gnoc-helper.git", dir); err != nil {
-		return err
+	if !pathExists(repoDir("gnoc-helper") + "/.git") {
+		return missingCheck("~/gnoc-helper not cloned")
 	}
+	if !fileContains(home+"/.zshrc", "# BEGIN: GNOC Temp Help") {
+		return outdatedCheck("GNOC block missing from ~/.zshrc")
+	}
+	for _, sl := range gnocHelperSymlinks {
+		if !pathExists(sl[1]) {
+			return outdatedCheck(sl[1] + " not linked")
+		}
+	}
+	return setupMarkerCheck(toolGNOCHelper, "gnoc-helper")
+}
+
+func gnocHelperSteps(guid string) []step {
+	dir := repoDir("gnoc-helper")
 
 	block := fmt.Sprintf(`# BEGIN: GNOC Temp Help
 export OCI_USER="%s"
@@ -501,100 +650,135 @@ rekey() {
     ssh-add -s /usr/local/lib/opensc-pkcs11.so 2>/dev/null
 }
 # END: GNOC Temp Help`, guid)
-	if err := appendToZshrc("# BEGIN: GNOC Temp Help", block); err != nil {
-		return err
-	}
 
-	symlinks := [][2]string{
-		{dir + "/gnoc-helper.sh", "/usr/local/bin/gnoc-helper"},
-		{dir + "/scripts/rack-finder.sh", "/usr/local/bin/rack-finder"},
-		{dir + "/scripts/console-finder.sh", "/usr/local/bin/console-finder"},
-	}
-	for _, sl := range symlinks {
-		if !pathExists(sl[1]) {
-			if _, err := sudoCmd("gnoc_helper", nil, "ln", "-s", sl[0], sl[1]); err != nil {
-				return err
-			}
-		}
+	steps := []step{
+		gitStep("gnoc_helper", "gnoc-helper"),
+		zshrcStep("# BEGIN: GNOC Temp Help", block),
 	}
-	if _, err := runCmd("gnoc_helper", nil, "/usr/local/bin/gnoc-helper", "--setup"); err != nil {
-		return err
+	for _, sl := range gnocHelperSymlinks {
+		steps = append(steps, execStep("gnoc_helper", "ln", "-s", dir+sl[0], sl[1]).sudo().creates(sl[1]))
 	}
-	pip := home + "/.pyenv/versions/3.13.2/bin/pip"
-	_, err := runCmd("gnoc_helper", nil, pip,
-		"install", "rust", "cffi==1.16.0", "cryptography", "asyncssh", "pproxy", "pyyaml")
-	return err
+	steps = append(steps,
+		execStep("gnoc_helper", "/usr/local/bin/gnoc-helper", "--setup"),
+		pipConfStep("gnoc_helper", toolPython313),
+	)
+	steps = append(steps, pipInstallSteps("gnoc_helper", toolPython313,
+		[]string{"rust", "cffi==1.16.0", "cryptography", "asyncssh", "pproxy", "pyyaml"})...)
+	return append(steps, setupMarkerStep(toolGNOCHelper, "gnoc-helper"))
 }
 
-func installStencil() error {
-	home := os.Getenv("HOME")
-	repos := map[string]string{
-		home + "/stencil":           "ssh://git@bitbucket.oci.oraclecorp.com:7999/nse/stencil.git",
-		home + "/stencil-temp-gnoc": "ssh://git@bitbucket.oci.oraclecorp.com:7999/gnoc/stencil-temp-gnoc.git",
-	}
-	for dir, remote := range repos {
-		if err := gitCloneOrPull("stencil", remote, dir); err != nil {
-			return err
+var stencilRepos = []string{"stencil", "stencil-temp-gnoc"}
+
+func checkStencil() toolCheck {
+	for _, r := range stencilRepos {
+		if !pathExists(repoDir(r) + "/.git") {
+			return missingCheck("~/" + repos[r].Dir + " not cloned")
 		}
 	}
-	pip := home + "/.pyenv/versions/ncpcli/bin/pip"
-	if _, err := runCmd("stencil", pyenvEnv("ncpcli"), pip, "install", home+"/stencil/."); err != nil {
-		return err
+	if !pathExists(pythonBin(toolPyenvVenvNCP, "stencil")) {
+		return missingCheck("stencil not installed in ncpcli virtualenv")
 	}
-	stencilBin := home + "/.pyenv/versions/ncpcli/bin/stencil"
 	if !pathExists("/usr/local/bin/stencil") {
-		if _, err := sudoCmd("stencil", nil, "ln", "-s", stencilBin, "/usr/local/bin/stencil"); err != nil {
-			return err
-		}
+		return outdatedCheck("/usr/local/bin/stencil not linked")
+	}
+	if c, drifted := pipDriftCheck(toolPyenvVenvNCP); drifted {
+		return c
 	}
-	_, err := runCmd("stencil", pyenvEnv("ncpcli"), "/usr/local/bin/stencil", "init")
-	return err
+	version := pipPackageVersion(pythonBin(toolPyenvVenvNCP, "pip"), "stencil")
+	return installedCheck("stencil installed and linked").withVersion(version)
 }
 
-func installSilencer() error {
-	home := os.Getenv("HOME")
-	dir := home + "/silencer"
-	if err := gitCloneOrPull("silencer", "ssh://git@bitbucket.oci.oraclecorp.com:7999/nse/silencer.git", dir); err != nil {
-		return err
+func stencilSteps() []step {
+	var steps []step
+	for _, r := range stencilRepos {
+		steps = append(steps, gitStep("stencil", r))
+	}
+	venv := pythonEnvFor(toolPyenvVenvNCP).Name
+	pip := pythonBin(toolPyenvVenvNCP, "pip")
+	stencilBin := pythonBin(toolPyenvVenvNCP, "stencil")
+	steps = append(steps, pipConfStep("stencil", toolPyenvVenvNCP))
+	steps = append(steps, pipInstallSteps("stencil", toolPyenvVenvNCP, nil)...)
+	args := append(append([]string{"install"}, pipSourceArgs(toolPyenvVenvNCP)...), repoDir("stencil")+"/.")
+	return append(steps,
+		execStep("stencil", pip, args...).inVenv(venv),
+		execStep("stencil", "ln", "-s", stencilBin, "/usr/local/bin/stencil").sudo().creates("/usr/local/bin/stencil"),
+		execStep("stencil", "/usr/local/bin/stencil", "init").inVenv(venv),
+	)
+}
+
+func checkSilencer() toolCheck {
+	if !pathExists(repoDir("silencer") + "/.git") {
+		return missingCheck("~/silencer not cloned")
 	}
-	if _, err := runCmd("silencer", nil, "make", "-C", dir, "install"); err != nil {
-		return err
+	return setupMarkerCheck(toolSilencer, "silencer")
+}
+
+func silencerSteps() []step {
+	dir := repoDir("silencer")
+	return []step{
+		gitStep("silencer", "silencer"),
+		execStep("silencer", "make", "-C", dir, "install"),
+		execStep("silencer", "make", "-C", dir, "link"),
+		setupMarkerStep(toolSilencer, "silencer"),
 	}
-	_, err := runCmd("silencer", nil, "make", "-C", dir, "link")
-	return err
 }
 
-func installNCPCLI() error {
-	home := os.Getenv("HOME")
-	pip := home + "/.pyenv/versions/ncpcli/bin/pip"
-	env := pyenvEnv("ncpcli")
+func checkNCPCLI() toolCheck {
+	version := pipPackageVersion(pythonBin(toolPyenvVenvNCP, "pip"), "ncpcli")
+	if version == "" {
+		return missingCheck("ncpcli not installed in ncpcli virtualenv")
+	}
+	if c, drifted := pipDriftCheck(toolPyenvVenvNCP); drifted {
+		return c
+	}
+	return installedCheck("ncpcli installed in ncpcli virtualenv").withVersion(version)
+}
 
-	_, _ = runCmd("ncpcli", env, pip, "cache", "purge")
-	if _, err := runCmd("ncpcli", env, pip, "install", "--upgrade", "pip"); err != nil {
-		return err
+func ncpcliSteps() []step {
+	venv := pythonEnvFor(toolPyenvVenvNCP).Name
+	pip := pythonBin(toolPyenvVenvNCP, "pip")
+	opensslPrefix := brewOpenSSLPrefix()
+	buildEnv := []string{
+		"LDFLAGS=-L" + opensslPrefix + "/lib",
+		"CFLAGS=-I" + opensslPrefix + "/include",
+	}
+	steps := []step{
+		pipConfStep("ncpcli", toolPyenvVenvNCP),
+		execStep("ncpcli", pip, "cache", "purge").inVenv(venv).ignoreErr(),
+		execStep("ncpcli", pip, "install", "--upgrade", "pip").inVenv(venv),
+	}
+	// Packages without a wheel for this Mac are built from source against OpenSSL 1.1.
+	for _, s := range pipInstallSteps("ncpcli", toolPyenvVenvNCP, []string{"ncpcli"}) {
+		if s.Kind == stepExec {
+			s = s.withEnv(buildEnv...)
+		}
+		steps = append(steps, s)
 	}
-	opensslPrefix := cmdOutput("/opt/homebrew/bin/brew", "--prefix", "openssl@1.1")
-	env = append(env,
-		"LDFLAGS=-L"+opensslPrefix+"/lib",
-		"CFLAGS=-I"+opensslPrefix+"/include",
-	)
-	if _, err := runCmd("ncpcli", env, pip,
-		"install",
-		"--index-url", "https://artifactory.oci.oraclecorp.com/api/pypi/global-release-pypi/simple",
-		"--trusted-host", "artifactory.oci.oraclecorp.com",
-		"ncpcli"); err != nil {
-		return err
+	return append(steps,
+		execStep("ncpcli", pythonBin(toolPyenvVenvNCP, "ncpcli"), "--rebuild-config").inVenv(venv).withEnv(buildEnv...))
+}
+
+// brewOpenSSLPrefix is where Homebrew keeps openssl@1.1, as brew itself reports it;
+// before brew is installed it is the usual location under the prefix.
+func brewOpenSSLPrefix() string {
+	if p := cmdOutput(platform.brewBin(), "--prefix", "openssl@1.1"); p != "" {
+		return p
 	}
-	_, err := runCmd("ncpcli", env, home+"/.pyenv/versions/ncpcli/bin/ncpcli", "--rebuild-config")
-	return err
+	return platform.BrewPrefix + "/opt/openssl@1.1"
 }
 
-func installJITPass() error {
-	home := os.Getenv("HOME")
-	dir := home + "/gnoc-jit-pass"
-	if err := gitCloneOrPull("jit_pass", "ssh://git@bitbucket.oci.oraclecorp.com:7999/gnoc/gnoc-jit-pass.git", dir); err != nil {
-		return err
+func checkJITPass() toolCheck {
+	if !pathExists(repoDir("gnoc-jit-pass") + "/.git") {
+		return missingCheck("~/gnoc-jit-pass not cloned")
+	}
+	return setupMarkerCheck(toolJITPass, "gnoc-jit-pass")
+}
+
+func jitPassSteps() []step {
+	dir := repoDir("gnoc-jit-pass")
+	return []step{
+		gitStep("jit_pass", "gnoc-jit-pass"),
+		execStep("jit_pass", dir+"/wrapper.sh"),
+		setupMarkerStep(toolJITPass, "gnoc-jit-pass"),
 	}
-	_, err := runCmd("jit_pass", nil, dir+"/wrapper.sh")
-	return err
 }
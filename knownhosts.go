@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sshHost is an SSH server chs-onboard talks to. Fingerprints pin its host keys
+// (as ssh-keygen -l prints them, SHA256:...); only matching keys are added to
+// known_hosts.
+type sshHost struct {
+	HostName     string   `json:"hostname"`
+	Port         int      `json:"port,omitempty"`
+	User         string   `json:"user,omitempty"`
+	Fingerprints []string `json:"fingerprints,omitempty"`
+}
+
+// defaultSSHHosts is the SSH host manifest. Bitbucket's host keys are not pinned
+// by default; pin them in ~/.chs-onboard/ssh_hosts.json with the fingerprints
+// published by the Bitbucket admins.
+var defaultSSHHosts = map[string]sshHost{
+	"bitbucket": {HostName: "bitbucket.oci.oraclecorp.com", Port: 7999, User: "git"},
+}
+
+// sshHosts is defaultSSHHosts with entries from ~/.chs-onboard/ssh_hosts.json applied.
+var sshHosts = loadSSHHosts()
+
+func loadSSHHosts() map[string]sshHost {
+	m := map[string]sshHost{}
+	for name, h := range defaultSSHHosts {
+		m[name] = h
+	}
+	path := filepath.Join(os.Getenv("HOME"), ".chs-onboard", "ssh_hosts.json")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return m
+	}
+	var override map[string]sshHost
+	if err := json.Unmarshal(data, &override); err != nil {
+		fmt.Fprintf(os.Stderr, "  [!] ignoring %s: %v\n", path, err)
+		return m
+	}
+	for name, h := range override {
+		if h.HostName == "" {
+			fmt.Fprintf(os.Stderr, "  [!] ignoring %s entry %q: hostname is required\n", path, name)
+			continue
+		}
+		m[name] = h
+	}
+	return m
+}
+
+func (h sshHost) port() int {
+	if h.Port == 0 {
+		return 22
+	}
+	return h.Port
+}
+
+// knownHostsName is how known_hosts and ssh-keyscan name the host.
+func (h sshHost) knownHostsName() string {
+	if h.port() == 22 {
+		return h.HostName
+	}
+	return fmt.Sprintf("[%s]:%d", h.HostName, h.port())
+}
+
+// inUse reports whether any registry repository is cloned over SSH from h.
+func (h sshHost) inUse() bool {
+	want := h.HostName + ":" + strconv.Itoa(h.port())
+	for _, r := range repos {
+		if strings.Contains(r.Remote, "://") && !strings.HasPrefix(r.Remote, "ssh://") {
+			continue
+		}
+		if remoteHostPort(r.Remote) == want {
+			return true
+		}
+	}
+	return false
+}
+
+func knownHostsPath() string {
+	return filepath.Join(os.Getenv("HOME"), ".ssh", "known_hosts")
+}
+
+func knownHostsStep(log string, h sshHost) step {
+	return step{Kind: stepKnownHosts, Log: log, Dst: knownHostsPath(), Host: &h}
+}
+
+// seedKnownHosts adds h's host keys to dst unless it already has them. Keys are
+// fetched with ssh-keyscan and, when h is pinned, kept only if they match a pin.
+func seedKnownHosts(log, dst string, h sshHost) error {
+	if dryRun {
+		logInfo(log, "DRY-RUN: would add host keys of "+h.knownHostsName()+" to "+dst, nil)
+		return nil
+	}
+	name := h.knownHostsName()
+	if known := knownHostKeys(dst, name); len(known) > 0 {
+		if len(h.Fingerprints) == 0 || len(matchingHostKeys(known, h.Fingerprints)) > 0 {
+			logInfo(log, name+" already in "+dst, nil)
+			return nil
+		}
+		return fmt.Errorf("%s has a key for %s that matches none of the pinned fingerprints; if the server key really changed, remove it with ssh-keygen -R '%s' and retry", dst, name, name)
+	}
+	if activeBundle != nil {
+		logWarn(log, "installing from a bundle; host keys of "+name+" will be added on the first online run", nil)
+		return nil
+	}
+
+	out, err := exec.Command("ssh-keyscan", "-T", "10", "-p", strconv.Itoa(h.port()), h.HostName).Output()
+	var scanned []string
+	for _, line := range strings.Split(string(out), "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+			scanned = append(scanned, line)
+		}
+	}
+	if len(scanned) == 0 {
+		if err == nil {
+			err = errors.New("no keys returned")
+		}
+		return fmt.Errorf("ssh-keyscan %s: %v (is VPN connected?)", name, err)
+	}
+
+	keep := scanned
+	if len(h.Fingerprints) == 0 {
+		logWarn(log, name+" host keys are not pinned; trusting the keys it offers now", map[string]string{"fingerprints": strings.Join(hostKeyFingerprints(scanned), ", ")})
+	} else if keep = matchingHostKeys(scanned, h.Fingerprints); len(keep) == 0 {
+		return fmt.Errorf("%s offered host keys %s, none of which is pinned (%s); not trusting it",
+			name, strings.Join(hostKeyFingerprints(scanned), ", "), strings.Join(h.Fingerprints, ", "))
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(dst, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(strings.Join(keep, "\n") + "\n")
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("writing %s: %w", dst, err)
+	}
+	logInfo(log, fmt.Sprintf("added %d host key(s) of %s to %s", len(keep), name, dst), nil)
+	return nil
+}
+
+// knownHostKeys returns the known_hosts lines for name.
+func knownHostKeys(path, name string) []string {
+	out := cmdOutput("ssh-keygen", "-F", name, "-f", path)
+	var keys []string
+	for _, line := range strings.Split(out, "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+			keys = append(keys, line)
+		}
+	}
+	return keys
+}
+
+// hostKeyFingerprint returns the SHA256 fingerprint of a known_hosts line.
+func hostKeyFingerprint(line string) string {
+	cmd := exec.Command("ssh-keygen", "-l", "-f", "-")
+	cmd.Stdin = strings.NewReader(line + "\n")
+	out, err := cmd.Output()
+	if err != nil {
+		return ""
+	}
+	fields := strings.Fields(string(out))
+	if len(fields) < 2 {
+		return ""
+	}
+	return fields[1]
+}
+
+func hostKeyFingerprints(lines []string) []string {
+	fps := make([]string, 0, len(lines))
+	for _, line := range lines {
+		fps = append(fps, hostKeyFingerprint(line))
+	}
+	return fps
+}
+
+func matchingHostKeys(lines, pins []string) []string {
+	var keep []string
+	for _, line := range lines {
+		fp := hostKeyFingerprint(line)
+		for _, pin := range pins {
+			if fp != "" && fp == pin {
+				keep = append(keep, line)
+				break
+			}
+		}
+	}
+	return keep
+}
+
+// errSSHKeyNotAdded is returned by probeSSH when the server rejects the key.
+var errSSHKeyNotAdded = errors.New("SSH key not accepted")
+
+var (
+	sshDeniedRe  = regexp.MustCompile(`(?i)permission denied \(publickey|too many authentication failures`)
+	sshHostKeyRe = regexp.MustCompile(`(?i)host key verification failed|remote host identification has changed|no \w+ host key is known`)
+	sshNetworkRe = regexp.MustCompile(`(?i)timed out|could not resolve|connection refused|no route to host|network is unreachable`)
+)
+
+// probeSSH runs a non-interactive `ssh -T` against h. The server refuses a shell,
+// so any exit status other than ssh's own 255 means the key was accepted.
+func probeSSH(h sshHost) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	target := h.HostName
+	if h.User != "" {
+		target = h.User + "@" + target
+	}
+	cmd := exec.CommandContext(ctx, "ssh", "-T", "-o", "BatchMode=yes", "-o", "ConnectTimeout=10", "-o", "StrictHostKeyChecking=yes",
+		"-p", strconv.Itoa(h.port()), target)
+	out, err := cmd.CombinedOutput()
+	var exitErr *exec.ExitError
+	if err == nil || errors.As(err, &exitErr) && exitErr.ExitCode() != 255 {
+		return nil
+	}
+	msg := strings.TrimSpace(string(out))
+	key := sshKeyPath()
+	switch {
+	case ctx.Err() != nil:
+		return fmt.Errorf("ssh to %s timed out; is VPN connected?", h.knownHostsName())
+	case sshDeniedRe.MatchString(msg):
+		return fmt.Errorf("%w: %s rejected %s; add %s.pub at https://bitbucket.oci.oraclecorp.com/plugins/servlet/ssh/account/keys",
+			errSSHKeyNotAdded, h.HostName, key, key)
+	case sshHostKeyRe.MatchString(msg):
+		return fmt.Errorf("host key of %s is missing or changed in %s (%s); rerun to seed it, or remove a stale entry with ssh-keygen -R '%s'",
+			h.knownHostsName(), knownHostsPath(), firstLine(msg), h.knownHostsName())
+	case sshNetworkRe.MatchString(msg):
+		return fmt.Errorf("cannot reach %s (%s); is VPN connected?", h.knownHostsName(), firstLine(msg))
+	}
+	return fmt.Errorf("ssh to %s failed: %s", h.knownHostsName(), firstLine(msg))
+}
+
+// verifyBitbucketSSH probes Bitbucket until it accepts the key. While someone is at
+// the keyboard a rejected key can be added and the probe retried.
+func verifyBitbucketSSH() error {
+	h := sshHosts["bitbucket"]
+	if dryRun {
+		logInfo("bitbucket_ssh", "dry-run mode: would probe "+h.knownHostsName()+" with ssh -T", nil)
+		return nil
+	}
+	for {
+		err := probeSSH(h)
+		if err == nil {
+			logInfo("bitbucket_ssh", "Bitbucket accepted the SSH key", map[string]string{"key": sshKeyPath()})
+			return nil
+		}
+		if !errors.Is(err, errSSHKeyNotAdded) || !attended() {
+			return err
+		}
+		ok, _ := uiConfirm("Bitbucket SSH key", err.Error()+"\n\nAdd the key, then continue to check again.")
+		if !ok {
+			return err
+		}
+	}
+}
+
+func checkBitbucketSSH() toolCheck {
+	h := sshHosts["bitbucket"]
+	if !h.inUse() {
+		return installedCheck("no repository is cloned over SSH from " + h.HostName)
+	}
+	if len(knownHostKeys(knownHostsPath(), h.knownHostsName())) == 0 {
+		return missingCheck(h.knownHostsName() + " not in ~/.ssh/known_hosts")
+	}
+	data, _ := os.ReadFile(sshConfigPath())
+	body, _ := bitbucketSSHConfig(h)
+	switch current := managedBlock(string(data), "bitbucket"); current {
+	case "":
+		return missingCheck("no bitbucket block in ~/.ssh/config")
+	case sshConfigBlock("bitbucket", body):
+		return installedCheck("host key known and ~/.ssh/config entry present")
+	}
+	return outdatedCheck("bitbucket block in ~/.ssh/config is out of date")
+}
+
+// bitbucketSSHConfig renders the ~/.ssh/config entry for Bitbucket.
+func bitbucketSSHConfig(h sshHost) (string, []sshExpect) {
+	body := fmt.Sprintf("Host %s\n    Port %d\n", h.HostName, h.port())
+	opts := map[string]string{"port": strconv.Itoa(h.port()), "identitiesonly": "yes"}
+	if h.User != "" {
+		body += "    User " + h.User + "\n"
+		opts["user"] = h.User
+	}
+	body += "    IdentityFile " + sshKeyPath() + "\n    IdentitiesOnly yes\n    StrictHostKeyChecking yes\n"
+	return body, []sshExpect{{Host: h.HostName, Options: opts}}
+}
+
+func bitbucketSSHSteps() []step {
+	h := sshHosts["bitbucket"]
+	if !h.inUse() {
+		return []step{noteStep("bitbucket_ssh", "no repository is cloned over SSH from "+h.HostName+"; nothing to configure")}
+	}
+	body, expect := bitbucketSSHConfig(h)
+	return []step{
+		knownHostsStep("bitbucket_ssh", h),
+		sshConfigStep("bitbucket_ssh", "bitbucket", body, expect),
+	}
+}
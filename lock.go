@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// runLockInfo identifies the process holding ~/.chs-onboard/run.lock.
+type runLockInfo struct {
+	PID     int    `json:"pid"`
+	Started string `json:"started"`
+	User    string `json:"user"`
+	Command string `json:"command"`
+}
+
+// runLockFile is the open, flock'ed run lock while this process holds it.
+var runLockFile *os.File
+
+func runLockFilePath() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(home, ".chs-onboard")
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "run.lock"), nil
+}
+
+// acquireRunLock makes sure only one chs-onboard modifies this account at a time.
+// The lock is an flock on run.lock, so the kernel drops it when its holder exits
+// and a crashed run never leaves a lock behind. The file itself is never removed;
+// it only records who holds the lock, for the error message.
+func acquireRunLock() error {
+	if runLockFile != nil {
+		return nil
+	}
+	path, err := runLockFilePath()
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0640)
+	if err != nil {
+		return err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		_ = f.Close()
+		if !errors.Is(err, syscall.EWOULDBLOCK) {
+			return fmt.Errorf("locking %s: %w", path, err)
+		}
+		holder, rerr := readRunLock(path)
+		if rerr != nil {
+			return fmt.Errorf("another chs-onboard is already running (lock %s); wait for it to finish or close it, then retry", path)
+		}
+		return fmt.Errorf("another chs-onboard is already running (pid %d, started %s, command %q); wait for it to finish or close it, then retry",
+			holder.PID, holder.Started, holder.Command)
+	}
+
+	info := runLockInfo{
+		PID:     os.Getpid(),
+		Started: time.Now().UTC().Format(time.RFC3339),
+		User:    os.Getenv("USER"),
+		Command: strings.Join(os.Args, " "),
+	}
+	data, err := json.Marshal(info)
+	if err == nil {
+		err = f.Truncate(0)
+	}
+	if err == nil {
+		_, err = f.WriteAt(data, 0)
+	}
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	runLockFile = f
+	return nil
+}
+
+// releaseRunLock clears the holder record and drops the lock if this process holds it.
+func releaseRunLock() {
+	if runLockFile == nil {
+		return
+	}
+	_ = runLockFile.Truncate(0)
+	_ = syscall.Flock(int(runLockFile.Fd()), syscall.LOCK_UN)
+	_ = runLockFile.Close()
+	runLockFile = nil
+}
+
+func readRunLock(path string) (runLockInfo, error) {
+	var info runLockInfo
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return info, err
+	}
+	if err := json.Unmarshal(data, &info); err != nil {
+		return info, fmt.Errorf("invalid run lock: %w", err)
+	}
+	return info, nil
+}
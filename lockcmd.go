@@ -0,0 +1,242 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// runLockCommand implements `chs-onboard lock`: it regenerates pip lockfiles from the
+// installed (already resolved) environments, or with --check reports drift from them.
+func runLockCommand(args []string) {
+	fs := flag.NewFlagSet("lock", flag.ExitOnError)
+	outFlag := fs.String("out", userLockDir(), "directory to write <env>.txt lockfiles to (use locks to update the embedded ones)")
+	checkFlag := fs.Bool("check", false, "report packages that differ from the lockfiles instead of regenerating them")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: chs-onboard lock [--out dir] [--check] [env...]")
+		fmt.Fprintln(os.Stderr, "\nenv is a pyenv version name or Python tool ID; default all.")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	envs, err := lockEnvs(fs.Args())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if *checkFlag {
+		if drifted := printLockDrift(envs); drifted {
+			os.Exit(1)
+		}
+		return
+	}
+
+	failed := false
+	for _, e := range envs {
+		if err := writePipLock(e, *outFlag); err != nil {
+			fmt.Printf("  [✗] %s: %v\n", e.Name, err)
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// lockEnvs resolves command-line names to python matrix entries.
+func lockEnvs(names []string) ([]pythonEnv, error) {
+	if len(names) == 0 {
+		return pythonMatrix, nil
+	}
+	var envs []pythonEnv
+	for _, name := range names {
+		found := false
+		for _, e := range pythonMatrix {
+			if e.Name == name || string(e.Tool) == name {
+				envs = append(envs, e)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown python environment %q", name)
+		}
+	}
+	return envs, nil
+}
+
+// printLockDrift prints how each environment differs from its lockfile and reports
+// whether any locked package is missing or at another version.
+func printLockDrift(envs []pythonEnv) bool {
+	drifted := false
+	for _, e := range envs {
+		l, ok := pipLocks[e.Name]
+		if !ok {
+			fmt.Printf("  [-] %-12s no lockfile\n", e.Name)
+			continue
+		}
+		pip := pythonBin(e.Tool, "pip")
+		if !pathExists(pip) {
+			fmt.Printf("  [-] %-12s not installed\n", e.Name)
+			continue
+		}
+		d := comparePipLock(l, pipInstalled(pip))
+		if !d.drifted() && len(d.Extra) == 0 {
+			fmt.Printf("  [✓] %-12s matches %s (%d packages)\n", e.Name, l.Source, len(l.Pins))
+			continue
+		}
+		mark := "[✓]"
+		if d.drifted() {
+			mark, drifted = "[✗]", true
+		}
+		fmt.Printf("  %s %-12s differs from %s\n", mark, e.Name, l.Source)
+		for _, s := range d.Changed {
+			fmt.Printf("        changed  %s\n", s)
+		}
+		for _, s := range d.Missing {
+			fmt.Printf("        missing  %s\n", s)
+		}
+		for _, s := range d.Extra {
+			fmt.Printf("        extra    %s (not locked)\n", s)
+		}
+	}
+	return drifted
+}
+
+// writePipLock pins every package installed in e, with the hashes of the files the
+// index has for that version, and writes <out>/<name>.txt.
+func writePipLock(e pythonEnv, out string) error {
+	pip := pythonBin(e.Tool, "pip")
+	if !pathExists(pip) {
+		return fmt.Errorf("not installed; install it first so its packages are resolved")
+	}
+	installed := pipInstalled(pip)
+	keys := make([]string, 0, len(installed))
+	for key := range installed {
+		if key != "pip" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	cfg := pipConfigFor(e.Name).withCABundle()
+	index, err := selectPipIndex("lock", cfg)
+	if err != nil {
+		return err
+	}
+	client := pipHTTPClient(cfg, 30*time.Second)
+	var pins []pipPin
+	var skipped []string
+	for _, key := range keys {
+		p := installed[key]
+		hashes, err := indexHashes(client, index, p.Name, p.Version)
+		if err != nil {
+			return fmt.Errorf("%s: %w", p.Name, err)
+		}
+		if len(hashes) == 0 {
+			// Installed from a local source tree (stencil) rather than the index.
+			skipped = append(skipped, p.Name+"=="+p.Version)
+			continue
+		}
+		p.Hashes = hashes
+		pins = append(pins, p)
+	}
+
+	header := []string{
+		fmt.Sprintf("pip lockfile for %s, generated by `chs-onboard lock` on %s", e.Name, time.Now().Format("2006-01-02")),
+		"from " + cmdOutput(pythonBin(e.Tool, "python"), "--version") + "; hashes from " + index,
+	}
+	if len(skipped) > 0 {
+		header = append(header, "not on the index, installed from source: "+strings.Join(skipped, ", "))
+	}
+	if err := os.MkdirAll(out, 0755); err != nil {
+		return err
+	}
+	dst := filepath.Join(out, e.Name+".txt")
+	if err := os.WriteFile(dst, []byte(formatPipLock(header, pins)), 0644); err != nil {
+		return fmt.Errorf("writing %s: %w", dst, err)
+	}
+	fmt.Printf("  [✓] %-12s %d packages locked → %s\n", e.Name, len(pins), dst)
+	for _, s := range skipped {
+		fmt.Printf("        skipped  %s (not on the index)\n", s)
+	}
+	return nil
+}
+
+var indexLinkRe = regexp.MustCompile(`<a\s[^>]*href="([^"]+)"`)
+
+// indexHashes returns the sha256 hashes of name's files for version listed on a
+// PEP 503 simple index page. A package the index does not know yields no hashes.
+func indexHashes(client *http.Client, index, name, version string) ([]string, error) {
+	resp, err := client.Get(strings.TrimSuffix(index, "/") + "/" + normalizePipName(name) + "/")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("index returned %s", resp.Status)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return parseIndexHashes(string(body), name, version), nil
+}
+
+// parseIndexHashes extracts sha256 hashes of name==version files from a simple index page.
+func parseIndexHashes(page, name, version string) []string {
+	var hashes []string
+	seen := map[string]bool{}
+	for _, m := range indexLinkRe.FindAllStringSubmatch(page, -1) {
+		href := strings.ReplaceAll(m[1], "&amp;", "&")
+		u, err := url.Parse(href)
+		if err != nil {
+			continue
+		}
+		digest, ok := strings.CutPrefix(u.Fragment, "sha256=")
+		if !ok || !distributionMatches(path.Base(u.Path), name, version) {
+			continue
+		}
+		if h := "sha256:" + digest; !seen[h] {
+			seen[h] = true
+			hashes = append(hashes, h)
+		}
+	}
+	sort.Strings(hashes)
+	return hashes
+}
+
+// distributionMatches reports whether a wheel or sdist filename is name at version.
+func distributionMatches(file, name, version string) bool {
+	var fileName, fileVersion string
+	if base, ok := strings.CutSuffix(file, ".whl"); ok {
+		parts := strings.Split(base, "-")
+		if len(parts) < 2 {
+			return false
+		}
+		fileName, fileVersion = parts[0], parts[1]
+	} else {
+		base := file
+		for _, ext := range []string{".tar.gz", ".tar.bz2", ".zip", ".tgz"} {
+			base = strings.TrimSuffix(base, ext)
+		}
+		i := strings.LastIndex(base, "-")
+		if i < 0 || base == file {
+			return false
+		}
+		fileName, fileVersion = base[:i], base[i+1:]
+	}
+	return normalizePipName(fileName) == normalizePipName(name) && fileVersion == version
+}
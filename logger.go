@@ -62,22 +62,25 @@ func logSetPhase(phase string) {
 	log.mu.Lock()
 	log.phase = phase
 	log.mu.Unlock()
+	statusSetPhase(phase)
 }
 
 func logWrite(level logLevel, step, msg string, fields map[string]string) {
 	log.mu.Lock()
 	defer log.mu.Unlock()
-	if log.encoder == nil {
-		return
-	}
-	_ = log.encoder.Encode(logEntry{
+	e := logEntry{
 		Timestamp: time.Now().UTC().Format(time.RFC3339),
 		Level:     level,
 		Phase:     log.phase,
 		Step:      step,
 		Message:   msg,
 		Fields:    fields,
-	})
+	}
+	statusRecordLog(e)
+	if log.encoder == nil {
+		return
+	}
+	_ = log.encoder.Encode(e)
 }
 
 func logInfo(step, msg string, fields map[string]string) {
@@ -98,6 +101,11 @@ func logError(step, msg string, fields map[string]string) {
 func logFatal(step, msg string, fields map[string]string) {
 	logWrite(logERROR, step, msg, fields)
 	fmt.Fprintf(os.Stderr, "  [✗] FATAL: %s\n", msg)
+	if hint := resumeHint(); hint != "" {
+		fmt.Fprintf(os.Stderr, "  %s\n", hint)
+	}
+	finishRunRecord("failed", msg)
+	releaseRunLock()
 	logClose()
 	os.Exit(1)
 }
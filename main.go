@@ -2,33 +2,83 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
 	"sort"
 	"strings"
+	"time"
 )
 
-const bastionConfigsOption = "bastion_configs (coming soon)"
-
 var dryRun bool
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "plan":
+			runPlanCommand(os.Args[2:])
+			return
+		case "apply":
+			runApplyCommand(os.Args[2:])
+			return
+		case "state":
+			runStateCommand(os.Args[2:])
+			return
+		case "lock":
+			runLockCommand(os.Args[2:])
+			return
+		case "bundle":
+			runBundleCommand(os.Args[2:])
+			return
+		case "repos":
+			runReposCommand(os.Args[2:])
+			return
+		case "doctor":
+			runDoctorCommand(os.Args[2:])
+			return
+		}
+	}
+
 	gnocFlag := flag.Bool("gnoc", false, "include GNOC-specific tools")
 	onlyFlag := flag.String("only", "", "comma-separated tool IDs to install (use --list to see options)")
 	listFlag := flag.Bool("list", false, "list available tool IDs and exit")
 	dryRunFlag := flag.Bool("dry-run", false, "print intended actions without making system changes")
 	forceReinstallFlag := flag.Bool("force-reinstall", false, "ignore saved completion state and rerun all selected steps")
 	resetStateFlag := flag.Bool("reset-state", false, "clear saved completion state and exit")
+	statusAddrFlag := flag.String("status-addr", "", "serve a live status dashboard on this address (e.g. 127.0.0.1:8765)")
+	keepGoingFlag := flag.Bool("keep-going", false, "keep installing tools that do not depend on a failed one, then summarise failures")
+	resumeFlag := flag.Bool("resume", false, "continue the last interrupted run from its last incomplete phase")
+	fromBundleFlag := flag.String("from-bundle", "", "install repositories, pip packages and downloads from a bundle made with `bundle create` instead of the network")
+	emitScriptFlag := flag.String("emit-script", "", "write an equivalent standalone zsh script for the selected tools to this file (- for stdout) and exit")
+	flag.Usage = printUsage
 	flag.Parse()
 	dryRun = *dryRunFlag
 	forceReinstall = *forceReinstallFlag
+	keepGoing = *keepGoingFlag
 
 	if *listFlag {
 		printToolList()
 		return
 	}
+	if *emitScriptFlag != "" {
+		tools := planToolSelection(*onlyFlag, *gnocFlag)
+		if len(tools) == 0 {
+			fmt.Fprintln(os.Stderr, "No valid tool IDs provided. Use --list to see available tools.")
+			os.Exit(1)
+		}
+		if err := writeEmittedScript(*emitScriptFlag, tools); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to emit script: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
 	if *resetStateFlag {
+		if err := acquireRunLock(); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to reset state: %v\n", err)
+			os.Exit(1)
+		}
+		defer releaseRunLock()
 		if err := resetRunState(); err != nil {
 			fmt.Fprintf(os.Stderr, "failed to reset state: %v\n", err)
 			os.Exit(1)
@@ -37,14 +87,85 @@ func main() {
 		return
 	}
 
+	if *fromBundleFlag != "" {
+		b, err := openBundle(*fromBundleFlag)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cannot use bundle: %v\n", err)
+			os.Exit(1)
+		}
+		activeBundle = b
+		fmt.Printf("Installing from bundle %s (created %s on %s, %d files verified).\n",
+			*fromBundleFlag, b.Manifest.Created.Local().Format("2006-01-02 15:04"), b.Manifest.Host, len(b.Manifest.Entries))
+	}
+
+	if *resumeFlag {
+		runResume(*statusAddrFlag, *onlyFlag, *gnocFlag)
+		return
+	}
+
+	finish := startRun(*statusAddrFlag)
+	defer finish()
+	if p := stateData.Progress; p != nil {
+		fmt.Printf("\n  [!] A previous run stopped in %s; rerun with --resume to continue it instead.\n", p.Phase)
+	}
+
+	// Preflight
+	logSetPhase("preflight")
+	fmt.Println("\n── Preflight ─────────────────────────────────────────────────")
+	guid, err := preflightRun()
+	if err != nil {
+		logFatal("preflight", err.Error(), nil)
+	}
+
+	tools := selectTools(*onlyFlag, *gnocFlag)
+	runOnboarding("install", tools, buildRunHooks(tools), guid)
+}
+
+// selectTools resolves the tool list from --only, or asks the user for optional tools.
+func selectTools(only string, gnoc bool) []toolID {
+	if only != "" {
+		tools := parseOnlyFlag(only)
+		if len(tools) == 0 {
+			logFatal("tool_select", "No valid tool IDs provided. Use --list to see available tools.", nil)
+		}
+		return tools
+	}
+	requestedOptional, err := promptToolSelection(gnoc)
+	if err != nil {
+		logFatal("tool_select", err.Error(), nil)
+	}
+	if len(requestedOptional) == 0 {
+		fmt.Println("\nNo optional tools selected. Continuing with required tool set.")
+	}
+	requested := append(requiredTools(), requestedOptional...)
+	return resolveTools(requested)
+}
+
+// startRun initialises logging, the status dashboard, saved state, sudo and sleep
+// settings shared by every installing command. The caller must defer the returned func.
+func startRun(statusAddr string) func() {
 	if err := logInit(); err != nil {
 		fmt.Fprintf(os.Stderr, "failed to init logger: %v\n", err)
 		os.Exit(1)
 	}
-	defer logClose()
-	defer runCleanup()
-	if err := loadRunState(); err != nil {
+	if err := acquireRunLock(); err != nil {
+		logFatal("lock", err.Error(), nil)
+	}
+	registerCleanup(releaseRunLock)
+	if statusAddr != "" {
+		if err := startStatusServer(statusAddr); err != nil {
+			logFatal("status", err.Error(), nil)
+		}
+	}
+	if err := loadRunState(); errors.Is(err, errStateTooNew) {
+		logFatal("state", err.Error(), nil)
+	} else if err != nil {
 		logWarn("state", fmt.Sprintf("could not load saved state: %v", err), nil)
+	} else if stateMigrated && !dryRun {
+		fmt.Fprintf(os.Stderr, "  [→] migrated state file to schema %d\n", stateSchemaVersion)
+		if err := saveRunState(); err != nil {
+			logWarn("state", fmt.Sprintf("could not save migrated state: %v", err), nil)
+		}
 	}
 
 	printBanner()
@@ -53,9 +174,8 @@ func main() {
 	}
 
 	// Cache sudo and start keepalive goroutine
+	ctx, cancel := context.WithCancel(context.Background())
 	if !dryRun {
-		ctx, cancel := context.WithCancel(context.Background())
-		defer cancel()
 		fmt.Println("\n[sudo] chs-onboard needs administrator privileges:")
 		if err := startSudoKeepalive(ctx); err != nil {
 			logFatal("sudo", fmt.Sprintf("sudo auth failed: %v", err), nil)
@@ -76,144 +196,221 @@ func main() {
 		}
 	})
 
-	// Preflight
-	logSetPhase("preflight")
-	fmt.Println("\n── Preflight ─────────────────────────────────────────────────")
-	guid, err := preflightRun()
-	if err != nil {
-		logFatal("preflight", err.Error(), nil)
+	return func() {
+		cancel()
+		runCleanup()
+		logClose()
+	}
+}
+
+// runOnboarding installs the resolved tools phase by phase, handling the VPN and OCNA
+// handovers, and runs hooks around them.
+func runOnboarding(mode string, tools []toolID, hooks runHooks, guid string) {
+	if !dryRun {
+		setStateIdentity(guid)
+	}
+	beginRunRecord(mode, tools)
+	if mode == "apply" {
+		// an apply runs its plan from the start; progress left by an
+		// interactive run must not skip any of its phases
+		stateData.Progress = nil
+	} else {
+		beginProgress(tools, guid)
 	}
 
 	// Write .zshrc blocks
-	if err := writeBaseZshrcBlocks(); err != nil {
+	if err := runSteps(hooks.Start); err != nil {
 		logFatal("zshrc", err.Error(), nil)
 	}
 
-	// Resolve tool list
-	var tools []toolID
-	bastionConfigsSelected := false
-	if *onlyFlag != "" {
-		tools = parseOnlyFlag(*onlyFlag)
-		if len(tools) == 0 {
-			fmt.Fprintln(os.Stderr, "No valid tool IDs provided. Use --list to see available tools.")
-			os.Exit(1)
-		}
-	} else {
-		requestedOptional, bastionSelected, err := promptToolSelection(*gnocFlag)
-		if err != nil {
-			logFatal("tool_select", err.Error(), nil)
-		}
-		if len(requestedOptional) == 0 && !bastionSelected {
-			fmt.Println("\nNo optional tools selected. Continuing with required tool set.")
-		}
-		requested := append(requiredTools(), requestedOptional...)
-		tools = resolveTools(requested)
-		bastionConfigsSelected = bastionSelected
-	}
+	statusSetTools(tools)
 
 	// Split into phase 1 / phase 3 / phase 4 (OCNA-gated)
-	var p1, p3, p4 []toolID
-	for _, t := range tools {
-		if phase1Tools[t] {
-			p1 = append(p1, t)
-		} else if phase4Tools[t] {
-			p4 = append(p4, t)
-		} else {
-			p3 = append(p3, t)
-		}
-	}
+	p1, p3, p4 := splitPhases(tools)
 
 	// Phase 1: public internet
 	logSetPhase("phase1")
+	saveProgress("phase1")
 	fmt.Println("\n── Phase 1: Public Internet (VPN OFF) ────────────────────────")
-	if err := runPhase(p1, guid); err != nil {
-		logFatal("phase1", err.Error(), nil)
-	}
-	if dryRun {
-		logInfo("pyenv_global", "dry-run mode: would set pyenv global 3.13.2 ncpcli", nil)
-	} else if err := setPyenvGlobal("3.13.2", "ncpcli"); err != nil {
-		logWarn("pyenv_global", fmt.Sprintf("pyenv global set failed: %v", err), nil)
-	}
-
-	if hasTool(tools, toolGNOCHelper) {
-		fmt.Println("\n  [→] Ensuring sshpass is installed (required for gnoc-helper)...")
-		if dryRun {
-			logInfo("sshpass", "dry-run mode: would install/verify sshpass", nil)
-		} else if err := ensureSSHPass(); err != nil {
-			logFatal("sshpass", err.Error(), nil)
-		}
-	}
+	runPhaseOnce("phase1", milestonePhase1, p1, guid, hooks.AfterPhase1)
 
 	if len(p3) == 0 && len(p4) == 0 {
-		if bastionConfigsSelected {
-			logWarn("bastion_configs", "Bastion configs selected, but setup is not implemented yet; skipping", nil)
-		}
+		finishKeepGoing()
 		fmt.Println("\n✓ Done. No VPN-gated tools selected.")
+		clearProgress()
+		finishRunRecord("completed", "")
 		return
 	}
 
 	// Phase 2: VPN handover
 	logSetPhase("phase2")
+	saveProgress("phase2")
 	fmt.Println("\n── Phase 2: Connect to VPN ───────────────────────────────────")
-	uiVPNPrompt()
-	waitForVPN()
-	fmt.Println("  [✓] VPN confirmed")
-	if err := postVPNSSHKeyStep(); err != nil {
-		logFatal("ssh_key", err.Error(), nil)
-	}
-	if err := checkPublicInternet(); err != nil {
-		logWarn("net_check", "public internet currently unreachable while on VPN (this can be expected before OCNA/full VPN)", nil)
+	if activeBundle != nil {
+		fmt.Println("  [→] Installing from an offline bundle; VPN is not required")
+	} else if progressDone(milestoneVPN) {
+		fmt.Println("  [✓] VPN handover already completed in previous run; checking VPN is still connected")
+		waitForVPN()
+		fmt.Println("  [✓] VPN confirmed")
 	} else {
-		logInfo("net_check", "public internet reachable while on VPN", nil)
+		uiVPNPrompt()
+		waitForVPN()
+		fmt.Println("  [✓] VPN confirmed")
+		if err := runSteps(hooks.VPN); err != nil {
+			logFatal("ssh_key", err.Error(), nil)
+		}
+		markProgress(milestoneVPN)
+	}
+	if activeBundle == nil {
+		if err := checkPublicInternet(); err != nil {
+			logWarn("net_check", "public internet currently unreachable while on VPN (this can be expected before OCNA/full VPN)", nil)
+		} else {
+			logInfo("net_check", "public internet reachable while on VPN", nil)
+		}
+	}
+
+	if hasTool(tools, toolBitbucketSSH) && activeBundle == nil {
+		// Clones in phases 3 and 4 must not stop at a host key prompt or a missing key.
+		fmt.Println("\n  [→] Checking Bitbucket SSH access...")
+		if err := installTool(toolBitbucketSSH, guid); err != nil {
+			logFatal("bitbucket_ssh", err.Error(), nil)
+		}
+		if sshHosts["bitbucket"].inUse() {
+			if err := verifyBitbucketSSH(); err != nil {
+				logFatal("bitbucket_ssh", err.Error(), nil)
+			}
+		}
+		p3 = withoutTool(p3, toolBitbucketSSH)
 	}
 
 	if len(p3) > 0 {
 		// Phase 3: internal tools on myaccess VPN
 		logSetPhase("phase3")
+		saveProgress("phase3")
 		fmt.Println("\n── Phase 3: Internal Tools (myaccess VPN) ────────────────────")
-		if err := runPhase(p3, guid); err != nil {
-			logFatal("phase3", err.Error(), nil)
-		}
+		runPhaseOnce("phase3", milestonePhase3, p3, guid, nil)
 	}
 
 	if len(p4) > 0 {
 		logSetPhase("phase4")
+		saveProgress("phase4")
 		fmt.Println("\n── Phase 4: OCNA + Yubikey Required (Final Installs) ────────")
-		ok, _ := uiConfirm("OCNA + Yubikey Required", "Before continuing, connect OCNA VPN and ensure your Yubikey is set up and connected. Continue?")
-		if !ok {
-			logFatal("phase4", "OCNA/Yubikey confirmation required", nil)
-		}
-		if err := waitForOCNA(); err != nil {
-			logFatal("phase4", err.Error(), nil)
-		}
-		if err := runPhase(p4, guid); err != nil {
-			logFatal("phase4", err.Error(), nil)
+		if !progressDone(milestonePhase4) {
+			if !progressDone(milestoneOCNA) {
+				ok, _ := uiConfirm("OCNA + Yubikey Required", "Before continuing, connect OCNA VPN and ensure your Yubikey is set up and connected. Continue?")
+				if !ok {
+					logFatal("phase4", "OCNA/Yubikey confirmation required", nil)
+				}
+			}
+			if activeBundle == nil {
+				if err := waitForOCNA(); err != nil {
+					logFatal("phase4", err.Error(), nil)
+				}
+			}
+			markProgress(milestoneOCNA)
 		}
+		runPhaseOnce("phase4", milestonePhase4, p4, guid, nil)
 	}
-	if bastionConfigsSelected {
-		logWarn("bastion_configs", "Bastion configs selected, but setup is not implemented yet; skipping", nil)
-	}
-
+	finishKeepGoing()
 	fmt.Println("\n✓ chs-onboard complete. Open a new terminal or run: source ~/.zshrc")
 	logInfo("done", "completed successfully", nil)
+	clearProgress()
+	finishRunRecord("completed", "")
 }
 
-func runPhase(tools []toolID, guid string) error {
+// runPhaseOnce runs a phase and then its after steps, unless a previous attempt of
+// this run already completed the phase. The milestone is recorded only when no tool
+// in the phase failed, so --keep-going failures are retried on resume.
+func runPhaseOnce(phase, milestone string, tools []toolID, guid string, after []step) {
+	if progressDone(milestone) {
+		fmt.Printf("  [✓] Phase %s already completed in previous run, skipping\n", strings.TrimPrefix(phase, "phase"))
+		return
+	}
+	if err := runPhase(phase, tools, guid); err != nil {
+		logFatal(phase, err.Error(), nil)
+	}
+	triagePhase(phase, tools, guid)
+	if err := runSteps(after); err != nil {
+		logFatal(phase, err.Error(), nil)
+	}
+	if !phaseFailed(phase) {
+		markProgress(milestone)
+	}
+}
+
+// runPhase installs tools in order. With --keep-going a failing tool does not stop
+// the phase; tools depending on it are skipped and the failure is recorded instead.
+func runPhase(phase string, tools []toolID, guid string) error {
 	for i, t := range tools {
-		if !forceReinstall && isToolCompleted(t) {
-			fmt.Printf("\n  [%d/%d] %s\n", i+1, len(tools), t)
-			fmt.Printf("  [✓] %s already completed in previous run, skipping\n", t)
-			continue
-		}
 		fmt.Printf("\n  [%d/%d] %s\n", i+1, len(tools), t)
-		if err := runTool(t, guid); err != nil {
-			return fmt.Errorf("%s failed: %w", t, err)
+		if keepGoing {
+			if f, ok := failedDependency(t); ok {
+				fmt.Printf("  [!] %s skipped: depends on %s, which failed\n", t, f.Tool)
+				statusSetTool(t, toolSkipped, fmt.Errorf("dependency %s failed", f.Tool))
+				if !hasTool(f.Blocked, t) {
+					f.Blocked = append(f.Blocked, t)
+				}
+				continue
+			}
+		}
+		if err := installTool(t, guid); err != nil {
+			if !keepGoing {
+				return err
+			}
+			fmt.Printf("  [✗] %v (continuing with --keep-going)\n", err)
+			recordFailure(phase, t, err)
+		}
+	}
+	return nil
+}
+
+// installTool installs one tool unless saved state or its check shows it is already done.
+func installTool(t toolID, guid string) error {
+	if !forceReinstall && isToolCompleted(t, guid) {
+		fmt.Printf("  [✓] %s already completed in previous run, skipping\n", t)
+		statusSetTool(t, toolSkipped, nil)
+		return nil
+	}
+	stale, reason := toolStale(t, guid)
+	if stale && !forceReinstall {
+		logInfo(string(t), fmt.Sprintf("%s was installed with an older definition (%s); re-running", t, reason), nil)
+	}
+	if !forceReinstall && !stale {
+		check := checkTool(t)
+		if check.State == checkInstalled {
+			fmt.Printf("  [✓] %s already present (%s), skipping\n", t, check.Reason)
+			if !dryRun {
+				if err := markToolPresent(t, guid); err != nil {
+					logWarn("state", fmt.Sprintf("failed to persist completion state for %s: %v", t, err), nil)
+				}
+			}
+			statusSetTool(t, toolSkipped, nil)
+			return nil
 		}
+		logInfo(string(t), fmt.Sprintf("%s is %s: %s", t, check.State, check.Reason), nil)
+	}
+	statusSetTool(t, toolRunning, nil)
+	started := time.Now()
+	err := runTool(t, guid)
+	if err != nil && offerFailureFix(t, err) {
+		err = runTool(t, guid)
+	}
+	if err != nil {
+		statusSetTool(t, toolFailed, err)
 		if !dryRun {
-			if err := markToolCompleted(t); err != nil {
-				logWarn("state", fmt.Sprintf("failed to persist completion state for %s: %v", t, err), nil)
+			if serr := markToolFailed(t, err); serr != nil {
+				logWarn("state", fmt.Sprintf("failed to persist failure state for %s: %v", t, serr), nil)
 			}
 		}
+		return fmt.Errorf("%s failed: %w", t, err)
+	}
+	if !dryRun {
+		if err := markToolCompleted(t, guid, time.Since(started)); err != nil {
+			logWarn("state", fmt.Sprintf("failed to persist completion state for %s: %v", t, err), nil)
+		}
+	}
+	statusSetTool(t, toolDone, nil)
+	if !dryRun {
 		fmt.Printf("  [✓] %s done\n", t)
 	}
 	return nil
@@ -232,7 +429,7 @@ func parseOnlyFlag(raw string) []toolID {
 	return resolveTools(requested)
 }
 
-func promptToolSelection(defaultIncludeGNOC bool) ([]toolID, bool, error) {
+func promptToolSelection(defaultIncludeGNOC bool) ([]toolID, error) {
 	optionalChoices := []string{
 		"bastion setup",
 		"allproxy",
@@ -251,15 +448,14 @@ func promptToolSelection(defaultIncludeGNOC bool) ([]toolID, bool, error) {
 		defaultChoices,
 	)
 	if err != nil {
-		return nil, false, err
+		return nil, err
 	}
 
 	selected := make([]toolID, 0, len(selectedNames))
-	bastionSelected := false
 	for _, name := range selectedNames {
 		switch name {
 		case "bastion setup":
-			bastionSelected = true
+			selected = append(selected, toolBastion)
 		case "allproxy":
 			selected = append(selected, toolAllProxy)
 		case "hops-cli":
@@ -274,7 +470,7 @@ func promptToolSelection(defaultIncludeGNOC bool) ([]toolID, bool, error) {
 		selected = append(selected, toolStencil, toolSilencer, toolNCPCLI, toolJITPass)
 	}
 
-	return selected, bastionSelected, nil
+	return selected, nil
 }
 
 func toolIDsToNames(ids []toolID) []string {
@@ -299,6 +495,23 @@ func hasTool(tools []toolID, target toolID) bool {
 	return false
 }
 
+func printUsage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintln(out, "usage: chs-onboard [flags]")
+	fmt.Fprintln(out, "       chs-onboard --resume")
+	fmt.Fprintln(out, "       chs-onboard plan [--out plan.json] [--gnoc] [--only ids] [--guid guid]")
+	fmt.Fprintln(out, "       chs-onboard apply [--dry-run] plan.json")
+	fmt.Fprintln(out, "       chs-onboard state show|diff|forget|export|import")
+	fmt.Fprintln(out, "       chs-onboard lock [--out dir] [--check] [env...]")
+	fmt.Fprintln(out, "       chs-onboard repos status [--fetch]")
+	fmt.Fprintln(out, "       chs-onboard doctor [--days n]")
+	fmt.Fprintln(out, "       chs-onboard bundle create [--out file] [--gnoc] [--only ids]")
+	fmt.Fprintln(out, "       chs-onboard --from-bundle file [flags]")
+	fmt.Fprintln(out, "       chs-onboard --emit-script onboard.zsh [--gnoc] [--only ids]")
+	fmt.Fprintln(out, "\nflags:")
+	flag.PrintDefaults()
+}
+
 func printToolList() {
 	fmt.Println("Available tool IDs (--only=id1,id2,...):")
 	names := make([]string, 0, len(validToolIDs))
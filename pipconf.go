@@ -0,0 +1,244 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// pipIndexConfig is the pip configuration chs-onboard manages for one Python environment.
+type pipIndexConfig struct {
+	IndexURL string `json:"index_url,omitempty"`
+	// Mirrors are used in order when IndexURL does not answer the reachability probe.
+	// They should be internal mirrors: a public index lets anyone publish a package
+	// under an internal package's name.
+	Mirrors []string `json:"mirrors,omitempty"`
+	// PublicPyPI opts in to public PyPI as the last resort after the mirrors.
+	PublicPyPI     bool     `json:"public_pypi,omitempty"`
+	ExtraIndexURLs []string `json:"extra_index_urls,omitempty"`
+	TrustedHosts   []string `json:"trusted_hosts,omitempty"`
+	// Timeout is pip's network timeout in seconds.
+	Timeout int `json:"timeout,omitempty"`
+	// Cert is a CA bundle pip (and the probe) should trust. Left empty, it is the
+	// bundle sparta_pki writes, once that exists.
+	Cert string `json:"cert,omitempty"`
+}
+
+// pipConfigFile is ~/.chs-onboard/pip.json. Envs override Default per pyenv version
+// name; fields left empty in an override keep the default.
+type pipConfigFile struct {
+	Default pipIndexConfig            `json:"default"`
+	Envs    map[string]pipIndexConfig `json:"envs,omitempty"`
+}
+
+var defaultPipConfig = pipConfigFile{
+	Default: pipIndexConfig{
+		IndexURL:     "https://artifactory.oci.oraclecorp.com/api/pypi/global-release-pypi/simple",
+		TrustedHosts: []string{"artifactory.oci.oraclecorp.com"},
+		Timeout:      100,
+	},
+}
+
+// pipConfig is defaultPipConfig, or ~/.chs-onboard/pip.json when present.
+var pipConfig = loadPipConfig()
+
+// pipProbeTimeout bounds the reachability probe, so a slow index fails over too.
+const pipProbeTimeout = 10 * time.Second
+
+func loadPipConfig() pipConfigFile {
+	path := filepath.Join(os.Getenv("HOME"), ".chs-onboard", "pip.json")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return defaultPipConfig
+	}
+	var c pipConfigFile
+	if err := json.Unmarshal(data, &c); err != nil {
+		fmt.Fprintf(os.Stderr, "  [!] ignoring %s: %v\n", path, err)
+		return defaultPipConfig
+	}
+	if c.Default.IndexURL == "" {
+		fmt.Fprintf(os.Stderr, "  [!] ignoring %s: default.index_url is required\n", path)
+		return defaultPipConfig
+	}
+	return c
+}
+
+// pipConfigFor returns the pip configuration for a pyenv version name.
+func pipConfigFor(env string) pipIndexConfig {
+	c := pipConfig.Default
+	o, ok := pipConfig.Envs[env]
+	if !ok {
+		return c
+	}
+	if o.IndexURL != "" {
+		c.IndexURL = o.IndexURL
+	}
+	if o.Mirrors != nil {
+		c.Mirrors = o.Mirrors
+	}
+	if o.PublicPyPI {
+		c.PublicPyPI = true
+	}
+	if o.ExtraIndexURLs != nil {
+		c.ExtraIndexURLs = o.ExtraIndexURLs
+	}
+	if o.TrustedHosts != nil {
+		c.TrustedHosts = o.TrustedHosts
+	}
+	if o.Timeout != 0 {
+		c.Timeout = o.Timeout
+	}
+	if o.Cert != "" {
+		c.Cert = o.Cert
+	}
+	return c
+}
+
+// withCABundle defaults Cert to the CA bundle sparta_pki writes, once it exists.
+// It is resolved when pip.conf is written, not in the step: the bundle appearing
+// must not change the definition of tools that already wrote their pip.conf.
+func (c pipIndexConfig) withCABundle() pipIndexConfig {
+	if c.Cert == "" && pathExists(caBundlePath()) {
+		c.Cert = caBundlePath()
+	}
+	return c
+}
+
+// publicPyPIIndex is only tried when a config sets public_pypi.
+const publicPyPIIndex = "https://pypi.org/simple"
+
+// indexes returns the index URLs to try, in order.
+func (c pipIndexConfig) indexes() []string {
+	indexes := append([]string{c.IndexURL}, c.Mirrors...)
+	if c.PublicPyPI {
+		indexes = append(indexes, publicPyPIIndex)
+	}
+	return indexes
+}
+
+// certPath expands a leading ~/ in Cert.
+func (c pipIndexConfig) certPath() string {
+	if rest, ok := strings.CutPrefix(c.Cert, "~/"); ok {
+		return filepath.Join(os.Getenv("HOME"), rest)
+	}
+	return c.Cert
+}
+
+// pipConfIndexPlaceholder stands in for the index chosen at install time.
+const pipConfIndexPlaceholder = "__CHS_PIP_INDEX__"
+
+// pipConfText renders pip.conf with index as index-url.
+func pipConfText(c pipIndexConfig, index string) string {
+	var b strings.Builder
+	b.WriteString("# Managed by chs-onboard; edit ~/.chs-onboard/pip.json instead.\n[global]\n")
+	b.WriteString("index-url = " + index + "\n")
+	writeList := func(key string, values []string) {
+		if len(values) > 0 {
+			b.WriteString(key + " = " + strings.Join(values, "\n    ") + "\n")
+		}
+	}
+	writeList("extra-index-url", c.ExtraIndexURLs)
+	writeList("trusted-host", c.TrustedHosts)
+	if c.Timeout > 0 {
+		b.WriteString("timeout = " + strconv.Itoa(c.Timeout) + "\n")
+	}
+	if c.Cert != "" {
+		b.WriteString("cert = " + c.certPath() + "\n")
+	}
+	return b.String()
+}
+
+// pipConfPath is the site-wide pip.conf of a pyenv interpreter or virtualenv; pip
+// reads it from sys.prefix, so it applies only to that environment.
+func pipConfPath(env string) string {
+	return pyenvVersionDir(env) + "/pip.conf"
+}
+
+// pipConfStep writes env's managed pip.conf, pointing it at the first configured
+// index that answers when the step runs.
+func pipConfStep(log string, env toolID) step {
+	name := pythonEnvFor(env).Name
+	c := pipConfigFor(name)
+	return step{Kind: stepPipConf, Log: log, Dst: pipConfPath(name), Pip: &c}
+}
+
+// pipHTTPClient returns a client for probing indexes that trusts c's CA bundle in
+// addition to the system roots.
+func pipHTTPClient(c pipIndexConfig, timeout time.Duration) *http.Client {
+	client := &http.Client{Timeout: timeout}
+	if c.Cert == "" {
+		return client
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if pem, err := os.ReadFile(c.certPath()); err == nil {
+		pool.AppendCertsFromPEM(pem)
+	}
+	client.Transport = &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: &tls.Config{RootCAs: pool}}
+	return client
+}
+
+// probePipIndex checks that a simple index answers for a package every index has.
+func probePipIndex(client *http.Client, index string) error {
+	resp, err := client.Get(strings.TrimSuffix(index, "/") + "/pip/")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	return nil
+}
+
+// selectPipIndex returns the first of c's indexes that passes the probe.
+func selectPipIndex(log string, c pipIndexConfig) (string, error) {
+	client := pipHTTPClient(c, pipProbeTimeout)
+	var failures []string
+	for _, index := range c.indexes() {
+		err := probePipIndex(client, index)
+		if err == nil {
+			if len(failures) > 0 {
+				logWarn(log, "failing over to package index "+index, map[string]string{"unreachable": strings.Join(failures, "; ")})
+			}
+			return index, nil
+		}
+		host := index
+		if u, perr := url.Parse(index); perr == nil {
+			host = u.Host
+		}
+		failures = append(failures, fmt.Sprintf("%s: %v", host, err))
+	}
+	return "", fmt.Errorf("no package index reachable: %s", strings.Join(failures, "; "))
+}
+
+// writePipConf probes c's indexes and writes pip.conf at dst for the first that
+// answers. Installs from a bundle do not use the index, so nothing is probed.
+func writePipConf(log, dst string, c pipIndexConfig) error {
+	c = c.withCABundle()
+	index := c.IndexURL
+	if activeBundle == nil {
+		var err error
+		if index, err = selectPipIndex(log, c); err != nil {
+			return err
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(dst, []byte(pipConfText(c, index)), 0644); err != nil {
+		return fmt.Errorf("writing %s: %w", dst, err)
+	}
+	logInfo(log, "pip.conf written", map[string]string{"path": dst, "index": index})
+	return nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// stubPipIndex points pip.json's default index at a test server and counts the
+// requests it gets.
+func stubPipIndex(t *testing.T) (*int32, string) {
+	t.Helper()
+	var hits int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+	}))
+	t.Cleanup(srv.Close)
+	index := srv.URL + "/simple"
+	old := pipConfig
+	pipConfig = pipConfigFile{Default: pipIndexConfig{IndexURL: index, Timeout: 5}}
+	t.Cleanup(func() { pipConfig = old })
+	return &hits, index
+}
+
+// runPipConfSteps runs the pip_conf steps of tool, writing pip.conf under dir.
+func runPipConfSteps(t *testing.T, tool toolID, dir string) int {
+	t.Helper()
+	steps, err := toolSteps(tool, "guid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for _, s := range steps {
+		if s.Kind != stepPipConf {
+			continue
+		}
+		n++
+		s.Dst = filepath.Join(dir, string(tool), "pip.conf")
+		if err := runStep(s); err != nil {
+			t.Errorf("%s: %v", tool, err)
+		}
+	}
+	return n
+}
+
+func TestPhase1StepsDoNotCallThePackageIndex(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	hits, index := stubPipIndex(t)
+
+	for tool := range phase1Tools {
+		steps, err := toolSteps(tool, "guid")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range steps {
+			if strings.Contains(s.describe(), index) {
+				t.Errorf("%s step uses the package index: %s", tool, s.describe())
+			}
+		}
+		if n := runPipConfSteps(t, tool, home); n > 0 {
+			t.Errorf("%s writes pip.conf in phase 1", tool)
+		}
+	}
+	if n := atomic.LoadInt32(hits); n != 0 {
+		t.Errorf("phase 1 steps called the package index %d times", n)
+	}
+
+	// the phase-3 tools probe it
+	if n := runPipConfSteps(t, toolHopsCLI, home); n == 0 {
+		t.Fatal("hops_cli does not write pip.conf")
+	}
+	if atomic.LoadInt32(hits) == 0 {
+		t.Error("hops_cli wrote pip.conf without probing the index")
+	}
+}
+
+func TestCABundleResolvedWhenPipConfIsWritten(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	hits, _ := stubPipIndex(t)
+
+	before := toolDefinitionHash(toolHopsCLI, "guid")
+	if before == "" {
+		t.Fatal("no definition hash for hops_cli")
+	}
+	if err := os.MkdirAll(filepath.Dir(caBundlePath()), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(caBundlePath(), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if after := toolDefinitionHash(toolHopsCLI, "guid"); after != before {
+		t.Errorf("the CA bundle appearing changed hops_cli's definition hash: %s → %s", before, after)
+	}
+
+	runPipConfSteps(t, toolHopsCLI, home)
+	if atomic.LoadInt32(hits) == 0 {
+		t.Fatal("pip.conf written without probing the index")
+	}
+	data, err := os.ReadFile(filepath.Join(home, string(toolHopsCLI), "pip.conf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "cert = "+caBundlePath()+"\n") {
+		t.Errorf("pip.conf does not trust the CA bundle:\n%s", data)
+	}
+}
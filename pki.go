@@ -0,0 +1,380 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// trustRootExpiryWarning is how close to expiry a trust root gets a warning.
+const trustRootExpiryWarning = 30 * 24 * time.Hour
+
+// systemCABundles are where the OS keeps its root certificates, macOS first.
+var systemCABundles = []string{"/etc/ssl/cert.pem", "/etc/ssl/certs/ca-certificates.crt"}
+
+func spartaRootsDir() string {
+	return filepath.Join(os.Getenv("HOME"), "sparta_roots")
+}
+
+// caBundlePath is the combined CA bundle REQUESTS_CA_BUNDLE, SSL_CERT_FILE and git
+// point at: the system roots plus the Sparta roots.
+func caBundlePath() string {
+	return filepath.Join(os.Getenv("HOME"), ".chs-onboard", "ca-bundle.pem")
+}
+
+// gitIncludePath is the git config chs-onboard manages, included from ~/.gitconfig.
+func gitIncludePath() string {
+	return filepath.Join(os.Getenv("HOME"), ".chs-onboard", "gitconfig")
+}
+
+// trustRoot is a certificate read from a trust roots directory.
+type trustRoot struct {
+	Source string
+	Cert   *x509.Certificate
+}
+
+func (r trustRoot) fingerprint() string {
+	sum := sha256.Sum256(r.Cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+func (r trustRoot) name() string {
+	if cn := r.Cert.Subject.CommonName; cn != "" {
+		return cn
+	}
+	return r.Cert.Subject.String()
+}
+
+// validate checks the certificate can act as a trust root at now.
+func (r trustRoot) validate(now time.Time) error {
+	switch c := r.Cert; {
+	case !c.BasicConstraintsValid || !c.IsCA:
+		return fmt.Errorf("not a CA certificate")
+	case now.After(c.NotAfter):
+		return fmt.Errorf("expired on %s", c.NotAfter.Format("2006-01-02"))
+	case now.Before(c.NotBefore):
+		return fmt.Errorf("not valid until %s", c.NotBefore.Format("2006-01-02"))
+	}
+	return nil
+}
+
+// parseCertificates reads every certificate in data, which is PEM (any number of
+// CERTIFICATE blocks) or DER.
+func parseCertificates(data []byte) ([]*x509.Certificate, error) {
+	if !bytes.Contains(data, []byte("-----BEGIN")) {
+		return x509.ParseCertificates(data)
+	}
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		c, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, c)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no CERTIFICATE blocks")
+	}
+	return certs, nil
+}
+
+// readTrustRoots parses the certificates in every file under dir, skipping dot
+// files and directories (.git). Files that are not certificates are returned in bad.
+func readTrustRoots(dir string) (roots []trustRoot, bad map[string]error, err error) {
+	bad = map[string]error{}
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(d.Name(), ".") && path != dir {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		certs, err := parseCertificates(data)
+		if err != nil {
+			bad[path] = err
+			return nil
+		}
+		for _, c := range certs {
+			roots = append(roots, trustRoot{Source: path, Cert: c})
+		}
+		return nil
+	})
+	return roots, bad, err
+}
+
+// installTrustRoots replaces dst with the valid, distinct CA certificates under
+// src, one PEM file each, and rebuilds bundle from them and the system roots.
+func installTrustRoots(log, src, dst, bundle string) error {
+	if dryRun {
+		logInfo(log, "DRY-RUN: would validate the trust roots in "+src+" into "+dst+" and "+bundle, nil)
+		return nil
+	}
+	roots, bad, err := readTrustRoots(src)
+	if err != nil {
+		return err
+	}
+	for path, err := range bad {
+		logWarn(log, "skipping "+path+": not a certificate", map[string]string{"error": err.Error()})
+	}
+	now := time.Now()
+	seen := map[string]bool{}
+	var keep []trustRoot
+	for _, r := range roots {
+		fp := r.fingerprint()
+		fields := map[string]string{"subject": r.name(), "sha256": fp, "not_after": r.Cert.NotAfter.Format("2006-01-02"), "file": r.Source}
+		if err := r.validate(now); err != nil {
+			logWarn(log, "skipping trust root: "+err.Error(), fields)
+			continue
+		}
+		if seen[fp] {
+			logInfo(log, "skipping duplicate trust root", fields)
+			continue
+		}
+		seen[fp] = true
+		if r.Cert.NotAfter.Sub(now) < trustRootExpiryWarning {
+			logWarn(log, "trust root expires soon", fields)
+		} else {
+			logInfo(log, "trust root ok", fields)
+		}
+		keep = append(keep, r)
+	}
+	if len(keep) == 0 {
+		return fmt.Errorf("no valid CA certificates in %s", src)
+	}
+
+	// Build the new directory beside the old one and swap, so a failure leaves
+	// the previous roots in place.
+	staged := dst + ".new"
+	if err := os.RemoveAll(staged); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(staged, 0755); err != nil {
+		return err
+	}
+	for _, r := range keep {
+		name := trustRootFileName(r, staged)
+		if err := os.WriteFile(filepath.Join(staged, name), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: r.Cert.Raw}), 0644); err != nil {
+			return err
+		}
+	}
+	if err := os.RemoveAll(dst); err != nil {
+		return err
+	}
+	if err := os.Rename(staged, dst); err != nil {
+		return err
+	}
+	if err := writeCABundle(bundle, keep); err != nil {
+		return err
+	}
+	useCABundle(bundle)
+	logInfo(log, fmt.Sprintf("installed %d trust roots", len(keep)), map[string]string{"dir": dst, "bundle": bundle})
+	return nil
+}
+
+// caBundleEnv points Python requests, pip and OpenSSL (curl, git, Python's ssl) at
+// bundle, as the zshrc block does for the user's shell; requests and pip otherwise
+// trust only certifi's roots, which lack the Sparta CAs.
+func caBundleEnv(bundle string) []string {
+	return []string{"REQUESTS_CA_BUNDLE=" + bundle, "SSL_CERT_FILE=" + bundle, "PIP_CERT=" + bundle}
+}
+
+// useCABundle adds caBundleEnv to baseEnv, so every later command trusts bundle.
+func useCABundle(bundle string) {
+	add := caBundleEnv(bundle)
+	replaced := map[string]bool{}
+	for _, e := range add {
+		k, _, _ := strings.Cut(e, "=")
+		replaced[k] = true
+	}
+	env := make([]string, 0, len(baseEnv)+len(add))
+	for _, e := range baseEnv {
+		if k, _, _ := strings.Cut(e, "="); !replaced[k] {
+			env = append(env, e)
+		}
+	}
+	baseEnv = append(env, add...)
+}
+
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// trustRootFileName names r's file after its source, with the fingerprint added
+// when a file holds several certificates or two sources share a name.
+func trustRootFileName(r trustRoot, dir string) string {
+	base := strings.TrimSuffix(filepath.Base(r.Source), filepath.Ext(r.Source))
+	base = unsafeFileChars.ReplaceAllString(base, "_")
+	name := base + ".pem"
+	if pathExists(filepath.Join(dir, name)) {
+		name = base + "-" + r.fingerprint()[:12] + ".pem"
+	}
+	return name
+}
+
+// writeCABundle writes the system roots followed by roots, without duplicates.
+func writeCABundle(bundle string, roots []trustRoot) error {
+	var system []trustRoot
+	for _, path := range systemCABundles {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		certs, err := parseCertificates(data)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		for _, c := range certs {
+			system = append(system, trustRoot{Source: path, Cert: c})
+		}
+		break
+	}
+	if len(system) == 0 {
+		logWarn("sparta_pki", "no system CA bundle found; "+bundle+" holds only the Sparta roots", nil)
+	}
+	var b bytes.Buffer
+	seen := map[string]bool{}
+	for _, r := range append(system, roots...) {
+		if fp := r.fingerprint(); !seen[fp] {
+			seen[fp] = true
+			fmt.Fprintf(&b, "# %s\n", r.name())
+			_ = pem.Encode(&b, &pem.Block{Type: "CERTIFICATE", Bytes: r.Cert.Raw})
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(bundle), 0755); err != nil {
+		return err
+	}
+	return writeFileAtomic(bundle, b.Bytes(), 0644)
+}
+
+// bundleFingerprints returns the fingerprints of the certificates in bundle.
+func bundleFingerprints(bundle string) map[string]bool {
+	fps := map[string]bool{}
+	data, err := os.ReadFile(bundle)
+	if err != nil {
+		return fps
+	}
+	certs, _ := parseCertificates(data)
+	for _, c := range certs {
+		fps[trustRoot{Cert: c}.fingerprint()] = true
+	}
+	return fps
+}
+
+const caBundleZshrcGuard = "# BEGIN: CA bundle"
+
+func caBundleZshrcBlock() string {
+	return caBundleZshrcGuard + "\n" +
+		`export REQUESTS_CA_BUNDLE="$HOME/.chs-onboard/ca-bundle.pem"` + "\n" +
+		`export SSL_CERT_FILE="$HOME/.chs-onboard/ca-bundle.pem"` + "\n" +
+		"# END: CA bundle"
+}
+
+func checkSpartaPKI() toolCheck {
+	roots, _, err := readTrustRoots(spartaRootsDir())
+	if err != nil || len(roots) == 0 {
+		return missingCheck("~/sparta_roots is empty or missing")
+	}
+	inBundle := bundleFingerprints(caBundlePath())
+	missing := 0
+	for _, r := range roots {
+		if !inBundle[r.fingerprint()] {
+			missing++
+		}
+	}
+	switch {
+	case len(inBundle) == 0:
+		return outdatedCheck("no CA bundle at " + caBundlePath())
+	case missing > 0:
+		return outdatedCheck(fmt.Sprintf("%d trust roots missing from %s", missing, caBundlePath()))
+	case cmdOutput("git", "config", "--global", "--includes", "--get", "http.sslCAInfo") != caBundlePath():
+		return outdatedCheck("git http.sslCAInfo does not point at " + caBundlePath())
+	}
+	return installedCheck(fmt.Sprintf("%d trust roots in ~/sparta_roots and %s", len(roots), caBundlePath())).withVersion(fmt.Sprintf("%d roots", len(roots)))
+}
+
+func spartaPKISteps() []step {
+	tmpClone := repoDir("sparta-pki")
+	bundle := caBundlePath()
+	include := gitIncludePath()
+	return []step{
+		gitStep("sparta_pki", "sparta-pki"),
+		trustRootsStep("sparta_pki", tmpClone+"/trustroots", spartaRootsDir(), bundle),
+		execStep("sparta_pki", "rm", "-rf", tmpClone),
+		zshrcStep(caBundleZshrcGuard, caBundleZshrcBlock()),
+		execStep("sparta_pki", "git", "config", "--file", include, "http.sslCAInfo", bundle),
+		execStep("sparta_pki", "git", "config", "--global", "--replace-all", "include.path", include, "^"+regexp.QuoteMeta(include)+"$"),
+	}
+}
+
+// doctorTrustRoots reports the state of the installed Sparta roots and the CA bundle.
+func doctorTrustRoots(warnWithin time.Duration) []doctorFinding {
+	roots, bad, err := readTrustRoots(spartaRootsDir())
+	if err != nil || len(roots) == 0 {
+		return []doctorFinding{{Level: doctorFail, Message: "no trust roots in ~/sparta_roots; run chs-onboard --only sparta_pki"}}
+	}
+	var findings []doctorFinding
+	for path := range bad {
+		findings = append(findings, doctorFinding{Level: doctorWarn, Message: path + " is not a certificate"})
+	}
+	now := time.Now()
+	healthy := 0
+	for _, r := range roots {
+		left := r.Cert.NotAfter.Sub(now)
+		switch {
+		case r.validate(now) != nil:
+			findings = append(findings, doctorFinding{Level: doctorFail, Message: fmt.Sprintf("%s (%s): %v", r.name(), filepath.Base(r.Source), r.validate(now))})
+		case left < warnWithin:
+			findings = append(findings, doctorFinding{Level: doctorWarn, Message: fmt.Sprintf("%s (%s) expires in %d days, on %s", r.name(), filepath.Base(r.Source), int(left.Hours()/24), r.Cert.NotAfter.Format("2006-01-02"))})
+		default:
+			healthy++
+		}
+	}
+	if healthy > 0 {
+		findings = append(findings, doctorFinding{Level: doctorOK, Message: fmt.Sprintf("%d trust roots valid for more than %d days", healthy, int(warnWithin.Hours()/24))})
+	}
+
+	bundle := caBundlePath()
+	inBundle := bundleFingerprints(bundle)
+	if len(inBundle) == 0 {
+		return append(findings, doctorFinding{Level: doctorFail, Message: "no CA bundle at " + bundle})
+	}
+	for _, r := range roots {
+		if !inBundle[r.fingerprint()] {
+			findings = append(findings, doctorFinding{Level: doctorFail, Message: fmt.Sprintf("%s is missing from %s; rerun chs-onboard --only sparta_pki", r.name(), bundle)})
+		}
+	}
+	for _, env := range []string{"REQUESTS_CA_BUNDLE", "SSL_CERT_FILE"} {
+		if v := os.Getenv(env); v != bundle {
+			findings = append(findings, doctorFinding{Level: doctorWarn, Message: fmt.Sprintf("%s is %q, not %s; open a new shell", env, v, bundle)})
+		}
+	}
+	if v := cmdOutput("git", "config", "--global", "--includes", "--get", "http.sslCAInfo"); v != bundle {
+		findings = append(findings, doctorFinding{Level: doctorFail, Message: fmt.Sprintf("git http.sslCAInfo is %q, not %s", v, bundle)})
+	}
+	return findings
+}
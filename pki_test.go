@@ -0,0 +1,45 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestUseCABundleExportsToChildProcesses(t *testing.T) {
+	old := baseEnv
+	t.Cleanup(func() { baseEnv = old })
+	baseEnv = []string{"HOME=/home/me", "SSL_CERT_FILE=/old.pem", "PIP_CERT=/old.pem"}
+
+	useCABundle("/home/me/.chs-onboard/ca-bundle.pem")
+
+	want := map[string]string{
+		"REQUESTS_CA_BUNDLE": "/home/me/.chs-onboard/ca-bundle.pem",
+		"SSL_CERT_FILE":      "/home/me/.chs-onboard/ca-bundle.pem",
+		"PIP_CERT":           "/home/me/.chs-onboard/ca-bundle.pem",
+		"HOME":               "/home/me",
+	}
+	got := map[string][]string{}
+	for _, e := range baseEnv {
+		k, v, _ := strings.Cut(e, "=")
+		got[k] = append(got[k], v)
+	}
+	for k, v := range want {
+		if len(got[k]) != 1 || got[k][0] != v {
+			t.Errorf("%s = %q, want [%q]", k, got[k], v)
+		}
+	}
+}
+
+// TestCABundleEnvMatchesZshrc keeps child processes and the user's shell on the same CAs.
+func TestCABundleEnvMatchesZshrc(t *testing.T) {
+	block := caBundleZshrcBlock()
+	for _, e := range caBundleEnv("$HOME/.chs-onboard/ca-bundle.pem") {
+		k, _, _ := strings.Cut(e, "=")
+		if k == "PIP_CERT" {
+			continue // pip reads cert from pip.conf in the shell
+		}
+		if !strings.Contains(block, "export "+k+"=") {
+			t.Errorf("%s is exported to child processes but not by the zshrc block", k)
+		}
+	}
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+const planVersion = 2
+
+type toolAction string
+
+const (
+	actionRun         toolAction = "run"
+	actionSkipState   toolAction = "skip_state"
+	actionSkipPresent toolAction = "skip_present"
+)
+
+// runPlan is a fully resolved install plan for one machine, written by `plan`
+// and executed verbatim by `apply`.
+type runPlan struct {
+	Version        int         `json:"version"`
+	Generated      string      `json:"generated"`
+	User           string      `json:"user"`
+	Home           string      `json:"home"`
+	GUID           string      `json:"guid"`
+	ForceReinstall bool        `json:"force_reinstall,omitempty"`
+	Hooks          runHooks    `json:"hooks"`
+	Phases         []planPhase `json:"phases"`
+}
+
+type planPhase struct {
+	Name  string     `json:"name"`
+	Tools []planTool `json:"tools"`
+}
+
+type planTool struct {
+	ID     toolID     `json:"id"`
+	Action toolAction `json:"action"`
+	Check  toolCheck  `json:"check"`
+	Steps  []planStep `json:"steps,omitempty"`
+}
+
+// planStep is a step plus the guard verdict observed when the plan was made.
+type planStep struct {
+	step
+	Skip string `json:"skip,omitempty"`
+}
+
+// plannedSteps, when set by apply, replaces each tool's freshly built steps.
+var plannedSteps map[toolID][]step
+
+func runPlanCommand(args []string) {
+	fs := flag.NewFlagSet("plan", flag.ExitOnError)
+	outFlag := fs.String("out", "plan.json", "file to write the plan to (- for stdout)")
+	gnocFlag := fs.Bool("gnoc", false, "include GNOC-specific tools")
+	onlyFlag := fs.String("only", "", "comma-separated tool IDs to plan (default: required tools)")
+	guidFlag := fs.String("guid", "", "Oracle GUID to plan for (default: current user)")
+	forceReinstallFlag := fs.Bool("force-reinstall", false, "plan every selected tool as if nothing were installed")
+	_ = fs.Parse(args)
+	forceReinstall = *forceReinstallFlag
+
+	if err := loadRunState(); err != nil {
+		fmt.Fprintf(os.Stderr, "could not load saved state: %v\n", err)
+		os.Exit(1)
+	}
+	tools := planToolSelection(*onlyFlag, *gnocFlag)
+	if len(tools) == 0 {
+		fmt.Fprintln(os.Stderr, "No valid tool IDs provided. Use --list to see available tools.")
+		os.Exit(1)
+	}
+	guid := strings.TrimSpace(*guidFlag)
+	if guid == "" {
+		guid = currentUser()
+	}
+
+	p, err := buildPlan(tools, guid)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "plan failed: %v\n", err)
+		os.Exit(1)
+	}
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "plan failed: %v\n", err)
+		os.Exit(1)
+	}
+	data = append(data, '\n')
+	if *outFlag == "-" {
+		_, _ = os.Stdout.Write(data)
+		return
+	}
+	if err := os.WriteFile(*outFlag, data, 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "writing plan: %v\n", err)
+		os.Exit(1)
+	}
+	printPlanSummary(p)
+	fmt.Printf("\nPlan written to %s. Run `chs-onboard apply %s` to execute it.\n", *outFlag, *outFlag)
+}
+
+func runApplyCommand(args []string) {
+	fs := flag.NewFlagSet("apply", flag.ExitOnError)
+	dryRunFlag := fs.Bool("dry-run", false, "verify the plan and print it without making system changes")
+	statusAddrFlag := fs.String("status-addr", "", "serve a live status dashboard on this address (e.g. 127.0.0.1:8765)")
+	keepGoingFlag := fs.Bool("keep-going", false, "keep installing tools that do not depend on a failed one, then summarise failures")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: chs-onboard apply [flags] plan.json")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	dryRun = *dryRunFlag
+	keepGoing = *keepGoingFlag
+
+	p, err := loadPlan(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not load plan: %v\n", err)
+		os.Exit(1)
+	}
+	forceReinstall = p.ForceReinstall
+	if err := loadRunState(); err != nil {
+		fmt.Fprintf(os.Stderr, "could not load saved state: %v\n", err)
+		os.Exit(1)
+	}
+	if diffs := verifyPlan(p); len(diffs) > 0 {
+		fmt.Fprintln(os.Stderr, "Refusing to apply: this machine no longer matches the plan.")
+		for _, d := range diffs {
+			fmt.Fprintf(os.Stderr, "  - %s\n", d)
+		}
+		fmt.Fprintln(os.Stderr, "Generate a fresh plan with `chs-onboard plan`.")
+		os.Exit(1)
+	}
+
+	finish := startRun(*statusAddrFlag)
+	defer finish()
+
+	logSetPhase("preflight")
+	fmt.Println("\n── Preflight ─────────────────────────────────────────────────")
+	if err := preflightChecks(); err != nil {
+		logFatal("preflight", err.Error(), nil)
+	}
+	logInfo("identity", "using GUID from plan", map[string]string{"guid": p.GUID})
+
+	plannedSteps = map[toolID][]step{}
+	var tools []toolID
+	for _, ph := range p.Phases {
+		for _, pt := range ph.Tools {
+			tools = append(tools, pt.ID)
+			steps := make([]step, 0, len(pt.Steps))
+			for _, ps := range pt.Steps {
+				steps = append(steps, ps.step)
+			}
+			plannedSteps[pt.ID] = steps
+		}
+	}
+	runOnboarding("apply", tools, p.Hooks, p.GUID)
+}
+
+// planToolSelection resolves tools for a plan without prompting, mirroring the interactive selection.
+func planToolSelection(only string, gnoc bool) []toolID {
+	if only != "" {
+		return parseOnlyFlag(only)
+	}
+	requested := requiredTools()
+	if gnoc {
+		requested = append(requested, toolGNOCHelper, toolStencil, toolSilencer, toolNCPCLI, toolJITPass)
+	}
+	return resolveTools(requested)
+}
+
+// buildPlan resolves phases, check results and steps for tools on this machine. It makes no changes.
+func buildPlan(tools []toolID, guid string) (*runPlan, error) {
+	p := &runPlan{
+		Version:        planVersion,
+		Generated:      time.Now().UTC().Format(time.RFC3339),
+		User:           currentUser(),
+		Home:           os.Getenv("HOME"),
+		GUID:           guid,
+		ForceReinstall: forceReinstall,
+		Hooks:          buildRunHooks(tools),
+	}
+	p1, p3, p4 := splitPhases(tools)
+	for _, ph := range []struct {
+		name  string
+		tools []toolID
+	}{{"phase1", p1}, {"phase3", p3}, {"phase4", p4}} {
+		if len(ph.tools) == 0 {
+			continue
+		}
+		phase := planPhase{Name: ph.name}
+		for _, t := range ph.tools {
+			pt, err := planForTool(t, guid)
+			if err != nil {
+				return nil, err
+			}
+			phase.Tools = append(phase.Tools, pt)
+		}
+		p.Phases = append(p.Phases, phase)
+	}
+	return p, nil
+}
+
+func planForTool(t toolID, guid string) (planTool, error) {
+	pt := planTool{ID: t, Action: actionRun, Check: checkTool(t)}
+	stale, _ := toolStale(t, guid)
+	switch {
+	case !forceReinstall && isToolCompleted(t, guid):
+		pt.Action = actionSkipState
+	case !forceReinstall && pt.Check.State == checkInstalled && !stale:
+		pt.Action = actionSkipPresent
+	}
+	steps, err := toolSteps(t, guid)
+	if err != nil {
+		return pt, err
+	}
+	for _, s := range steps {
+		pt.Steps = append(pt.Steps, planStep{step: s, Skip: s.skipReason()})
+	}
+	return pt, nil
+}
+
+func loadPlan(path string) (*runPlan, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var p runPlan
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("invalid plan file: %w", err)
+	}
+	if p.Version != planVersion {
+		return nil, fmt.Errorf("plan version %d is not supported (want %d)", p.Version, planVersion)
+	}
+	return &p, nil
+}
+
+// verifyPlan re-evaluates the plan against the machine and returns every divergence found.
+func verifyPlan(p *runPlan) []string {
+	var diffs []string
+	if user := currentUser(); !strings.EqualFold(user, p.User) {
+		diffs = append(diffs, fmt.Sprintf("plan was made for user %q, running as %q", p.User, user))
+	}
+	if home := os.Getenv("HOME"); home != p.Home {
+		diffs = append(diffs, fmt.Sprintf("plan was made for home %s, current home is %s", p.Home, home))
+	}
+	for _, ph := range p.Phases {
+		for _, pt := range ph.Tools {
+			if _, ok := toolDefs[pt.ID]; !ok {
+				diffs = append(diffs, fmt.Sprintf("%s: unknown tool", pt.ID))
+				continue
+			}
+			now, err := planForTool(pt.ID, p.GUID)
+			if err != nil {
+				diffs = append(diffs, fmt.Sprintf("%s: %v", pt.ID, err))
+				continue
+			}
+			if now.Action != pt.Action {
+				diffs = append(diffs, fmt.Sprintf("%s: planned %s, would now %s", pt.ID, pt.Action, now.Action))
+			}
+			if now.Check.State != pt.Check.State {
+				diffs = append(diffs, fmt.Sprintf("%s: was %s, now %s (%s)", pt.ID, pt.Check.State, now.Check.State, now.Check.Reason))
+			}
+			if pt.Action != actionRun {
+				continue
+			}
+			for _, ps := range pt.Steps {
+				if skip := ps.skipReason(); (skip == "") != (ps.Skip == "") {
+					diffs = append(diffs, fmt.Sprintf("%s: step %q guard changed (planned skip=%q, now skip=%q)", pt.ID, ps.describe(), ps.Skip, skip))
+				}
+			}
+		}
+	}
+	return diffs
+}
+
+func printPlanSummary(p *runPlan) {
+	fmt.Printf("Plan for %s (GUID %s):\n", p.User, p.GUID)
+	for _, h := range [][]step{p.Hooks.Start, p.Hooks.AfterPhase1, p.Hooks.VPN} {
+		for _, s := range h {
+			fmt.Printf("    [→] %s\n", s.describe())
+		}
+	}
+	for _, ph := range p.Phases {
+		fmt.Printf("\n  %s\n", ph.Name)
+		for _, pt := range ph.Tools {
+			switch pt.Action {
+			case actionSkipState:
+				fmt.Printf("    [✓] %s: skip, already completed in previous run\n", pt.ID)
+			case actionSkipPresent:
+				fmt.Printf("    [✓] %s: skip, already present (%s)\n", pt.ID, pt.Check.Reason)
+			default:
+				fmt.Printf("    [→] %s: run (%s: %s)\n", pt.ID, pt.Check.State, pt.Check.Reason)
+			}
+		}
+	}
+}
+
+// currentUser returns the login name of the user running chs-onboard.
+func currentUser() string {
+	user := strings.TrimSpace(cmdOutput("id", "-un"))
+	if user == "" {
+		user = os.Getenv("USER")
+	}
+	return user
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"os"
+	"runtime"
+	"strings"
+)
+
+const (
+	armBrewPrefix   = "/opt/homebrew"
+	intelBrewPrefix = "/usr/local"
+)
+
+// platformFS is the filesystem view platform detection needs; tests can swap in a fake.
+type platformFS interface {
+	exists(path string) bool
+}
+
+type osPlatformFS struct{}
+
+func (osPlatformFS) exists(path string) bool { return pathExists(path) }
+
+// platformInfo describes the Mac chs-onboard runs on and where Homebrew lives.
+type platformInfo struct {
+	// Arch is the hardware architecture, "arm64" or "amd64", even when this
+	// process is translated by Rosetta.
+	Arch string
+	// Rosetta is set when this process is an x86_64 binary running on Apple Silicon.
+	Rosetta    bool
+	BrewPrefix string
+}
+
+// platform is detected once at startup; everything that needs a Homebrew path derives it from here.
+var platform = detectHostPlatform()
+
+func detectHostPlatform() platformInfo {
+	arch := runtime.GOARCH
+	if strings.TrimSpace(cmdOutput("sysctl", "-n", "hw.optional.arm64")) == "1" {
+		arch = "arm64"
+	}
+	translated := strings.TrimSpace(cmdOutput("sysctl", "-n", "sysctl.proc_translated")) == "1"
+	return detectPlatform(osPlatformFS{}, arch, translated, os.Getenv("HOMEBREW_PREFIX"))
+}
+
+// detectPlatform picks the Homebrew prefix for the hardware: an explicit HOMEBREW_PREFIX
+// with brew in it wins, then the architecture's default prefix, then the other layout
+// (e.g. an Intel Homebrew migrated to an Apple Silicon Mac). With no brew installed
+// yet, the architecture's default is where it will be installed.
+func detectPlatform(fs platformFS, arch string, translated bool, envPrefix string) platformInfo {
+	p := platformInfo{Arch: arch, Rosetta: translated && arch == "arm64"}
+	preferred, other := intelBrewPrefix, armBrewPrefix
+	if arch == "arm64" {
+		preferred, other = armBrewPrefix, intelBrewPrefix
+	}
+	switch {
+	case envPrefix != "" && fs.exists(envPrefix+"/bin/brew"):
+		p.BrewPrefix = envPrefix
+	case fs.exists(preferred + "/bin/brew"):
+		p.BrewPrefix = preferred
+	case fs.exists(other + "/bin/brew"):
+		p.BrewPrefix = other
+	default:
+		p.BrewPrefix = preferred
+	}
+	return p
+}
+
+func (p platformInfo) brewBin() string { return p.BrewPrefix + "/bin/brew" }
+
+// brewPath returns the path of a Homebrew-installed binary.
+func (p platformInfo) brewPath(name string) string { return p.BrewPrefix + "/bin/" + name }
+
+// brewRepository is where Homebrew's own git checkout lives for this prefix.
+func (p platformInfo) brewRepository() string {
+	if p.BrewPrefix == intelBrewPrefix {
+		return intelBrewPrefix + "/Homebrew"
+	}
+	return p.BrewPrefix
+}
+
+// brewCommand returns argv for running brew. Under Rosetta an arm64 Homebrew is
+// run with `arch -arm64` so it does not install x86_64 bottles.
+func (p platformInfo) brewCommand(args ...string) []string {
+	argv := append([]string{p.brewBin()}, args...)
+	if p.Rosetta && p.BrewPrefix == armBrewPrefix {
+		argv = append([]string{"arch", "-arm64"}, argv...)
+	}
+	return argv
+}
+
+// pathDirs is the PATH prefix for Homebrew binaries.
+func (p platformInfo) pathDirs() []string {
+	return []string{p.BrewPrefix + "/bin", p.BrewPrefix + "/sbin"}
+}
+
+// joinPath joins PATH directories, dropping repeats (/usr/local/bin is both the
+// Intel Homebrew bin and a system default).
+func joinPath(dirs ...string) string {
+	seen := map[string]bool{}
+	out := make([]string, 0, len(dirs))
+	for _, d := range dirs {
+		if !seen[d] {
+			seen[d] = true
+			out = append(out, d)
+		}
+	}
+	return strings.Join(out, ":")
+}
+
+func (p platformInfo) brewEnv() []string {
+	return []string{
+		"HOMEBREW_PREFIX=" + p.BrewPrefix,
+		"HOMEBREW_CELLAR=" + p.BrewPrefix + "/Cellar",
+		"HOMEBREW_REPOSITORY=" + p.brewRepository(),
+	}
+}
+
+// shellenvLine is the ~/.zshrc line that puts this Homebrew on PATH.
+func (p platformInfo) shellenvLine() string {
+	return `eval "$(` + p.brewBin() + ` shellenv)"`
+}
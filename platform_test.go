@@ -0,0 +1,118 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// fakePlatformFS reports the listed paths as existing.
+type fakePlatformFS map[string]bool
+
+func (f fakePlatformFS) exists(path string) bool { return f[path] }
+
+func TestDetectPlatform(t *testing.T) {
+	tests := []struct {
+		name       string
+		files      []string
+		arch       string
+		translated bool
+		envPrefix  string
+		want       platformInfo
+	}{
+		{
+			name:  "apple silicon",
+			files: []string{"/opt/homebrew/bin/brew"},
+			arch:  "arm64",
+			want:  platformInfo{Arch: "arm64", BrewPrefix: armBrewPrefix},
+		},
+		{
+			name:  "intel",
+			files: []string{"/usr/local/bin/brew"},
+			arch:  "amd64",
+			want:  platformInfo{Arch: "amd64", BrewPrefix: intelBrewPrefix},
+		},
+		{
+			name: "apple silicon without brew yet",
+			arch: "arm64",
+			want: platformInfo{Arch: "arm64", BrewPrefix: armBrewPrefix},
+		},
+		{
+			name: "intel without brew yet",
+			arch: "amd64",
+			want: platformInfo{Arch: "amd64", BrewPrefix: intelBrewPrefix},
+		},
+		{
+			name:  "intel homebrew migrated to apple silicon",
+			files: []string{"/usr/local/bin/brew"},
+			arch:  "arm64",
+			want:  platformInfo{Arch: "arm64", BrewPrefix: intelBrewPrefix},
+		},
+		{
+			name:  "both layouts prefer the architecture's",
+			files: []string{"/usr/local/bin/brew", "/opt/homebrew/bin/brew"},
+			arch:  "arm64",
+			want:  platformInfo{Arch: "arm64", BrewPrefix: armBrewPrefix},
+		},
+		{
+			name:       "rosetta",
+			files:      []string{"/opt/homebrew/bin/brew"},
+			arch:       "arm64",
+			translated: true,
+			want:       platformInfo{Arch: "arm64", Rosetta: true, BrewPrefix: armBrewPrefix},
+		},
+		{
+			name:       "rosetta with env prefix",
+			files:      []string{"/opt/homebrew/bin/brew", "/usr/local/bin/brew"},
+			arch:       "arm64",
+			translated: true,
+			envPrefix:  "/usr/local",
+			want:       platformInfo{Arch: "arm64", Rosetta: true, BrewPrefix: intelBrewPrefix},
+		},
+		{
+			name:      "env prefix without brew is ignored",
+			files:     []string{"/opt/homebrew/bin/brew"},
+			arch:      "arm64",
+			envPrefix: "/nonexistent",
+			want:      platformInfo{Arch: "arm64", BrewPrefix: armBrewPrefix},
+		},
+		{
+			name:       "translated flag on intel is not rosetta",
+			files:      []string{"/usr/local/bin/brew"},
+			arch:       "amd64",
+			translated: true,
+			want:       platformInfo{Arch: "amd64", BrewPrefix: intelBrewPrefix},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := fakePlatformFS{}
+			for _, f := range tt.files {
+				fs[f] = true
+			}
+			got := detectPlatform(fs, tt.arch, tt.translated, tt.envPrefix)
+			if got != tt.want {
+				t.Errorf("detectPlatform() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBrewCommandUnderRosetta(t *testing.T) {
+	arm := platformInfo{Arch: "arm64", Rosetta: true, BrewPrefix: armBrewPrefix}
+	if got, want := arm.brewCommand("install", "xz"), []string{"arch", "-arm64", "/opt/homebrew/bin/brew", "install", "xz"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("arm64 brew under rosetta: got %q, want %q", got, want)
+	}
+	intel := platformInfo{Arch: "arm64", Rosetta: true, BrewPrefix: intelBrewPrefix}
+	if got, want := intel.brewCommand("install", "xz"), []string{"/usr/local/bin/brew", "install", "xz"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("intel brew under rosetta: got %q, want %q", got, want)
+	}
+}
+
+func TestBrewRepository(t *testing.T) {
+	if got := (platformInfo{BrewPrefix: intelBrewPrefix}).brewRepository(); got != "/usr/local/Homebrew" {
+		t.Errorf("intel brewRepository() = %q", got)
+	}
+	if got := (platformInfo{BrewPrefix: armBrewPrefix}).brewRepository(); got != armBrewPrefix {
+		t.Errorf("arm brewRepository() = %q", got)
+	}
+}
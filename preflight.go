@@ -4,7 +4,6 @@ import (
 	"fmt"
 	"net/http"
 	"os"
-	"os/exec"
 	"regexp"
 	"strings"
 	"time"
@@ -19,15 +18,20 @@ var (
 
 // preflightRun executes all preflight checks. Returns the Oracle GUID entered by the user.
 func preflightRun() (string, error) {
+	if err := preflightChecks(); err != nil {
+		return "", err
+	}
+	return preflightIdentity()
+}
+
+// preflightChecks runs the preflight steps that do not depend on the user's GUID.
+func preflightChecks() error {
 	logSetPhase("preflight")
 
 	if err := preflightNetCheck(); err != nil {
-		return "", err
-	}
-	if err := preflightSSHKeyEnsure(); err != nil {
-		return "", err
+		return err
 	}
-	return preflightIdentity()
+	return preflightSSHKeyEnsure()
 }
 
 func preflightNetCheck() error {
@@ -39,46 +43,56 @@ func preflightNetCheck() error {
 	return nil
 }
 
+// preflightSSHKeyEnsure makes sure there is an SSH key that meets sshKeyConfig,
+// with sane ~/.ssh permissions, loaded into ssh-agent for the git clones to come.
 func preflightSSHKeyEnsure() error {
-	home := os.Getenv("HOME")
-	candidates := []string{
-		home + "/.ssh/id_ed25519.pub",
-		home + "/.ssh/id_rsa.pub",
-	}
+	fixSSHPermissions()
 
-	var pubKeyPath string
-	for _, p := range candidates {
-		if pathExists(p) {
-			pubKeyPath = p
-			break
+	keyPath := findSSHKey()
+	if keyPath != "" {
+		info, err := inspectSSHKey(keyPath + ".pub")
+		if err != nil {
+			return err
+		}
+		if sshKeyConfig.weak(info) {
+			if keyPath, err = offerKeyRotation(keyPath, info); err != nil {
+				return err
+			}
 		}
 	}
 
-	if pubKeyPath == "" {
+	if keyPath == "" {
 		if dryRun {
-			logInfo("ssh_key", "dry-run mode: no SSH key found; would generate ed25519 key", nil)
+			logInfo("ssh_key", "dry-run mode: no SSH key found; would generate "+sshKeyConfig.Type+" key", nil)
 			cachedSSHPublicKey = "<dry-run: ssh public key would be generated here>"
 			return nil
 		}
-		logInfo("ssh_key", "no SSH key found, generating ed25519 key", nil)
+		logInfo("ssh_key", "no SSH key found, generating "+sshKeyConfig.Type+" key", nil)
 		email, err := uiPrompt("SSH Key Setup", "Enter your Oracle email for SSH key generation:", "firstname.lastname@oracle.com")
 		if err != nil {
 			return fmt.Errorf("SSH key generation cancelled: %w", err)
 		}
-		keyPath := home + "/.ssh/id_ed25519"
-		if err := exec.Command("ssh-keygen", "-t", "ed25519", "-C", email, "-f", keyPath, "-N", "").Run(); err != nil {
-			return fmt.Errorf("ssh-keygen failed: %w", err)
+		keyPath = sshKeyConfig.keyFiles()[0]
+		if err := generateSSHKey(keyPath, email); err != nil {
+			return err
 		}
-		pubKeyPath = keyPath + ".pub"
-		logInfo("ssh_key", "SSH key generated", map[string]string{"path": keyPath})
 	}
 
+	pubKeyPath := keyPath + ".pub"
 	pubKey, err := os.ReadFile(pubKeyPath)
 	if err != nil {
 		return fmt.Errorf("could not read public key at %s: %w", pubKeyPath, err)
 	}
-
 	cachedSSHPublicKey = strings.TrimSpace(string(pubKey))
+
+	if info, err := inspectSSHKey(pubKeyPath); err == nil {
+		if err := loadSSHAgent(keyPath, info); err != nil {
+			logWarn("ssh_key", "key not loaded into ssh-agent; git may prompt for it", map[string]string{"error": err.Error()})
+		}
+	}
+	if err := writeSSHConfig(sshAgentConfigStep("ssh_key")); err != nil {
+		logWarn("ssh_key", "could not add the ssh-agent settings to ~/.ssh/config", map[string]string{"error": err.Error()})
+	}
 	logInfo("ssh_key", "SSH public key ready; Bitbucket add step deferred until VPN is connected", nil)
 	return nil
 }
@@ -92,8 +106,18 @@ func postVPNSSHKeyStep() error {
 		logInfo("ssh_key", "dry-run mode: would prompt user to add SSH key in Bitbucket now", nil)
 		return nil
 	}
+	token, err := bitbucketToken()
+	if err != nil {
+		logWarn("ssh_key", "ignoring the Bitbucket access token", map[string]string{"error": err.Error()})
+	} else if token != "" {
+		logInfo("ssh_key", "registering SSH public key through the Bitbucket API", map[string]string{"url": bitbucketURL()})
+		if err = registerSSHKey(newBitbucketClient(token), cachedSSHPublicKey); err == nil {
+			return nil
+		}
+		logWarn("ssh_key", "Bitbucket API upload failed; falling back to adding the key by hand", map[string]string{"error": err.Error()})
+	}
 	logInfo("ssh_key", "presenting SSH public key for Bitbucket add", nil)
-	return uiShowSSHKey(cachedSSHPublicKey)
+	return uiShowSSHKey(cachedSSHPublicKey, registerSSHKeyWithPrompt)
 }
 
 func preflightIdentity() (string, error) {
@@ -103,21 +127,26 @@ func preflightIdentity() (string, error) {
 	}
 	guid = strings.TrimSpace(guid)
 	logInfo("identity", "oracle GUID entered", map[string]string{"guid": guid})
-
-	currentUser := strings.TrimSpace(cmdOutput("id", "-un"))
-	if currentUser == "" {
-		currentUser = os.Getenv("USER")
+	if err := ensureIdentity(guid); err != nil {
+		return "", err
 	}
+	return guid, nil
+}
+
+// ensureIdentity checks the local account matches guid and offers to rename it if not.
+// After an auto-rename the process exits; the run continues with --resume after relogin.
+func ensureIdentity(guid string) error {
+	localUser := currentUser()
 	currentHome := strings.TrimSpace(os.Getenv("HOME"))
 	expectedHome := "/Users/" + guid
 
-	if strings.EqualFold(currentUser, guid) && strings.EqualFold(currentHome, expectedHome) {
+	if strings.EqualFold(localUser, guid) && strings.EqualFold(currentHome, expectedHome) {
 		logInfo("identity", "local username/home already match GUID", nil)
-		return guid, nil
+		return nil
 	}
 
 	logWarn("identity", "local user/home mismatch detected", map[string]string{
-		"current_user": currentUser,
+		"current_user": localUser,
 		"guid":         guid,
 		"current_home": currentHome,
 		"expected_home": expectedHome,
@@ -125,28 +154,38 @@ func preflightIdentity() (string, error) {
 
 	choice, err := uiChoose(
 		"GUID Mismatch",
-		fmt.Sprintf("Your GUID is %s, but local account is %s with home %s.\n\nChoose how to proceed:", guid, currentUser, currentHome),
+		fmt.Sprintf("Your GUID is %s, but local account is %s with home %s.\n\nChoose how to proceed:", guid, localUser, currentHome),
 		[]string{"Auto-rename", "Manual steps", "Cancel"},
 		"Manual steps",
 	)
 	if err != nil {
-		return "", fmt.Errorf("identity choice cancelled: %w", err)
+		return fmt.Errorf("identity choice cancelled: %w", err)
 	}
 	if choice == "Cancel" {
-		return "", fmt.Errorf("cancelled by user")
+		return fmt.Errorf("cancelled by user")
 	}
 	if choice == "Manual steps" {
 		_ = uiAlert("Manual Rename Required",
-			fmt.Sprintf("Please rename your local user and home folder to GUID before rerunning:\n\nCurrent user: %s\nGUID: %s\nExpected home: %s\n\nThen run chs-onboard again.", currentUser, guid, expectedHome))
-		return "", fmt.Errorf("manual rename required before proceeding")
+			fmt.Sprintf("Please rename your local user and home folder to GUID before rerunning:\n\nCurrent user: %s\nGUID: %s\nExpected home: %s\n\nThen run chs-onboard again.", localUser, guid, expectedHome))
+		return fmt.Errorf("manual rename required before proceeding")
 	}
 
-	if err := autoRenameLocalUser(guid, currentUser, currentHome); err != nil {
-		return "", err
+	// Record the GUID before the rename moves the home directory (and state.json with it).
+	beginProgress(nil, guid)
+	if err := autoRenameLocalUser(guid, localUser, currentHome); err != nil {
+		return err
 	}
-	_ = uiAlert("Relogin Required", "Account rename completed. Please log out and log back in, then rerun chs-onboard.")
+	msg := "Account rename completed. Please log out and log back in, then run chs-onboard --resume."
+	if ok, _ := uiConfirm("Resume After Login", "Continue onboarding automatically after you log back in?"); ok {
+		if err := installResumeAgent(currentHome, expectedHome); err != nil {
+			logWarn("resume", fmt.Sprintf("failed to install resume LaunchAgent: %v", err), nil)
+		} else {
+			msg = "Account rename completed. Please log out and log back in; onboarding will continue automatically in Terminal."
+		}
+	}
+	_ = uiAlert("Relogin Required", msg)
 	os.Exit(0)
-	return guid, nil
+	return nil
 }
 
 func autoRenameLocalUser(guid, currentUser, currentHome string) error {
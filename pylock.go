@@ -0,0 +1,291 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// pipPin is one locked package: an exact version and the hashes of its allowed files.
+type pipPin struct {
+	Name    string
+	Version string
+	Hashes  []string
+}
+
+// pipLock is a requirements lockfile for one pyenv interpreter or virtualenv.
+type pipLock struct {
+	Env    string
+	Source string
+	Pins   []pipPin
+	data   []byte
+}
+
+// pipLocks maps pyenv version names to their lockfiles. Lockfiles are embedded from
+// locks/<name>.txt; ~/.chs-onboard/locks/<name>.txt overrides the embedded one.
+var pipLocks = loadPipLocks()
+
+func userLockDir() string {
+	return filepath.Join(os.Getenv("HOME"), ".chs-onboard", "locks")
+}
+
+func loadPipLocks() map[string]*pipLock {
+	locks := map[string]*pipLock{}
+	entries, _ := fs.ReadDir(embeddedLocks, "locks")
+	for _, e := range entries {
+		name, ok := strings.CutSuffix(e.Name(), ".txt")
+		if !ok {
+			continue
+		}
+		data, _ := fs.ReadFile(embeddedLocks, "locks/"+e.Name())
+		l, err := parsePipLock(name, string(data))
+		if err != nil {
+			panic(err)
+		}
+		l.Source = "embedded locks/" + e.Name()
+		locks[name] = l
+	}
+	entries, _ = os.ReadDir(userLockDir())
+	for _, e := range entries {
+		name, ok := strings.CutSuffix(e.Name(), ".txt")
+		if !ok {
+			continue
+		}
+		path := filepath.Join(userLockDir(), e.Name())
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		l, err := parsePipLock(name, string(data))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "  [!] ignoring %s: %v\n", path, err)
+			continue
+		}
+		l.Source = path
+		locks[name] = l
+	}
+	return locks
+}
+
+var pinRe = regexp.MustCompile(`^([A-Za-z0-9][A-Za-z0-9._-]*)(\[[^\]]*\])?==([^\s;]+)$`)
+
+// parsePipLock reads a hash-pinned requirements file: one `name==version` per
+// requirement followed by its --hash options, with backslash continuations.
+func parsePipLock(env, text string) (*pipLock, error) {
+	l := &pipLock{Env: env, data: []byte(text)}
+	logical := strings.ReplaceAll(text, "\\\n", " ")
+	for i, line := range strings.Split(logical, "\n") {
+		if c := strings.Index(line, "#"); c >= 0 {
+			line = line[:c]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		m := pinRe.FindStringSubmatch(fields[0])
+		if m == nil {
+			return nil, fmt.Errorf("requirement %d: %q is not pinned with ==", i+1, fields[0])
+		}
+		p := pipPin{Name: m[1], Version: m[3]}
+		for _, f := range fields[1:] {
+			h, ok := strings.CutPrefix(f, "--hash=")
+			if !ok {
+				return nil, fmt.Errorf("%s: unsupported option %q", p.Name, f)
+			}
+			p.Hashes = append(p.Hashes, h)
+		}
+		if len(p.Hashes) == 0 {
+			return nil, fmt.Errorf("%s has no --hash", p.Name)
+		}
+		l.Pins = append(l.Pins, p)
+	}
+	return l, nil
+}
+
+// formatPipLock renders pins in the format parsePipLock reads.
+func formatPipLock(header []string, pins []pipPin) string {
+	var b strings.Builder
+	for _, h := range header {
+		b.WriteString("# " + h + "\n")
+	}
+	for _, p := range pins {
+		b.WriteString(p.Name + "==" + p.Version)
+		for _, h := range p.Hashes {
+			b.WriteString(" \\\n    --hash=" + h)
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+var pipNameSepRe = regexp.MustCompile(`[-_.]+`)
+
+// normalizePipName folds a package name the way the package index does (PEP 503).
+func normalizePipName(name string) string {
+	return strings.ToLower(pipNameSepRe.ReplaceAllString(name, "-"))
+}
+
+func (l *pipLock) pin(name string) (pipPin, bool) {
+	name = normalizePipName(name)
+	for _, p := range l.Pins {
+		if normalizePipName(p.Name) == name {
+			return p, true
+		}
+	}
+	return pipPin{}, false
+}
+
+// step writes the lockfile to dst. The content is part of the step, so editing a
+// lockfile changes the definition hash of the tools using it.
+func (l *pipLock) step(log, dst string) step {
+	return contentStep(log, "pip-lock/"+l.Env, string(l.data), dst)
+}
+
+// pipLockPath is where a lockfile is written for pip to read.
+func pipLockPath(env string) string {
+	return filepath.Join(os.Getenv("HOME"), ".chs-onboard", "pip", env+"-requirements.lock")
+}
+
+// pipLockFor returns the lockfile for a Python tool's interpreter or virtualenv.
+func pipLockFor(env toolID) (*pipLock, bool) {
+	l, ok := pipLocks[pythonEnvFor(env).Name]
+	return l, ok
+}
+
+// pipRequirementName strips version specifiers and extras from a requirement.
+func pipRequirementName(req string) string {
+	name := strings.FieldsFunc(req, func(r rune) bool { return strings.ContainsRune("=<>!~[; ", r) })
+	if len(name) == 0 {
+		return ""
+	}
+	return name[0]
+}
+
+// pipInstallSteps installs pkgs with env's pip. With a lockfile for env, every locked
+// package is installed at its pinned version with hash checking; requirements the
+// lockfile does not cover are installed unpinned with a warning. Without a lockfile
+// pkgs are installed unpinned with opts.
+func pipInstallSteps(log string, env toolID, pkgs []string, opts ...string) []step {
+	e := pythonEnvFor(env)
+	pip := pythonBin(env, "pip")
+	inEnv := func(s step) step {
+		if e.isVenv() {
+			return s.inVenv(e.Name)
+		}
+		return s
+	}
+	l, ok := pipLockFor(env)
+	if !ok {
+		if len(pkgs) == 0 {
+			return nil
+		}
+		args := append(append([]string{"install"}, opts...), pkgs...)
+		return []step{
+			noteStep(log, fmt.Sprintf("no pip lockfile for %s; installing unpinned (chs-onboard lock creates one)", e.Name)),
+			inEnv(execStep(log, pip, args...)),
+		}
+	}
+	dst := pipLockPath(e.Name)
+	steps := []step{
+		l.step(log, dst),
+		inEnv(execStep(log, pip, "install", "--require-hashes", "--no-deps", "-r", dst)),
+	}
+	var unlocked []string
+	for _, pkg := range pkgs {
+		if _, ok := l.pin(pipRequirementName(pkg)); !ok {
+			unlocked = append(unlocked, pkg)
+		}
+	}
+	if len(unlocked) > 0 {
+		steps = append(steps,
+			noteStep(log, fmt.Sprintf("%s not in the %s lockfile; installing unpinned", strings.Join(unlocked, ", "), e.Name)),
+			inEnv(execStep(log, pip, append(append([]string{"install"}, opts...), unlocked...)...)),
+		)
+	}
+	return steps
+}
+
+// pipSourceArgs are extra `pip install` arguments for a local source tree. With a
+// lockfile its dependencies come from the lockfile, so pip must not resolve them.
+func pipSourceArgs(env toolID) []string {
+	if _, ok := pipLockFor(env); ok {
+		return []string{"--no-deps"}
+	}
+	return nil
+}
+
+// pipInstalled lists the non-editable packages installed for pip, keyed by normalized name.
+func pipInstalled(pip string) map[string]pipPin {
+	installed := map[string]pipPin{}
+	if !pathExists(pip) {
+		return installed
+	}
+	var pkgs []struct {
+		Name    string `json:"name"`
+		Version string `json:"version"`
+	}
+	if err := json.Unmarshal([]byte(cmdOutput(pip, "list", "--format=json", "--exclude-editable", "--disable-pip-version-check")), &pkgs); err != nil {
+		return installed
+	}
+	for _, p := range pkgs {
+		installed[normalizePipName(p.Name)] = pipPin{Name: p.Name, Version: p.Version}
+	}
+	return installed
+}
+
+// pipDrift is how an environment differs from its lockfile.
+type pipDrift struct {
+	Missing []string // locked but not installed
+	Changed []string // installed at a different version than locked
+	Extra   []string // installed but not locked
+}
+
+func (d pipDrift) drifted() bool { return len(d.Missing) > 0 || len(d.Changed) > 0 }
+
+// comparePipLock compares installed packages with a lockfile. pip itself is not locked.
+func comparePipLock(l *pipLock, installed map[string]pipPin) pipDrift {
+	var d pipDrift
+	locked := map[string]bool{}
+	for _, p := range l.Pins {
+		key := normalizePipName(p.Name)
+		locked[key] = true
+		got, ok := installed[key]
+		switch {
+		case !ok:
+			d.Missing = append(d.Missing, p.Name+"=="+p.Version)
+		case got.Version != p.Version:
+			d.Changed = append(d.Changed, fmt.Sprintf("%s %s (locked %s)", p.Name, got.Version, p.Version))
+		}
+	}
+	for key, p := range installed {
+		if !locked[key] && key != "pip" {
+			d.Extra = append(d.Extra, p.Name+"=="+p.Version)
+		}
+	}
+	sort.Strings(d.Extra)
+	return d
+}
+
+// pipDriftCheck reports an outdated check when packages in env are installed at
+// versions other than the locked ones. Missing packages are left to each tool's
+// own check, since the tools sharing an environment install at different times.
+func pipDriftCheck(env toolID) (toolCheck, bool) {
+	l, ok := pipLockFor(env)
+	if !ok {
+		return toolCheck{}, false
+	}
+	d := comparePipLock(l, pipInstalled(pythonBin(env, "pip")))
+	if len(d.Changed) == 0 {
+		return toolCheck{}, false
+	}
+	changed := d.Changed
+	if len(changed) > 3 {
+		changed = append(changed[:3:3], fmt.Sprintf("%d more", len(d.Changed)-3))
+	}
+	return outdatedCheck(fmt.Sprintf("%s packages differ from lockfile: %s", pythonEnvFor(env).Name, strings.Join(changed, ", "))), true
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+)
+
+const testLock = `# test lockfile
+requests==2.32.3 \
+    --hash=sha256:70761cfe03c773ceb22aa2f671b4757976145175cdfca038c02654d061d6dcc6
+`
+
+func TestPipLockStepCarriesTheLockfile(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	l, err := parsePipLock("3.13.2", testLock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldLocks := pipLocks
+	pipLocks = map[string]*pipLock{"3.13.2": l}
+	t.Cleanup(func() { pipLocks = oldLocks })
+
+	nAssets := len(assets)
+	steps := pipInstallSteps("test", toolPython313, []string{"requests"})
+	if len(assets) != nAssets {
+		t.Errorf("building steps registered %d assets", len(assets)-nAssets)
+	}
+	if len(steps) != 2 || steps[0].Kind != stepFile {
+		t.Fatalf("steps = %+v, want the lockfile then pip install", steps)
+	}
+
+	// a plan stores the steps as JSON; applying it must write the same lockfile
+	data, err := json.Marshal(steps[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var planned step
+	if err := json.Unmarshal(data, &planned); err != nil {
+		t.Fatal(err)
+	}
+	pipLocks = map[string]*pipLock{}
+	if err := runStep(planned); err != nil {
+		t.Fatalf("runStep: %v", err)
+	}
+	got, err := os.ReadFile(pipLockPath("3.13.2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != testLock {
+		t.Errorf("lockfile written:\n%s\nwant:\n%s", got, testLock)
+	}
+}
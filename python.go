@@ -0,0 +1,343 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// pythonEnv is one pyenv interpreter or virtualenv in the toolchain.
+type pythonEnv struct {
+	Tool toolID `json:"tool"`
+	// Name is the pyenv version name: an interpreter version such as "3.13.2",
+	// or the virtualenv name.
+	Name string `json:"name"`
+	// Base is the interpreter a virtualenv is built on; empty for interpreters.
+	Base string `json:"base,omitempty"`
+	// Packages are pip-installed right after the interpreter or virtualenv is created.
+	Packages []string `json:"packages,omitempty"`
+	// Global is the position in `pyenv global` (1 first); 0 leaves it out.
+	Global int `json:"global,omitempty"`
+}
+
+func (e pythonEnv) isVenv() bool { return e.Base != "" }
+
+// defaultPythonMatrix is the toolchain every laptop gets. Tools refer to entries by
+// tool ID, so bumping a version here updates every pip path derived from it.
+var defaultPythonMatrix = []pythonEnv{
+	{Tool: toolPython313, Name: "3.13.2", Global: 1},
+	{Tool: toolPython396, Name: "3.9.6"},
+	{Tool: toolPyenvVenvNCP, Name: "ncpcli", Base: "3.9.6", Global: 2},
+}
+
+// pythonMatrix is defaultPythonMatrix, or ~/.chs-onboard/python.json when present.
+var pythonMatrix = loadPythonMatrix()
+
+func loadPythonMatrix() []pythonEnv {
+	path := filepath.Join(os.Getenv("HOME"), ".chs-onboard", "python.json")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return defaultPythonMatrix
+	}
+	var m []pythonEnv
+	if err := json.Unmarshal(data, &m); err != nil {
+		fmt.Fprintf(os.Stderr, "  [!] ignoring %s: %v\n", path, err)
+		return defaultPythonMatrix
+	}
+	if err := validatePythonMatrix(m); err != nil {
+		fmt.Fprintf(os.Stderr, "  [!] ignoring %s: %v\n", path, err)
+		return defaultPythonMatrix
+	}
+	return m
+}
+
+// pythonTools are the tools the matrix declares. Every entry must be one of them:
+// an entry for any other tool would get no installer and no steps.
+var pythonTools = []toolID{toolPython313, toolPython396, toolPyenvVenvNCP}
+
+// validatePythonMatrix checks every Python tool is declared once, nothing else is
+// declared and every virtualenv is based on a declared interpreter.
+func validatePythonMatrix(m []pythonEnv) error {
+	byTool := map[toolID]pythonEnv{}
+	versions := map[string]bool{}
+	for _, e := range m {
+		if !hasTool(pythonTools, e.Tool) {
+			return fmt.Errorf("entry %q is for %q, which is not a Python tool (want one of %v)", e.Name, e.Tool, pythonTools)
+		}
+		if e.Name == "" {
+			return fmt.Errorf("entry for %q has no name", e.Tool)
+		}
+		if _, dup := byTool[e.Tool]; dup {
+			return fmt.Errorf("%s declared twice", e.Tool)
+		}
+		byTool[e.Tool] = e
+		if !e.isVenv() {
+			versions[e.Name] = true
+		}
+	}
+	for _, t := range pythonTools {
+		if _, ok := byTool[t]; !ok {
+			return fmt.Errorf("%s not declared", t)
+		}
+	}
+	for _, e := range m {
+		if e.isVenv() && !versions[e.Base] {
+			return fmt.Errorf("virtualenv %s is based on %s, which is not declared", e.Name, e.Base)
+		}
+	}
+	return nil
+}
+
+// pythonEnvFor returns the matrix entry for a Python tool.
+func pythonEnvFor(t toolID) pythonEnv {
+	for _, e := range pythonMatrix {
+		if e.Tool == t {
+			return e
+		}
+	}
+	panic("no python matrix entry for " + string(t))
+}
+
+// pythonBaseTool returns the interpreter tool a virtualenv tool is built on.
+func pythonBaseTool(t toolID) toolID {
+	base := pythonEnvFor(t).Base
+	for _, e := range pythonMatrix {
+		if !e.isVenv() && e.Name == base {
+			return e.Tool
+		}
+	}
+	panic("no python interpreter declared for " + string(t))
+}
+
+func pyenvVersionDir(name string) string {
+	return os.Getenv("HOME") + "/.pyenv/versions/" + name
+}
+
+// pythonBin returns the path of an executable (python, pip, ...) in t's interpreter or virtualenv.
+func pythonBin(t toolID, name string) string {
+	return pyenvVersionDir(pythonEnvFor(t).Name) + "/bin/" + name
+}
+
+// pythonGlobals returns the `pyenv global` versions in order.
+func pythonGlobals() []string {
+	var globals []pythonEnv
+	for _, e := range pythonMatrix {
+		if e.Global > 0 {
+			globals = append(globals, e)
+		}
+	}
+	sort.SliceStable(globals, func(i, j int) bool { return globals[i].Global < globals[j].Global })
+	names := make([]string, 0, len(globals))
+	for _, e := range globals {
+		names = append(names, e.Name)
+	}
+	return names
+}
+
+func pythonToolDef(t toolID) toolDef {
+	return toolDef{
+		check: func() toolCheck { return checkPythonEnv(pythonEnvFor(t)) },
+		steps: func(string) []step { return pythonEnvSteps(pythonEnvFor(t)) },
+	}
+}
+
+func checkPythonEnv(e pythonEnv) toolCheck {
+	if e.isVenv() {
+		return checkPyenvVenv(e)
+	}
+	return checkPythonVersion(e)
+}
+
+func pythonEnvSteps(e pythonEnv) []step {
+	var steps []step
+	if e.isVenv() {
+		steps = pyenvVenvSteps(e)
+	} else {
+		steps = pythonVersionSteps(e.Name)
+	}
+	// pip.conf is written by the phase-3 tools: its index is only reachable on VPN
+	if len(e.Packages) > 0 {
+		steps = append(steps, pipInstallSteps("pyenv", e.Tool, e.Packages)...)
+	}
+	return steps
+}
+
+func checkPythonVersion(e pythonEnv) toolCheck {
+	if pathExists(pyenvVersionDir(e.Name)) {
+		if missing := missingPipPackages(e); len(missing) > 0 {
+			return outdatedCheck(fmt.Sprintf("Python %s missing packages: %s", e.Name, strings.Join(missing, ", ")))
+		}
+		reason := fmt.Sprintf("Python %s present", e.Name)
+		if newer := newestPatch(e.Name, availablePythonVersions()); newer != e.Name {
+			reason += fmt.Sprintf(" (%s available; bump the python matrix to upgrade)", newer)
+		}
+		return installedCheck(reason).withVersion(e.Name)
+	}
+	if older := installedPatches(e.Name); len(older) > 0 {
+		return outdatedCheck(fmt.Sprintf("Python %s installed, %s wanted (patch upgrade)", strings.Join(older, ", "), e.Name))
+	}
+	return missingCheck(fmt.Sprintf("Python %s not installed in pyenv", e.Name))
+}
+
+func pythonVersionSteps(version string) []step {
+	return []step{execStep("pyenv", "pyenv", "install", version).creates(pyenvVersionDir(version))}
+}
+
+func checkPyenvVenv(e pythonEnv) toolCheck {
+	venvDir := pyenvVersionDir(e.Name)
+	if !pathExists(venvDir) {
+		return missingCheck(fmt.Sprintf("virtualenv %s not found", e.Name))
+	}
+	if base := venvBase(e.Name); base != "" && base != e.Base {
+		return outdatedCheck(fmt.Sprintf("virtualenv %s is on Python %s, want %s", e.Name, base, e.Base))
+	}
+	if missing := missingPipPackages(e); len(missing) > 0 {
+		return outdatedCheck(fmt.Sprintf("virtualenv %s missing packages: %s", e.Name, strings.Join(missing, ", ")))
+	}
+	return installedCheck(fmt.Sprintf("virtualenv %s present", e.Name)).withVersion(cmdOutput(venvDir+"/bin/python", "--version"))
+}
+
+// pyenvVenvSteps creates the virtualenv, first migrating it when it exists on a
+// different base interpreter: its packages are frozen, the virtualenv is rebuilt on
+// the new base and the packages are reinstalled.
+func pyenvVenvSteps(e pythonEnv) []step {
+	venvDir := pyenvVersionDir(e.Name)
+	var steps []step
+	if base := venvBase(e.Name); pathExists(venvDir) && base != "" && base != e.Base {
+		freeze := filepath.Join(os.Getenv("HOME"), ".chs-onboard", "venv-"+e.Name+"-requirements.txt")
+		steps = append(steps,
+			noteStep("pyenv_venv", fmt.Sprintf("migrating virtualenv %s from Python %s to %s", e.Name, base, e.Base)),
+			execStep("pyenv_venv", "mkdir", "-p", filepath.Dir(freeze)),
+			execStep("pyenv_venv", "/bin/sh", "-c", shellJoin([]string{venvDir + "/bin/pip", "freeze", "--exclude-editable"})+" > "+shellQuote(freeze)),
+			execStep("pyenv_venv", "pyenv", "virtualenv-delete", "-f", e.Name),
+			execStep("pyenv_venv", "pyenv", "virtualenv", e.Base, e.Name),
+			execStep("pyenv_venv", venvDir+"/bin/pip", "install", "-r", freeze).inVenv(e.Name),
+		)
+		return steps
+	}
+	return append(steps, execStep("pyenv_venv", "pyenv", "virtualenv", e.Base, e.Name).creates(venvDir))
+}
+
+// venvBase returns the interpreter version a pyenv virtualenv was built on, or "" if unknown.
+func venvBase(name string) string {
+	// pyenv-virtualenv links versions/<name> to versions/<base>/envs/<name>
+	if target, err := filepath.EvalSymlinks(pyenvVersionDir(name)); err == nil {
+		if parts := strings.Split(filepath.ToSlash(target), "/"); len(parts) >= 3 && parts[len(parts)-2] == "envs" {
+			return parts[len(parts)-3]
+		}
+	}
+	data, err := os.ReadFile(pyenvVersionDir(name) + "/pyvenv.cfg")
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		k, v, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		switch strings.TrimSpace(k) {
+		case "version":
+			return strings.TrimSpace(v)
+		case "version_info": // virtualenv writes e.g. 3.9.6.final.0
+			if parts := strings.Split(strings.TrimSpace(v), "."); len(parts) >= 3 {
+				return strings.Join(parts[:3], ".")
+			}
+		}
+	}
+	return ""
+}
+
+func missingPipPackages(e pythonEnv) []string {
+	var missing []string
+	pip := pyenvVersionDir(e.Name) + "/bin/pip"
+	for _, pkg := range e.Packages {
+		name := pipRequirementName(pkg)
+		if name == "" {
+			continue
+		}
+		if pipPackageVersion(pip, name) == "" {
+			missing = append(missing, pkg)
+		}
+	}
+	return missing
+}
+
+// installedPatches lists installed interpreters with the same major.minor as version but a different patch.
+func installedPatches(version string) []string {
+	entries, err := os.ReadDir(os.Getenv("HOME") + "/.pyenv/versions")
+	if err != nil {
+		return nil
+	}
+	var out []string
+	for _, e := range entries {
+		if e.Name() != version && sameMinor(e.Name(), version) {
+			out = append(out, e.Name())
+		}
+	}
+	return out
+}
+
+// availablePythonVersions lists CPython versions pyenv can install. It only reads
+// pyenv's local build definitions.
+func availablePythonVersions() []string {
+	var out []string
+	for _, line := range strings.Split(cmdOutput(platform.brewPath("pyenv"), "install", "--list"), "\n") {
+		if v := strings.TrimSpace(line); parseVersion(v) != nil {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// newestPatch returns the highest final release in available with version's major.minor, or version.
+func newestPatch(version string, available []string) string {
+	best := version
+	for _, v := range available {
+		if sameMinor(v, version) && compareVersions(v, best) > 0 {
+			best = v
+		}
+	}
+	return best
+}
+
+// parseVersion parses a final CPython release "X.Y.Z"; pre-releases and other builds return nil.
+func parseVersion(v string) []int {
+	parts := strings.Split(v, ".")
+	if len(parts) != 3 {
+		return nil
+	}
+	nums := make([]int, 3)
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			return nil
+		}
+		nums[i] = n
+	}
+	return nums
+}
+
+func sameMinor(a, b string) bool {
+	pa, pb := parseVersion(a), parseVersion(b)
+	return pa != nil && pb != nil && pa[0] == pb[0] && pa[1] == pb[1]
+}
+
+func compareVersions(a, b string) int {
+	pa, pb := parseVersion(a), parseVersion(b)
+	if pa == nil || pb == nil {
+		return strings.Compare(a, b)
+	}
+	for i := range pa {
+		if pa[i] != pb[i] {
+			if pa[i] < pb[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
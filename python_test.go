@@ -0,0 +1,61 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestValidatePythonMatrix(t *testing.T) {
+	tests := []struct {
+		name    string
+		extra   []pythonEnv
+		mutate  func(m []pythonEnv)
+		wantErr string
+	}{
+		{name: "default"},
+		{name: "extra entry", extra: []pythonEnv{{Tool: "python312", Name: "3.12.8", Global: 3}}, wantErr: "not a Python tool"},
+		{name: "extra entry without tool", extra: []pythonEnv{{Name: "3.12.8"}}, wantErr: "not a Python tool"},
+		{name: "duplicate tool", extra: []pythonEnv{{Tool: toolPython313, Name: "3.13.3"}}, wantErr: "declared twice"},
+		{name: "unknown base", mutate: func(m []pythonEnv) { m[2].Base = "3.8.0" }, wantErr: "not declared"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := append(append([]pythonEnv(nil), defaultPythonMatrix...), tt.extra...)
+			if tt.mutate != nil {
+				tt.mutate(m)
+			}
+			err := validatePythonMatrix(m)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("validatePythonMatrix() = %v, want nil", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Errorf("validatePythonMatrix() = %v, want error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadPythonMatrixRejectsExtraEntry(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	path := filepath.Join(home, ".chs-onboard", "python.json")
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	data := `[
+		{"tool": "python313", "name": "3.13.2", "global": 1},
+		{"tool": "python396", "name": "3.9.6"},
+		{"tool": "pyenv_venv_ncpcli", "name": "ncpcli", "base": "3.9.6", "global": 2},
+		{"tool": "python312", "name": "3.12.8", "global": 3}
+	]`
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	m := loadPythonMatrix()
+	if !reflect.DeepEqual(m, defaultPythonMatrix) {
+		t.Fatalf("loadPythonMatrix() = %+v, want the default matrix", m)
+	}
+}
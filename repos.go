@@ -0,0 +1,555 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// gitRepo is a repository chs-onboard clones and keeps up to date. At most one of
+// Branch, Tag and Commit is set; with none the remote's default branch is followed.
+type gitRepo struct {
+	Name string `json:"name"`
+	// Path locates the repository under the git base; Remote is the URL it resolves
+	// to after overrides and rewrites.
+	Path   string `json:"path,omitempty"`
+	Remote string `json:"remote"`
+	// Dir is the clone location relative to $HOME.
+	Dir    string `json:"dir"`
+	Branch string `json:"branch,omitempty"`
+	Tag    string `json:"tag,omitempty"`
+	Commit string `json:"commit,omitempty"`
+	// Shallow clones fetch only the tip of a branch or tag; commit pins always
+	// fetch full history.
+	Shallow bool `json:"shallow,omitempty"`
+	// LocalChanges is what to do with uncommitted changes in an existing clone:
+	// abort (default), stash or reset. With reset a diverged branch is also reset
+	// to the remote.
+	LocalChanges string `json:"local_changes,omitempty"`
+}
+
+// defaultGitBase is the URL registry paths are relative to.
+const defaultGitBase = "ssh://git@bitbucket.oci.oraclecorp.com:7999/"
+
+// defaultRepos is the repository registry, keyed by name. Entries follow the
+// remote's default branch; state records the branch and commit each sync resolved it to.
+var defaultRepos = map[string]gitRepo{
+	"misc-tools":        {Path: "~rralliso/misc-tools.git", Dir: "misc-tools"},
+	"sparta-pki":        {Path: "secinf/sparta-pki.git", Dir: "sparta-pki", Shallow: true, LocalChanges: "reset"},
+	"gnoc-helper":       {Path: "gnoc/gnoc-helper.git", Dir: "gnoc-helper"},
+	"stencil":           {Path: "nse/stencil.git", Dir: "stencil"},
+	"stencil-temp-gnoc": {Path: "gnoc/stencil-temp-gnoc.git", Dir: "stencil-temp-gnoc"},
+	"silencer":          {Path: "nse/silencer.git", Dir: "silencer"},
+	"gnoc-jit-pass":     {Path: "gnoc/gnoc-jit-pass.git", Dir: "gnoc-jit-pass"},
+}
+
+// reposConfigFile is ~/.chs-onboard/repos.json. Base replaces defaultGitBase, e.g.
+// with an HTTPS endpoint, a mirror or a local directory of bare repositories.
+// Rewrites work like git's url.<replacement>.insteadOf: a remote starting with a
+// key has that prefix replaced by its value, the longest matching key winning.
+type reposConfigFile struct {
+	Base     string                  `json:"base,omitempty"`
+	Rewrites map[string]string       `json:"rewrites,omitempty"`
+	Repos    map[string]repoOverride `json:"repos,omitempty"`
+}
+
+// repoOverride is an entry of repos.json. Remote replaces the URL derived from the
+// base (rewrites still apply). Setting any of branch, tag or commit replaces the
+// registry's ref; other fields left empty keep the default.
+type repoOverride struct {
+	Remote       string `json:"remote,omitempty"`
+	Branch       string `json:"branch,omitempty"`
+	Tag          string `json:"tag,omitempty"`
+	Commit       string `json:"commit,omitempty"`
+	Shallow      *bool  `json:"shallow,omitempty"`
+	LocalChanges string `json:"local_changes,omitempty"`
+}
+
+// repos is defaultRepos with ~/.chs-onboard/repos.json applied.
+var repos = loadRepos()
+
+func loadRepos() map[string]gitRepo {
+	var c reposConfigFile
+	path := filepath.Join(os.Getenv("HOME"), ".chs-onboard", "repos.json")
+	if data, err := os.ReadFile(path); err == nil {
+		if err := json.Unmarshal(data, &c); err != nil {
+			fmt.Fprintf(os.Stderr, "  [!] ignoring %s: %v\n", path, err)
+			c = reposConfigFile{}
+		}
+	}
+	base := defaultGitBase
+	if c.Base != "" {
+		base = c.Base
+	}
+
+	m := map[string]gitRepo{}
+	for name, r := range defaultRepos {
+		r.Name = name
+		r.Remote = rewriteRemote(joinGitBase(base, r.Path), c.Rewrites)
+		m[name] = r
+	}
+	for name, o := range c.Repos {
+		r, ok := m[name]
+		if !ok {
+			fmt.Fprintf(os.Stderr, "  [!] ignoring %s entry %q: no such repository\n", path, name)
+			continue
+		}
+		if o.Remote != "" {
+			r.Remote = rewriteRemote(expandHome(o.Remote), c.Rewrites)
+		}
+		if o.Branch != "" || o.Tag != "" || o.Commit != "" {
+			r.Branch, r.Tag, r.Commit = o.Branch, o.Tag, o.Commit
+		}
+		if o.Shallow != nil {
+			r.Shallow = *o.Shallow
+		}
+		if o.LocalChanges != "" {
+			r.LocalChanges = o.LocalChanges
+		}
+		if err := r.validate(); err != nil {
+			fmt.Fprintf(os.Stderr, "  [!] ignoring %s entry %q: %v\n", path, name, err)
+			continue
+		}
+		m[name] = r
+	}
+	return m
+}
+
+// joinGitBase appends a registry path to base. Bases may be URLs, scp-style
+// addresses (git@host:) or local directories.
+func joinGitBase(base, path string) string {
+	base = expandHome(base)
+	if strings.HasSuffix(base, "/") || strings.HasSuffix(base, ":") {
+		return base + path
+	}
+	return base + "/" + path
+}
+
+// rewriteRemote replaces the longest rewrite prefix remote starts with.
+func rewriteRemote(remote string, rewrites map[string]string) string {
+	best := ""
+	for prefix := range rewrites {
+		if strings.HasPrefix(remote, prefix) && len(prefix) > len(best) {
+			best = prefix
+		}
+	}
+	if best == "" {
+		return remote
+	}
+	return expandHome(rewrites[best]) + strings.TrimPrefix(remote, best)
+}
+
+// expandHome expands a leading ~/ in a local path.
+func expandHome(p string) string {
+	if rest, ok := strings.CutPrefix(p, "~/"); ok {
+		return filepath.Join(os.Getenv("HOME"), rest)
+	}
+	return p
+}
+
+// gitRemoteHosts returns the host:port of every network remote in the registry,
+// for the VPN check. Local remotes need no network.
+func gitRemoteHosts() []string {
+	seen := map[string]bool{}
+	var hosts []string
+	for _, r := range repos {
+		h := remoteHostPort(r.Remote)
+		if h != "" && !seen[h] {
+			seen[h] = true
+			hosts = append(hosts, h)
+		}
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+// remoteHostPort returns the host:port a git remote connects to, or "" for local paths.
+func remoteHostPort(remote string) string {
+	if u, err := url.Parse(remote); err == nil && u.Host != "" {
+		switch {
+		case u.Port() != "":
+			return u.Host
+		case u.Scheme == "ssh":
+			return u.Hostname() + ":22"
+		case u.Scheme == "https":
+			return u.Hostname() + ":443"
+		case u.Scheme == "http":
+			return u.Hostname() + ":80"
+		}
+		return ""
+	}
+	// scp-style user@host:path
+	if at, colon := strings.Index(remote, "@"), strings.Index(remote, ":"); at > 0 && colon > at && !strings.Contains(remote[:colon], "/") {
+		return remote[at+1:colon] + ":22"
+	}
+	return ""
+}
+
+func (r gitRepo) validate() error {
+	refs := 0
+	for _, ref := range []string{r.Branch, r.Tag, r.Commit} {
+		if ref != "" {
+			refs++
+		}
+	}
+	if refs > 1 {
+		return fmt.Errorf("set only one of branch, tag and commit")
+	}
+	switch r.LocalChanges {
+	case "", "abort", "stash", "reset":
+	default:
+		return fmt.Errorf("local_changes must be abort, stash or reset, not %q", r.LocalChanges)
+	}
+	return nil
+}
+
+// repoDir is the clone location of a registry repository.
+func repoDir(name string) string {
+	r, ok := repos[name]
+	if !ok {
+		panic("no repository registry entry for " + name)
+	}
+	return filepath.Join(os.Getenv("HOME"), r.Dir)
+}
+
+// ref describes what the repository is pinned to.
+func (r gitRepo) ref() string {
+	switch {
+	case r.Commit != "":
+		return "commit " + r.Commit
+	case r.Tag != "":
+		return "tag " + r.Tag
+	case r.Branch != "":
+		return "branch " + r.Branch
+	}
+	return "default branch"
+}
+
+func (r gitRepo) localChanges() string {
+	if r.LocalChanges == "" {
+		return "abort"
+	}
+	return r.LocalChanges
+}
+
+// repo returns a git step's repository; plans written before repositories were
+// pinned carry only the remote, which follows the default branch.
+func (s step) repo() gitRepo {
+	if s.Repo != nil {
+		return *s.Repo
+	}
+	return gitRepo{Name: filepath.Base(s.Dst), Remote: s.Remote, Dir: s.Dst}
+}
+
+// repoState is the commit a repository was last synced to.
+type repoState struct {
+	Dir      string `json:"dir"`
+	Ref      string `json:"ref"`
+	Commit   string `json:"commit"`
+	SyncedAt string `json:"synced_at"`
+}
+
+func recordRepoCommit(name, dir, ref, commit string) error {
+	if stateData == nil {
+		stateData = newRunState()
+	}
+	if stateData.Repos == nil {
+		stateData.Repos = map[string]*repoState{}
+	}
+	stateData.Repos[name] = &repoState{Dir: dir, Ref: ref, Commit: commit, SyncedAt: time.Now().UTC().Format(time.RFC3339)}
+	return saveRunState()
+}
+
+// syncRepo clones r into dir, or brings an existing clone to r's ref, and records
+// the commit it ends up at. source is where to fetch from: r.Remote, or a git
+// bundle holding it; origin always points at r.Remote.
+func syncRepo(log string, r gitRepo, dir, source string) error {
+	if dryRun {
+		logInfo(log, fmt.Sprintf("DRY-RUN: would sync %s (%s) → %s", r.Name, r.ref(), dir), nil)
+		return nil
+	}
+	var err error
+	if pathExists(dir + "/.git") {
+		err = updateRepo(log, r, dir, source)
+	} else {
+		err = cloneRepo(log, r, dir, source)
+	}
+	if err != nil {
+		return err
+	}
+	commit := cmdOutput("git", "-C", dir, "rev-parse", "HEAD")
+	if commit == "" {
+		return fmt.Errorf("%s: no commit checked out", dir)
+	}
+	ref := r.ref()
+	if r.Branch == "" && r.Tag == "" && r.Commit == "" {
+		// record which branch the remote's default resolved to
+		if branch := cmdOutput("git", "-C", dir, "symbolic-ref", "--quiet", "--short", "HEAD"); branch != "" {
+			ref += " " + branch
+		}
+	}
+	logInfo(log, fmt.Sprintf("%s at %s (%s)", r.Name, shortCommit(commit), ref), nil)
+	if err := recordRepoCommit(r.Name, dir, ref, commit); err != nil {
+		logWarn(log, "could not record commit in state", map[string]string{"error": err.Error()})
+	}
+	return nil
+}
+
+func cloneRepo(log string, r gitRepo, dir, source string) error {
+	logInfo(log, fmt.Sprintf("cloning %s (%s) → %s", r.Remote, r.ref(), dir), nil)
+	args := []string{"clone"}
+	if r.Shallow && r.Commit == "" {
+		args = append(args, "--depth", "1")
+	}
+	if ref := r.Branch + r.Tag; ref != "" {
+		args = append(args, "--branch", ref)
+	}
+	if _, err := runCmd(log, nil, "git", append(args, source, dir)...); err != nil {
+		return err
+	}
+	if source != r.Remote {
+		if _, err := runCmd(log, nil, "git", "-C", dir, "remote", "set-url", "origin", r.Remote); err != nil {
+			return err
+		}
+	}
+	if r.Commit != "" {
+		_, err := runCmd(log, nil, "git", "-C", dir, "checkout", "--quiet", "--detach", r.Commit)
+		return err
+	}
+	return nil
+}
+
+func updateRepo(log string, r gitRepo, dir, source string) error {
+	git := func(args ...string) error {
+		_, err := runCmd(log, nil, "git", append([]string{"-C", dir}, args...)...)
+		return err
+	}
+	if err := handleLocalChanges(log, r, dir); err != nil {
+		return err
+	}
+	depth := []string{}
+	if r.Shallow {
+		depth = []string{"--depth", "1"}
+	}
+
+	switch {
+	case r.Commit != "":
+		if !gitHasCommit(dir, r.Commit) {
+			args := []string{"fetch", "--tags", source, "+refs/heads/*:refs/remotes/origin/*"}
+			if cmdOutput("git", "-C", dir, "rev-parse", "--is-shallow-repository") == "true" {
+				args = append(args, "--unshallow")
+			}
+			if err := git(args...); err != nil {
+				return err
+			}
+		}
+		if !gitHasCommit(dir, r.Commit) {
+			// Servers that allow it can fetch a commit no branch points at.
+			_ = git("fetch", source, r.Commit)
+		}
+		if !gitHasCommit(dir, r.Commit) {
+			return fmt.Errorf("commit %s not found in %s", r.Commit, r.Remote)
+		}
+		logInfo(log, "checking out commit "+r.Commit+" in "+dir, nil)
+		return git("checkout", "--quiet", "--detach", r.Commit)
+
+	case r.Tag != "":
+		tag := "refs/tags/" + r.Tag
+		if err := git(append(append([]string{"fetch"}, depth...), source, "+"+tag+":"+tag)...); err != nil {
+			return err
+		}
+		logInfo(log, "checking out tag "+r.Tag+" in "+dir, nil)
+		return git("checkout", "--quiet", "--detach", tag)
+	}
+
+	branch := r.Branch
+	if branch == "" {
+		branch = gitDefaultBranch(log, dir)
+		if branch == "" {
+			return fmt.Errorf("%s: cannot tell the default branch of origin; pin a branch in ~/.chs-onboard/repos.json", dir)
+		}
+	}
+	upstream := "origin/" + branch
+	if err := git(append(append([]string{"fetch"}, depth...), source, "+refs/heads/"+branch+":refs/remotes/"+upstream)...); err != nil {
+		return err
+	}
+	if cmdOutput("git", "-C", dir, "symbolic-ref", "--quiet", "--short", "HEAD") != branch {
+		if gitHasCommit(dir, "refs/heads/"+branch) {
+			if err := git("checkout", "--quiet", branch); err != nil {
+				return err
+			}
+		} else if err := git("checkout", "--quiet", "-b", branch, upstream); err != nil {
+			return err
+		}
+	}
+	if r.Shallow {
+		// Shallow clones are kept at the remote tip, not worked in.
+		return git("reset", "--quiet", "--hard", upstream)
+	}
+
+	ahead, behind := gitAheadBehind(dir, "HEAD", upstream)
+	switch {
+	case behind == 0:
+		if ahead > 0 {
+			logWarn(log, fmt.Sprintf("%s has %d local commit(s) not on %s", dir, ahead, upstream), nil)
+		}
+		return nil
+	case ahead == 0:
+		logInfo(log, fmt.Sprintf("fast-forwarding %s to %s (%d new commit(s))", dir, upstream, behind), nil)
+		return git("merge", "--quiet", "--ff-only", upstream)
+	case r.localChanges() == "reset":
+		logWarn(log, fmt.Sprintf("%s has diverged from %s; discarding %d local commit(s)", dir, upstream, ahead), nil)
+		return git("reset", "--quiet", "--hard", upstream)
+	}
+	return fmt.Errorf("%s has diverged from %s (%d local, %d remote commits); rebase or reset it, or set local_changes to reset for %s in ~/.chs-onboard/repos.json",
+		dir, upstream, ahead, behind, r.Name)
+}
+
+// handleLocalChanges applies r's local-change policy when dir has uncommitted changes.
+func handleLocalChanges(log string, r gitRepo, dir string) error {
+	dirty := gitDirtyCount(dir)
+	if dirty == 0 {
+		return nil
+	}
+	fields := map[string]string{"dir": dir, "changes": strconv.Itoa(dirty)}
+	switch r.localChanges() {
+	case "stash":
+		logWarn(log, "stashing local changes (see git stash list)", fields)
+		_, err := runCmd(log, nil, "git", "-C", dir, "stash", "push", "--include-untracked", "-m", "chs-onboard "+time.Now().Format("2006-01-02 15:04"))
+		return err
+	case "reset":
+		logWarn(log, "discarding local changes", fields)
+		if _, err := runCmd(log, nil, "git", "-C", dir, "reset", "--quiet", "--hard"); err != nil {
+			return err
+		}
+		_, err := runCmd(log, nil, "git", "-C", dir, "clean", "-fdq")
+		return err
+	}
+	return fmt.Errorf("%s has %d uncommitted change(s); commit or stash them, or set local_changes to stash or reset for %s in ~/.chs-onboard/repos.json",
+		dir, dirty, r.Name)
+}
+
+func gitHasCommit(dir, rev string) bool {
+	return cmdOutput("git", "-C", dir, "rev-parse", "--quiet", "--verify", rev+"^{commit}") != ""
+}
+
+func gitDirtyCount(dir string) int {
+	out := cmdOutput("git", "-C", dir, "status", "--porcelain")
+	if out == "" {
+		return 0
+	}
+	return len(strings.Split(out, "\n"))
+}
+
+// gitAheadBehind counts the commits on a but not b, and on b but not a.
+func gitAheadBehind(dir, a, b string) (int, int) {
+	fields := strings.Fields(cmdOutput("git", "-C", dir, "rev-list", "--left-right", "--count", a+"..."+b))
+	if len(fields) != 2 {
+		return 0, 0
+	}
+	ahead, _ := strconv.Atoi(fields[0])
+	behind, _ := strconv.Atoi(fields[1])
+	return ahead, behind
+}
+
+// gitDefaultBranch returns origin's default branch, asking the remote when the
+// clone does not know it.
+func gitDefaultBranch(log, dir string) string {
+	head := func() string {
+		return strings.TrimPrefix(cmdOutput("git", "-C", dir, "symbolic-ref", "--quiet", "--short", "refs/remotes/origin/HEAD"), "origin/")
+	}
+	if b := head(); b != "" {
+		return b
+	}
+	if activeBundle == nil {
+		_, _ = runCmd(log, nil, "git", "-C", dir, "remote", "set-head", "origin", "--auto")
+		if b := head(); b != "" {
+			return b
+		}
+	}
+	upstream := cmdOutput("git", "-C", dir, "rev-parse", "--abbrev-ref", "@{upstream}")
+	return strings.TrimPrefix(upstream, "origin/")
+}
+
+// runReposCommand implements `chs-onboard repos status`.
+func runReposCommand(args []string) {
+	if len(args) == 0 || args[0] != "status" {
+		fmt.Fprintln(os.Stderr, "usage: chs-onboard repos status [--fetch]")
+		os.Exit(2)
+	}
+	fs := flag.NewFlagSet("repos status", flag.ExitOnError)
+	fetchFlag := fs.Bool("fetch", false, "fetch each repository's ref before comparing")
+	_ = fs.Parse(args[1:])
+	if err := loadRunState(); err != nil {
+		fmt.Fprintf(os.Stderr, "could not load saved state: %v\n", err)
+		os.Exit(1)
+	}
+
+	names := make([]string, 0, len(repos))
+	for name := range repos {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Printf("  %-18s %-20s %-14s %-12s %-12s %8s %8s %6s\n", "REPO", "PINNED", "CHECKED OUT", "HEAD", "RECORDED", "AHEAD", "BEHIND", "DIRTY")
+	for _, name := range names {
+		r := repos[name]
+		dir := repoDir(name)
+		pinned := truncate(strings.TrimPrefix(r.ref(), "branch "), 20)
+		if !pathExists(dir + "/.git") {
+			fmt.Printf("  %-18s %-20s %s\n", name, pinned, "not cloned ("+dir+")")
+			continue
+		}
+		target := repoTarget(r, dir)
+		if *fetchFlag {
+			if _, err := runCmd("repos", nil, "git", "-C", dir, "fetch", "--quiet", "--tags", "origin"); err != nil {
+				fmt.Printf("  [!] %s: fetch failed: %v\n", name, err)
+			}
+		}
+		checkedOut := cmdOutput("git", "-C", dir, "symbolic-ref", "--quiet", "--short", "HEAD")
+		if checkedOut == "" {
+			checkedOut = "(detached)"
+		}
+		head := shortCommit(cmdOutput("git", "-C", dir, "rev-parse", "HEAD"))
+		recorded := "-"
+		if rs, ok := stateData.Repos[name]; ok {
+			recorded = shortCommit(rs.Commit)
+			if recorded != head {
+				recorded += "*"
+			}
+		}
+		ahead, behind := "-", "-"
+		if target != "" && gitHasCommit(dir, target) {
+			a, b := gitAheadBehind(dir, "HEAD", target)
+			ahead, behind = strconv.Itoa(a), strconv.Itoa(b)
+		}
+		fmt.Printf("  %-18s %-20s %-14s %-12s %-12s %8s %8s %6d\n", name, pinned, truncate(checkedOut, 14), head, recorded, ahead, behind, gitDirtyCount(dir))
+	}
+	fmt.Println("\n  AHEAD/BEHIND compare HEAD with the pinned ref as last fetched; RECORDED* differs from HEAD.")
+}
+
+// repoTarget is the revision a clone of r should be at.
+func repoTarget(r gitRepo, dir string) string {
+	switch {
+	case r.Commit != "":
+		return r.Commit
+	case r.Tag != "":
+		return "refs/tags/" + r.Tag
+	case r.Branch != "":
+		return "refs/remotes/origin/" + r.Branch
+	}
+	if b := strings.TrimPrefix(cmdOutput("git", "-C", dir, "symbolic-ref", "--quiet", "--short", "refs/remotes/origin/HEAD"), "origin/"); b != "" {
+		return "refs/remotes/origin/" + b
+	}
+	return "@{upstream}"
+}
+
+func shortCommit(c string) string {
+	return c[:min(12, len(c))]
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// gitTestEnv points HOME, git's identity and the command environment at a
+// temporary directory, so nothing reads or writes the real ~/.gitconfig or state.
+func gitTestEnv(t *testing.T) string {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	home := t.TempDir()
+	env := map[string]string{
+		"HOME":                home,
+		"GIT_CONFIG_NOSYSTEM": "1",
+		"GIT_AUTHOR_NAME":     "chs test",
+		"GIT_AUTHOR_EMAIL":    "chs@example.com",
+		"GIT_COMMITTER_NAME":  "chs test",
+		"GIT_COMMITTER_EMAIL": "chs@example.com",
+	}
+	oldEnv, oldState := baseEnv, stateData
+	baseEnv = append([]string(nil), baseEnv...)
+	for k, v := range env {
+		t.Setenv(k, v)
+		baseEnv = append(baseEnv, k+"="+v)
+	}
+	stateData = newRunState()
+	t.Cleanup(func() { baseEnv, stateData = oldEnv, oldState })
+	return home
+}
+
+func gitT(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+	out, err := exec.Command("git", append([]string{"-C", dir}, args...)...).CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s: %v\n%s", strings.Join(args, " "), err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// testRemote is a bare repository served over file:// and a work tree pushing to it.
+type testRemote struct {
+	URL    string
+	work   string
+	branch string
+}
+
+func newTestRemote(t *testing.T) *testRemote {
+	t.Helper()
+	return newTestRemoteOn(t, "master")
+}
+
+// newTestRemoteOn creates a test remote whose default branch is branch.
+func newTestRemoteOn(t *testing.T, branch string) *testRemote {
+	t.Helper()
+	root := t.TempDir()
+	bare := filepath.Join(root, "origin.git")
+	work := filepath.Join(root, "work")
+	gitT(t, root, "init", "--quiet", "--bare", "-b", branch, bare)
+	gitT(t, root, "init", "--quiet", "-b", branch, work)
+	gitT(t, work, "remote", "add", "origin", bare)
+	return &testRemote{URL: "file://" + bare, work: work, branch: branch}
+}
+
+// commit adds a commit writing body to name, pushes it and returns its hash.
+func (r *testRemote) commit(t *testing.T, name, body string) string {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(r.work, name), []byte(body), 0644); err != nil {
+		t.Fatal(err)
+	}
+	gitT(t, r.work, "add", name)
+	gitT(t, r.work, "commit", "--quiet", "-m", "update "+name)
+	gitT(t, r.work, "push", "--quiet", "origin", r.branch)
+	return gitT(t, r.work, "rev-parse", "HEAD")
+}
+
+func (r *testRemote) tag(t *testing.T, name string) {
+	t.Helper()
+	gitT(t, r.work, "tag", name)
+	gitT(t, r.work, "push", "--quiet", "origin", name)
+}
+
+func (r *testRemote) repo(base gitRepo) gitRepo {
+	base.Name, base.Remote = "test", r.URL
+	return base
+}
+
+func TestSyncRepoClonesAtTag(t *testing.T) {
+	home := gitTestEnv(t)
+	remote := newTestRemote(t)
+	tagged := remote.commit(t, "a.txt", "one")
+	remote.tag(t, "v1")
+	remote.commit(t, "a.txt", "two")
+
+	dir := filepath.Join(home, "clone")
+	r := remote.repo(gitRepo{Tag: "v1"})
+	if err := syncRepo("test", r, dir, r.Remote); err != nil {
+		t.Fatalf("syncRepo: %v", err)
+	}
+	if head := gitT(t, dir, "rev-parse", "HEAD"); head != tagged {
+		t.Errorf("HEAD = %s, want tag v1 at %s", head, tagged)
+	}
+	if rs := stateData.Repos["test"]; rs == nil || rs.Commit != tagged || rs.Ref != "tag v1" {
+		t.Errorf("recorded state = %+v", rs)
+	}
+}
+
+func TestSyncRepoClonesAndMovesAtCommit(t *testing.T) {
+	home := gitTestEnv(t)
+	remote := newTestRemote(t)
+	first := remote.commit(t, "a.txt", "one")
+	second := remote.commit(t, "a.txt", "two")
+
+	dir := filepath.Join(home, "clone")
+	r := remote.repo(gitRepo{Commit: first})
+	if err := syncRepo("test", r, dir, r.Remote); err != nil {
+		t.Fatalf("clone at commit: %v", err)
+	}
+	if head := gitT(t, dir, "rev-parse", "HEAD"); head != first {
+		t.Fatalf("HEAD = %s, want %s", head, first)
+	}
+
+	r.Commit = second
+	if err := syncRepo("test", r, dir, r.Remote); err != nil {
+		t.Fatalf("update to commit: %v", err)
+	}
+	if head := gitT(t, dir, "rev-parse", "HEAD"); head != second {
+		t.Errorf("HEAD = %s, want %s", head, second)
+	}
+
+	r.Commit = strings.Repeat("0", 40)
+	if err := syncRepo("test", r, dir, r.Remote); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("sync to a missing commit: %v, want not found", err)
+	}
+}
+
+func TestSyncRepoLocalChanges(t *testing.T) {
+	tests := []struct {
+		policy  string
+		wantErr string
+		check   func(t *testing.T, dir string)
+	}{
+		{policy: "", wantErr: "uncommitted change"},
+		{policy: "abort", wantErr: "uncommitted change"},
+		{policy: "stash", check: func(t *testing.T, dir string) {
+			if gitT(t, dir, "stash", "list") == "" {
+				t.Error("local change was not stashed")
+			}
+		}},
+		{policy: "reset", check: func(t *testing.T, dir string) {
+			if pathExists(filepath.Join(dir, "untracked.txt")) {
+				t.Error("untracked file survived reset")
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run("policy="+tt.policy, func(t *testing.T) {
+			home := gitTestEnv(t)
+			remote := newTestRemote(t)
+			remote.commit(t, "a.txt", "one")
+
+			dir := filepath.Join(home, "clone")
+			r := remote.repo(gitRepo{Branch: "master", LocalChanges: tt.policy})
+			if err := syncRepo("test", r, dir, r.Remote); err != nil {
+				t.Fatalf("clone: %v", err)
+			}
+			if err := os.WriteFile(filepath.Join(dir, "a.txt"), []byte("local edit"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(dir, "untracked.txt"), []byte("x"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			latest := remote.commit(t, "b.txt", "two")
+
+			err := syncRepo("test", r, dir, r.Remote)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("syncRepo = %v, want error containing %q", err, tt.wantErr)
+				}
+				if data, _ := os.ReadFile(filepath.Join(dir, "a.txt")); string(data) != "local edit" {
+					t.Error("aborted sync touched the local change")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("syncRepo: %v", err)
+			}
+			if head := gitT(t, dir, "rev-parse", "HEAD"); head != latest {
+				t.Errorf("HEAD = %s, want %s", head, latest)
+			}
+			if data, _ := os.ReadFile(filepath.Join(dir, "a.txt")); string(data) != "one" {
+				t.Errorf("a.txt = %q, want the committed content", data)
+			}
+			tt.check(t, dir)
+		})
+	}
+}
+
+func TestSyncRepoDiverged(t *testing.T) {
+	for _, policy := range []string{"abort", "reset"} {
+		t.Run("policy="+policy, func(t *testing.T) {
+			home := gitTestEnv(t)
+			remote := newTestRemote(t)
+			remote.commit(t, "a.txt", "one")
+
+			dir := filepath.Join(home, "clone")
+			r := remote.repo(gitRepo{Branch: "master", LocalChanges: policy})
+			if err := syncRepo("test", r, dir, r.Remote); err != nil {
+				t.Fatalf("clone: %v", err)
+			}
+			if err := os.WriteFile(filepath.Join(dir, "local.txt"), []byte("mine"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			gitT(t, dir, "add", "local.txt")
+			gitT(t, dir, "commit", "--quiet", "-m", "local work")
+			local := gitT(t, dir, "rev-parse", "HEAD")
+			upstream := remote.commit(t, "b.txt", "theirs")
+
+			err := syncRepo("test", r, dir, r.Remote)
+			if policy == "abort" {
+				if err == nil || !strings.Contains(err.Error(), "diverged") {
+					t.Fatalf("syncRepo = %v, want diverged error", err)
+				}
+				if head := gitT(t, dir, "rev-parse", "HEAD"); head != local {
+					t.Error("aborted sync moved HEAD")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("syncRepo: %v", err)
+			}
+			if head := gitT(t, dir, "rev-parse", "HEAD"); head != upstream {
+				t.Errorf("HEAD = %s, want the remote's %s", head, upstream)
+			}
+		})
+	}
+}
+
+func TestSyncRepoFastForwards(t *testing.T) {
+	home := gitTestEnv(t)
+	remote := newTestRemote(t)
+	remote.commit(t, "a.txt", "one")
+
+	dir := filepath.Join(home, "clone")
+	r := remote.repo(gitRepo{Branch: "master"})
+	if err := syncRepo("test", r, dir, r.Remote); err != nil {
+		t.Fatalf("clone: %v", err)
+	}
+	latest := remote.commit(t, "a.txt", "two")
+	if err := syncRepo("test", r, dir, r.Remote); err != nil {
+		t.Fatalf("syncRepo: %v", err)
+	}
+	if head := gitT(t, dir, "rev-parse", "HEAD"); head != latest {
+		t.Errorf("HEAD = %s, want %s", head, latest)
+	}
+}
+
+func TestSyncRepoShallowUpdate(t *testing.T) {
+	home := gitTestEnv(t)
+	remote := newTestRemote(t)
+	remote.commit(t, "a.txt", "one")
+	remote.commit(t, "a.txt", "two")
+
+	dir := filepath.Join(home, "clone")
+	r := remote.repo(gitRepo{Branch: "master", Shallow: true, LocalChanges: "reset"})
+	if err := syncRepo("test", r, dir, r.Remote); err != nil {
+		t.Fatalf("clone: %v", err)
+	}
+	if gitT(t, dir, "rev-parse", "--is-shallow-repository") != "true" {
+		t.Fatal("clone is not shallow")
+	}
+	if n := gitT(t, dir, "rev-list", "--count", "HEAD"); n != "1" {
+		t.Errorf("shallow clone has %s commits, want 1", n)
+	}
+
+	latest := remote.commit(t, "a.txt", "three")
+	if err := syncRepo("test", r, dir, r.Remote); err != nil {
+		t.Fatalf("syncRepo: %v", err)
+	}
+	if head := gitT(t, dir, "rev-parse", "HEAD"); head != latest {
+		t.Errorf("HEAD = %s, want %s", head, latest)
+	}
+	if gitT(t, dir, "rev-parse", "--is-shallow-repository") != "true" {
+		t.Error("update unshallowed the clone")
+	}
+}
+
+func TestSyncRepoFollowsDefaultBranch(t *testing.T) {
+	home := gitTestEnv(t)
+	remote := newTestRemoteOn(t, "main")
+	first := remote.commit(t, "a.txt", "one")
+
+	dir := filepath.Join(home, "clone")
+	r := remote.repo(gitRepo{})
+	if err := syncRepo("test", r, dir, r.Remote); err != nil {
+		t.Fatalf("clone: %v", err)
+	}
+	if head := gitT(t, dir, "rev-parse", "HEAD"); head != first {
+		t.Errorf("HEAD = %s, want %s", head, first)
+	}
+	if rs := stateData.Repos["test"]; rs == nil || rs.Commit != first || rs.Ref != "default branch main" {
+		t.Errorf("recorded state = %+v", rs)
+	}
+
+	latest := remote.commit(t, "a.txt", "two")
+	if err := syncRepo("test", r, dir, r.Remote); err != nil {
+		t.Fatalf("syncRepo: %v", err)
+	}
+	if head := gitT(t, dir, "rev-parse", "HEAD"); head != latest {
+		t.Errorf("HEAD = %s, want %s", head, latest)
+	}
+	if rs := stateData.Repos["test"]; rs == nil || rs.Commit != latest {
+		t.Errorf("recorded state = %+v, want commit %s", rs, latest)
+	}
+}
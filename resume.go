@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Milestones recorded in runProgress.Completed, in the order a run reaches them.
+const (
+	milestonePhase1 = "phase1"
+	milestoneVPN    = "vpn_handover"
+	milestonePhase3 = "phase3"
+	milestoneOCNA   = "ocna_handover"
+	milestonePhase4 = "phase4"
+)
+
+const resumeAgentLabel = "com.oracle.chs-onboard.resume"
+
+// runProgress is how far an interrupted install got, so --resume can continue
+// without asking for the GUID, tool selection or finished handovers again.
+type runProgress struct {
+	GUID  string   `json:"guid"`
+	Tools []string `json:"tools,omitempty"`
+	// BastionSelected was written before bastion became a tool; resuming such a run
+	// adds the bastion tool.
+	BastionSelected bool     `json:"bastion_selected,omitempty"`
+	Phase           string   `json:"phase"`
+	Completed       []string `json:"completed,omitempty"`
+	Updated         string   `json:"updated"`
+}
+
+// resumeRun is set by --resume; the saved progress is then continued instead of replaced.
+var resumeRun bool
+
+// beginProgress starts tracking a run, or picks up the saved progress when resuming.
+// A nil tools list (before tool selection) keeps any tools already recorded.
+func beginProgress(tools []toolID, guid string) {
+	if dryRun {
+		return
+	}
+	p := stateData.Progress
+	if !resumeRun || p == nil || !strings.EqualFold(p.GUID, guid) {
+		p = &runProgress{GUID: guid}
+		stateData.Progress = p
+	}
+	if tools != nil {
+		p.Tools = toolIDsToNames(tools)
+		p.BastionSelected = false
+	}
+	saveProgress("preflight")
+}
+
+// saveProgress records the phase the run is in.
+func saveProgress(phase string) {
+	p := stateData.Progress
+	if dryRun || p == nil {
+		return
+	}
+	p.Phase = phase
+	p.Updated = time.Now().UTC().Format(time.RFC3339)
+	if err := saveRunState(); err != nil {
+		logWarn("resume", fmt.Sprintf("failed to persist run progress: %v", err), nil)
+	}
+}
+
+// progressDone reports whether a previous attempt of this run already got past milestone m.
+func progressDone(m string) bool {
+	p := stateData.Progress
+	if p == nil {
+		return false
+	}
+	for _, c := range p.Completed {
+		if c == m {
+			return true
+		}
+	}
+	return false
+}
+
+func markProgress(m string) {
+	p := stateData.Progress
+	if dryRun || p == nil || progressDone(m) {
+		return
+	}
+	p.Completed = append(p.Completed, m)
+	saveProgress(p.Phase)
+}
+
+// clearProgress forgets the run progress once onboarding has finished.
+func clearProgress() {
+	if dryRun || stateData.Progress == nil {
+		return
+	}
+	stateData.Progress = nil
+	if err := saveRunState(); err != nil {
+		logWarn("resume", fmt.Sprintf("failed to clear run progress: %v", err), nil)
+	}
+}
+
+// resumeHint tells the user how to continue after a fatal error, if there is anything to resume.
+func resumeHint() string {
+	p := stateData.Progress
+	if dryRun || p == nil {
+		return ""
+	}
+	return fmt.Sprintf("Fix the problem above, then run `chs-onboard --resume` to continue from %s.", p.Phase)
+}
+
+// runResume continues the install recorded in state.json from its last incomplete phase.
+func runResume(statusAddr, only string, gnoc bool) {
+	resumeRun = true
+	finish := startRun(statusAddr)
+	defer finish()
+	removeResumeAgent()
+
+	p := stateData.Progress
+	if p == nil {
+		logFatal("resume", "no interrupted run to resume; run chs-onboard without --resume", nil)
+	}
+	logInfo("resume", fmt.Sprintf("resuming run for GUID %s from %s", p.GUID, p.Phase), nil)
+
+	logSetPhase("preflight")
+	fmt.Println("\n── Preflight (resume) ────────────────────────────────────────")
+	if !progressDone(milestonePhase1) {
+		if err := preflightNetCheck(); err != nil {
+			logFatal("preflight", err.Error(), nil)
+		}
+	}
+	if err := preflightSSHKeyEnsure(); err != nil {
+		logFatal("preflight", err.Error(), nil)
+	}
+	if err := ensureIdentity(p.GUID); err != nil {
+		logFatal("preflight", err.Error(), nil)
+	}
+
+	var tools []toolID
+	for _, name := range p.Tools {
+		t, ok := validToolIDs[name]
+		if !ok {
+			logFatal("resume", fmt.Sprintf("saved run includes unknown tool %q; start a new run instead", name), nil)
+		}
+		tools = append(tools, t)
+	}
+	if len(tools) == 0 {
+		// stopped before tool selection, e.g. for the account rename
+		tools = selectTools(only, gnoc)
+	} else if p.BastionSelected && !hasTool(tools, toolBastion) {
+		tools = append(tools, toolBastion)
+	}
+	runOnboarding("resume", tools, buildRunHooks(tools), p.GUID)
+}
+
+func resumeAgentPath(home string) string {
+	return filepath.Join(home, "Library", "LaunchAgents", resumeAgentLabel+".plist")
+}
+
+func resumeScriptPath(home string) string {
+	return filepath.Join(home, ".chs-onboard", "resume.command")
+}
+
+// installResumeAgent installs a one-shot LaunchAgent that opens Terminal with
+// `chs-onboard --resume` at the next login. Paths under oldHome are rewritten to
+// newHome because the agent runs after the account rename.
+func installResumeAgent(oldHome, newHome string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if rel, err := filepath.Rel(oldHome, exe); err == nil && !strings.HasPrefix(rel, "..") {
+		exe = filepath.Join(newHome, rel)
+	}
+	script := resumeScriptPath(newHome)
+	agent := resumeAgentPath(newHome)
+	if dryRun {
+		logInfo("resume", "dry-run mode: would install resume LaunchAgent", map[string]string{"path": agent})
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(script), 0750); err != nil {
+		return err
+	}
+	body := "#!/bin/zsh\nexec " + shellQuote(exe) + " --resume\n"
+	if err := os.WriteFile(script, []byte(body), 0755); err != nil {
+		return err
+	}
+
+	var args bytes.Buffer
+	for _, a := range []string{"/usr/bin/open", "-a", "Terminal", script} {
+		args.WriteString("\t\t<string>")
+		_ = xml.EscapeText(&args, []byte(a))
+		args.WriteString("</string>\n")
+	}
+	plist := fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>Label</key>
+	<string>%s</string>
+	<key>ProgramArguments</key>
+	<array>
+%s	</array>
+	<key>RunAtLoad</key>
+	<true/>
+</dict>
+</plist>
+`, resumeAgentLabel, args.String())
+	if err := os.MkdirAll(filepath.Dir(agent), 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(agent, []byte(plist), 0644); err != nil {
+		return err
+	}
+	logInfo("resume", "installed resume LaunchAgent", map[string]string{"path": agent})
+	return nil
+}
+
+// removeResumeAgent uninstalls the one-shot LaunchAgent so it does not fire again.
+func removeResumeAgent() {
+	home := os.Getenv("HOME")
+	agent := resumeAgentPath(home)
+	if !pathExists(agent) || dryRun {
+		return
+	}
+	_ = cmdOutput("launchctl", "remove", resumeAgentLabel)
+	_ = os.Remove(agent)
+	_ = os.Remove(resumeScriptPath(home))
+	logInfo("resume", "removed resume LaunchAgent", nil)
+}
@@ -0,0 +1,31 @@
+package main
+
+import "testing"
+
+// TestResumeSkipsCompletedPhases resumes a run that crashed late in phase 4: phase
+// 3 must not run again, phase 4 must.
+func TestResumeSkipsCompletedPhases(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	old := stateData
+	t.Cleanup(func() { stateData = old })
+	stateData = newRunState()
+	stateData.Progress = &runProgress{
+		GUID:      "guid",
+		Phase:     "phase4",
+		Completed: []string{milestonePhase1, milestoneVPN, milestonePhase3, milestoneOCNA},
+	}
+
+	// bastion without an inventory installs as a single note, recording its state
+	runPhaseOnce("phase3", milestonePhase3, []toolID{toolBastion}, "guid", nil)
+	if ts := stateData.Tools[string(toolBastion)]; ts != nil {
+		t.Fatalf("completed phase 3 ran again: %+v", ts)
+	}
+
+	runPhaseOnce("phase4", milestonePhase4, []toolID{toolBastion}, "guid", nil)
+	if ts := stateData.Tools[string(toolBastion)]; ts == nil || ts.CompletedAt == "" {
+		t.Errorf("phase 4 did not install its tools: %+v", ts)
+	}
+	if !progressDone(milestonePhase4) {
+		t.Error("phase 4 milestone not recorded")
+	}
+}
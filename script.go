@@ -0,0 +1,538 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// scriptGUIDPlaceholder stands in for the GUID in steps rendered by --emit-script;
+// the script asks for the real value when it runs.
+const scriptGUIDPlaceholder = "__CHS_GUID__"
+
+const scriptPrelude = `set -euo pipefail
+
+export PYENV_ROOT="$HOME/.pyenv"
+export PATH="__CHS_BREW_PREFIX__/bin:__CHS_BREW_PREFIX__/sbin:$PYENV_ROOT/bin:$PYENV_ROOT/shims:/usr/local/bin:$PATH"
+
+chs_phase() { print "\n── $1 ──────────────────────────────────────────"; }
+chs_note() { print "  [→] $1"; }
+chs_warn() { print "  [!] $1"; }
+
+# chs_venv runs a command with a pyenv virtualenv activated.
+chs_venv() {
+  local venv=$1; shift
+  PYENV_VERSION=$venv VIRTUAL_ENV="$PYENV_ROOT/versions/$venv" PATH="$PYENV_ROOT/versions/$venv/bin:$PATH" "$@"
+}
+
+# chs_git clones a repository or updates a clone, then checks out the pinned ref.
+# kind is branch, tag, commit or default; policy (abort, stash or reset) decides
+# what happens to uncommitted changes and diverged branches.
+chs_git() {
+  local remote=$1 dir=$2 kind=$3 ref=$4 shallow=$5 policy=$6
+  local depth=()
+  [[ "$shallow" == shallow && "$kind" != commit ]] && depth=(--depth 1)
+  if [[ ! -d "$dir/.git" ]]; then
+    case $kind in
+      branch|tag) git clone "${depth[@]}" --branch "$ref" "$remote" "$dir" ;;
+      *) git clone "${depth[@]}" "$remote" "$dir" ;;
+    esac
+    [[ "$kind" == commit ]] && git -C "$dir" checkout --quiet --detach "$ref"
+    return 0
+  fi
+  if [[ -n "$(git -C "$dir" status --porcelain)" ]]; then
+    case $policy in
+      stash) git -C "$dir" stash push --include-untracked -m chs-onboard ;;
+      reset) git -C "$dir" reset --quiet --hard && git -C "$dir" clean -fdq ;;
+      *) print "  [✗] $dir has uncommitted changes"; return 1 ;;
+    esac
+  fi
+  case $kind in
+    commit)
+      git -C "$dir" fetch --tags origin
+      git -C "$dir" checkout --quiet --detach "$ref" ;;
+    tag)
+      git -C "$dir" fetch "${depth[@]}" origin "+refs/tags/$ref:refs/tags/$ref"
+      git -C "$dir" checkout --quiet --detach "refs/tags/$ref" ;;
+    *)
+      if [[ "$kind" == default ]]; then
+        git -C "$dir" remote set-head origin --auto >/dev/null
+        ref=$(git -C "$dir" symbolic-ref --short refs/remotes/origin/HEAD)
+        ref=${ref#origin/}
+      fi
+      git -C "$dir" fetch "${depth[@]}" origin "+refs/heads/$ref:refs/remotes/origin/$ref"
+      git -C "$dir" checkout --quiet -B "$ref" "$(git -C "$dir" rev-parse --verify --quiet "refs/heads/$ref" || print "origin/$ref")"
+      if ! git -C "$dir" merge --quiet --ff-only "origin/$ref"; then
+        if [[ "$shallow" != shallow && "$policy" != reset ]]; then
+          print "  [✗] $dir has diverged from origin/$ref"
+          return 1
+        fi
+        git -C "$dir" reset --quiet --hard "origin/$ref"
+      fi ;;
+  esac
+}
+
+# chs_zshrc appends a block to ~/.zshrc unless its guard line is already there.
+chs_zshrc() {
+  if ! grep -qF -- "$1" ~/.zshrc 2>/dev/null; then
+    printf '\n%s\n' "$2" >> ~/.zshrc
+  fi
+}
+
+# chs_ssh_config replaces a chs-onboard managed block in ~/.ssh/config, or adds it
+# first, checking that ssh -G accepts the result for each host before installing it.
+chs_ssh_config() {
+  local name=$1 block=$2 cfg=~/.ssh/config h; shift 2
+  mkdir -p ~/.ssh && chmod 700 ~/.ssh
+  local tmp=$(mktemp ~/.ssh/.config.chs-XXXXXX)
+  print -r -- "$block" > "$tmp"
+  if grep -qF "# BEGIN chs-onboard $name" "$cfg" 2>/dev/null; then
+    awk -v b="# BEGIN chs-onboard $name" -v e="# END chs-onboard $name" -v f="$tmp" '
+      index($0, b) == 1 { while ((getline l < f) > 0) print l; skip = 1; next }
+      skip && $0 == e { skip = 0; next }
+      !skip' "$cfg" > "$tmp.new"
+  else
+    { cat "$tmp"; if [[ -s "$cfg" ]]; then print; cat "$cfg"; fi } > "$tmp.new"
+  fi
+  for h in "$@"; do
+    if ! ssh -G -F "$tmp.new" "$h" >/dev/null; then
+      print "  [✗] generated ssh config rejected for $h; $cfg left unchanged"
+      rm -f "$tmp" "$tmp.new"
+      return 1
+    fi
+  done
+  chmod 600 "$tmp.new" && mv "$tmp.new" "$cfg"
+  rm -f "$tmp"
+}
+
+# chs_known_hosts adds a host's keys to ~/.ssh/known_hosts unless it is already
+# known. With fingerprints given, only keys matching one of them are added.
+chs_known_hosts() {
+  local host=$1 port=$2 target=$1 line fp added=0; shift 2
+  [[ "$port" != 22 ]] && target="[$host]:$port"
+  mkdir -p ~/.ssh && chmod 700 ~/.ssh
+  ssh-keygen -F "$target" >/dev/null 2>&1 && return 0
+  ssh-keyscan -T 10 -p "$port" "$host" 2>/dev/null | while IFS= read -r line; do
+    [[ -z "$line" || "$line" == \#* ]] && continue
+    fp=$(print -r -- "$line" | ssh-keygen -lf - | awk '{print $2}')
+    if (( $# == 0 || ${@[(Ie)$fp]} )); then
+      print -r -- "$line" >> ~/.ssh/known_hosts
+      added=1
+    fi
+  done
+  (( added )) || { print "  [✗] no host key of $target matches the pinned fingerprints"; return 1; }
+}
+
+# chs_ssh_probe checks non-interactively that an SSH server accepts the key, asking
+# to retry while it is rejected. ssh exits with 255 only for its own errors.
+chs_ssh_probe() {
+  local out rc
+  while true; do
+    rc=0
+    out=$(ssh -T -o BatchMode=yes -o ConnectTimeout=10 -o StrictHostKeyChecking=yes -p "$2" "$1" 2>&1 </dev/null) || rc=$?
+    (( rc != 255 )) && return 0
+    if [[ "$out" != *"Permission denied (publickey"* ]]; then
+      print -r -- "  [✗] ssh to $1 failed: ${out%%$'\n'*}"
+      return 1
+    fi
+    chs_confirm "$1 rejected your SSH key. Add it at https://bitbucket.oci.oraclecorp.com/plugins/servlet/ssh/account/keys, then check again?"
+  done
+}
+
+# chs_trust_roots copies the CA certificates (PEM or DER) under src that are valid
+# now into dst, one per fingerprint, and writes them after the system roots to
+# bundle. openssl reads only the first certificate of each file.
+chs_trust_roots() {
+  local src=$1 dst=$2 bundle=$3 system=$4 f pem fp n=0
+  local -A seen
+  rm -rf "$dst.new" && mkdir -p "$dst.new" "$(dirname "$bundle")"
+  find "$src" -name '.*' -prune -o -type f -print | while IFS= read -r f; do
+    pem=$(openssl x509 -in "$f" 2>/dev/null || openssl x509 -inform DER -in "$f" 2>/dev/null) || { chs_warn "skipping $f: not a certificate"; continue; }
+    print -r -- "$pem" | openssl x509 -noout -text | grep -q 'CA:TRUE' || { chs_warn "skipping $f: not a CA certificate"; continue; }
+    print -r -- "$pem" | openssl x509 -noout -checkend 0 >/dev/null || { chs_warn "skipping $f: expired"; continue; }
+    fp=$(print -r -- "$pem" | openssl x509 -noout -fingerprint -sha256)
+    [[ -n ${seen[$fp]:-} ]] && continue
+    seen[$fp]=1
+    print -r -- "$fp  $f"
+    print -r -- "$pem" > "$dst.new/$(basename "${f%.*}")-$n.pem"
+    n=$((n + 1))
+  done
+  (( n > 0 )) || { print "  [✗] no valid CA certificates in $src"; return 1; }
+  rm -rf "$dst" && mv "$dst.new" "$dst"
+  { [[ -f "$system" ]] && cat "$system"; cat "$dst"/*.pem; } > "$bundle.tmp" && mv "$bundle.tmp" "$bundle"
+}
+
+chs_confirm() {
+  if ! read -q "?  [?] $1 [y/N] "; then
+    print "\n  [✗] $1: not confirmed, stopping."
+    exit 1
+  fi
+  print
+}
+
+# chs_download fetches a URL (resuming a partial download), checks its SHA-256 when
+# one is given, then unzips it into a directory or copies it to a file.
+chs_download() {
+  local url=$1 dst=$2 sha=$3 unzip=$4
+  local tmp="${TMPDIR:-/tmp}/chs-download-$(print -rn -- "$url" | shasum -a 256 | cut -c1-16)"
+  curl -fL -C - -o "$tmp" "$url"
+  if [[ -n "$sha" && "$(shasum -a 256 "$tmp" | cut -d' ' -f1)" != "$sha" ]]; then
+    print "  [✗] $url does not match sha256 $sha"
+    rm -f "$tmp"
+    exit 1
+  fi
+  if [[ "$unzip" == unzip ]]; then
+    unzip -oq "$tmp" -d "$dst"
+  else
+    mkdir -p "${dst:h}" && cp "$tmp" "$dst"
+  fi
+  rm -f "$tmp"
+}
+
+# chs_pip_index prints the first package index that answers, trying them in order.
+chs_pip_index() {
+  local idx
+  for idx in "$@"; do
+    if curl -fsS --max-time 10 -o /dev/null "${idx%/}/pip/"; then
+      print -r -- "$idx"
+      return 0
+    fi
+    chs_warn "package index $idx unreachable" >&2
+  done
+  return 1
+}
+
+chs_wait_tcp() {
+  until nc -z -G 3 "$1" "$2" >/dev/null 2>&1; do
+    print "  [~] Waiting for $1:$2..."
+    sleep 5
+  done
+}
+`
+
+// emitScript renders the install steps for tools as a standalone, rerunnable zsh script.
+func emitScript(tools []toolID) (string, error) {
+	var b strings.Builder
+	p1, p3, p4 := splitPhases(tools)
+	needsGUID := false
+
+	var body strings.Builder
+	renderTools := func(list []toolID) error {
+		for _, t := range list {
+			steps, err := toolSteps(t, scriptGUIDPlaceholder)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(&body, "\n# ── %s\nchs_note %s\n", t, scriptWord("installing "+string(t)))
+			for _, s := range steps {
+				line := renderScriptStep(s)
+				if strings.Contains(line, "$CHS_GUID") {
+					needsGUID = true
+				}
+				body.WriteString(line)
+			}
+		}
+		return nil
+	}
+
+	body.WriteString("\nchs_phase 'Preflight'\n")
+	body.WriteString(`curl -fsSI --max-time 5 https://github.com >/dev/null || { print "  [✗] public internet unreachable — ensure VPN is OFF"; exit 1; }
+`)
+	body.WriteString(scriptSSHKey())
+	body.WriteString(renderScriptStep(sshAgentConfigStep("ssh_key")))
+	body.WriteString("sudo -v\n")
+	for _, s := range baseZshrcSteps() {
+		body.WriteString(renderScriptStep(s))
+	}
+
+	body.WriteString("\nchs_phase 'Phase 1: Public Internet (VPN OFF)'\n")
+	if err := renderTools(p1); err != nil {
+		return "", err
+	}
+	fmt.Fprintf(&body, "\npyenv global %s || chs_warn 'pyenv global set failed'\n", shellJoin(pythonGlobals()))
+	if hasTool(tools, toolGNOCHelper) {
+		body.WriteString(`
+# sshpass is required for gnoc-helper
+if ! command -v sshpass >/dev/null; then
+  brew install hudochenkov/sshpass/sshpass || brew install sshpass
+fi
+`)
+	}
+
+	if len(p3) > 0 || len(p4) > 0 {
+		body.WriteString("\nchs_phase 'Phase 2: Connect to VPN'\n")
+		body.WriteString("read '?  [!] Phase 1 complete. Connect to myaccess.oraclevpn.com now, then press Enter. '\n")
+		for _, h := range vpnCheckHosts {
+			host, port, _ := net.SplitHostPort(h)
+			fmt.Fprintf(&body, "chs_wait_tcp %s %s\n", host, port)
+		}
+		body.WriteString(`print "  [✓] VPN confirmed"
+`)
+		body.WriteString(renderScriptStep(sshKeyAddStep("ssh_key")))
+		if hasTool(tools, toolBitbucketSSH) {
+			// Set up and probe SSH before phase 3 clones, so none stops at a prompt.
+			if err := renderTools([]toolID{toolBitbucketSSH}); err != nil {
+				return "", err
+			}
+			if h := sshHosts["bitbucket"]; h.inUse() {
+				target := h.HostName
+				if h.User != "" {
+					target = h.User + "@" + target
+				}
+				fmt.Fprintf(&body, "chs_ssh_probe %s %d\n", scriptWord(target), h.port())
+			}
+			p3 = withoutTool(p3, toolBitbucketSSH)
+		}
+	}
+	if len(p3) > 0 {
+		body.WriteString("\nchs_phase 'Phase 3: Internal Tools (myaccess VPN)'\n")
+		if err := renderTools(p3); err != nil {
+			return "", err
+		}
+	}
+	if len(p4) > 0 {
+		body.WriteString("\nchs_phase 'Phase 4: OCNA + Yubikey Required (Final Installs)'\n")
+		body.WriteString("chs_confirm 'Connect OCNA VPN and make sure your Yubikey is set up and connected. Continue?'\n")
+		body.WriteString(`if [[ -n "${CHS_OCNA_CHECK_TARGET:-}" ]]; then
+  chs_wait_tcp "${CHS_OCNA_CHECK_TARGET%:*}" "${CHS_OCNA_CHECK_TARGET##*:}"
+fi
+`)
+		if err := renderTools(p4); err != nil {
+			return "", err
+		}
+	}
+	body.WriteString("\nprint '\\n✓ chs-onboard complete. Open a new terminal or run: source ~/.zshrc'\n")
+
+	b.WriteString("#!/bin/zsh\n")
+	b.WriteString("#\n# chs-onboard standalone install script\n")
+	fmt.Fprintf(&b, "# Generated %s for tools: %s\n", time.Now().UTC().Format(time.RFC3339), strings.Join(toolIDsToNames(tools), ", "))
+	b.WriteString("#\n# Runs the same steps as the chs-onboard binary. Every step checks whether its\n")
+	b.WriteString("# work is already done, so the script is safe to rerun after a failure.\n")
+	b.WriteString("# Not covered: sleep settings, account rename and saved completion state.\n")
+	fmt.Fprintf(&b, "# Generated for %s Macs with Homebrew in %s.\n\n", platform.Arch, platform.BrewPrefix)
+	b.WriteString(strings.ReplaceAll(scriptPrelude, "__CHS_BREW_PREFIX__", platform.BrewPrefix))
+	if needsGUID {
+		b.WriteString("\nread \"CHS_GUID?  [?] Enter your Oracle GUID (e.g. jsmith): \"\n")
+		b.WriteString("[[ -n \"$CHS_GUID\" ]] || { print '  [✗] Oracle GUID is required'; exit 1; }\n")
+	}
+	b.WriteString(body.String())
+	return b.String(), nil
+}
+
+// renderScriptStep renders one step as zsh, translating its guards into shell tests.
+func renderScriptStep(s step) string {
+	var cmd string
+	switch s.Kind {
+	case stepExec:
+		words := make([]string, 0, len(s.Args)+4)
+		for _, e := range s.Env {
+			words = append(words, scriptWord(e))
+		}
+		if s.Venv != "" {
+			words = append(words, "chs_venv", scriptWord(s.Venv))
+		}
+		if s.Sudo {
+			words = append(words, "sudo")
+		}
+		for _, a := range s.Args {
+			words = append(words, scriptWord(a))
+		}
+		cmd = strings.Join(words, " ")
+		if s.IgnoreErr {
+			cmd += " || chs_warn " + scriptWord("ignoring failure: "+s.describe())
+		}
+	case stepGit:
+		r := s.repo()
+		kind, ref := "default", ""
+		switch {
+		case r.Commit != "":
+			kind, ref = "commit", r.Commit
+		case r.Tag != "":
+			kind, ref = "tag", r.Tag
+		case r.Branch != "":
+			kind, ref = "branch", r.Branch
+		}
+		depth := "full"
+		if r.Shallow {
+			depth = "shallow"
+		}
+		cmd = strings.Join([]string{"chs_git", scriptWord(s.Remote), scriptWord(s.Dst), kind, scriptWord(ref), depth, r.localChanges()}, " ")
+	case stepZshrc:
+		return "chs_zshrc " + scriptWord(s.Guard) + " " + scriptWord(s.Block) + "\n"
+	case stepFile:
+		data, err := s.fileData()
+		if err != nil {
+			return "print -r -- " + scriptWord("  [✗] "+err.Error()) + "; exit 1\n"
+		}
+		cmd = fmt.Sprintf("mkdir -p %s\ncat > %s <<'CHS_ASSET'\n%s\nCHS_ASSET",
+			scriptWord(filepath.Dir(s.Dst)), scriptWord(s.Dst), strings.TrimRight(string(data), "\n"))
+	case stepConfirm:
+		cmd = "chs_confirm " + scriptWord(s.Title+": "+s.Message)
+	case stepFetch:
+		mode := "copy"
+		if s.Unzip {
+			mode = "unzip"
+		}
+		cmd = "chs_download " + scriptWord(s.URL) + " " + scriptWord(s.Dst) + " " + scriptWord(s.SHA256) + " " + mode
+	case stepPipConf:
+		indexes := make([]string, 0, len(s.Pip.indexes()))
+		for _, idx := range s.Pip.indexes() {
+			indexes = append(indexes, scriptWord(idx))
+		}
+		data := strings.TrimRight(pipConfText(*s.Pip, pipConfIndexPlaceholder), "\n")
+		cmd = fmt.Sprintf("chs_index=$(chs_pip_index %s) || { print '  [✗] no package index reachable'; exit 1; }\nmkdir -p %s\nsed \"s|%s|$chs_index|\" > %s <<'CHS_ASSET'\n%s\nCHS_ASSET",
+			strings.Join(indexes, " "), scriptWord(filepath.Dir(s.Dst)), pipConfIndexPlaceholder, scriptWord(s.Dst), data)
+	case stepSSHConfig:
+		if s.Block == "" {
+			cmd = "print -r -- " + scriptWord("  [✗] "+s.Message) + "; exit 1"
+			break
+		}
+		words := []string{"chs_ssh_config", scriptWord(s.Guard), scriptWord(s.Block)}
+		for _, e := range s.SSH {
+			words = append(words, scriptWord(e.Host))
+		}
+		cmd = strings.Join(words, " ")
+	case stepKnownHosts:
+		words := []string{"chs_known_hosts", scriptWord(s.Host.HostName), strconv.Itoa(s.Host.port())}
+		for _, fp := range s.Host.Fingerprints {
+			words = append(words, scriptWord(fp))
+		}
+		cmd = strings.Join(words, " ")
+	case stepSSHKeyAdd:
+		cmd = `print "\n  Your SSH public key — add it at https://bitbucket.oci.oraclecorp.com/plugins/servlet/ssh/account/keys\n"
+cat $chs_key.pub
+chs_confirm "Has the key been added to Bitbucket?"`
+	case stepTrustRoots:
+		cmd = strings.Join([]string{"chs_trust_roots", scriptWord(s.Src), scriptWord(s.Dst), scriptWord(s.Bundle), scriptWord(systemCABundles[0])}, " ")
+	case stepNote:
+		cmd = "chs_note " + scriptWord(s.Message)
+	case stepBrew:
+		lines := make([]string, 0, len(s.Brew))
+		for _, p := range s.Brew {
+			line := shellJoin(append([]string{"brew"}, p.installArgs()...))
+			switch p.Kind {
+			case brewTap:
+				line = "brew tap | grep -qx " + scriptWord(p.Name) + " || " + line
+			case brewCask:
+				line = "brew list --cask " + scriptWord(p.shortName()) + " >/dev/null 2>&1 || " + line
+			default:
+				line = "brew list --formula " + scriptWord(p.shortName()) + " >/dev/null 2>&1 || " + line
+			}
+			if p.Optional {
+				line += " || chs_warn " + scriptWord("optional "+p.String()+" failed to install")
+			}
+			lines = append(lines, line)
+		}
+		cmd = strings.Join(lines, "\n")
+	default:
+		cmd = "# unsupported step: " + s.describe()
+	}
+
+	var conds []string
+	if s.Creates != "" {
+		conds = append(conds, "! -e "+scriptWord(s.Creates))
+	}
+	if s.Requires != "" {
+		conds = append(conds, "-e "+scriptWord(s.Requires))
+	}
+	if len(conds) == 0 {
+		return cmd + "\n"
+	}
+	return "if [[ " + strings.Join(conds, " && ") + " ]]; then\n" + indentLines(cmd, "  ") + "\nfi\n"
+}
+
+// scriptWord quotes s for zsh, turning this machine's home directory into $HOME
+// and the GUID placeholder into $CHS_GUID so the script works for any user.
+func scriptWord(s string) string {
+	home := os.Getenv("HOME")
+	hasHome := home != "" && home != "/" && regexp.MustCompile(regexp.QuoteMeta(home)+`(/|$)`).MatchString(s)
+	if !hasHome && !strings.Contains(s, scriptGUIDPlaceholder) {
+		return shellQuote(s)
+	}
+	q := "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+	if hasHome {
+		q = regexp.MustCompile(regexp.QuoteMeta(home)+`(/|')`).ReplaceAllString(q, `'"$$HOME"'$1`)
+	}
+	q = strings.ReplaceAll(q, scriptGUIDPlaceholder, `'"$CHS_GUID"'`)
+	q = strings.TrimPrefix(q, "''")
+	q = strings.TrimSuffix(q, "''")
+	return q
+}
+
+func indentLines(s, prefix string) string {
+	lines := strings.Split(s, "\n")
+	inHeredoc := false
+	for i, l := range lines {
+		if !inHeredoc {
+			lines[i] = prefix + l
+		}
+		if strings.Contains(l, "<<'CHS_ASSET'") {
+			inHeredoc = true
+		} else if l == "CHS_ASSET" {
+			inHeredoc = false
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func writeEmittedScript(path string, tools []toolID) error {
+	script, err := emitScript(tools)
+	if err != nil {
+		return err
+	}
+	if path == "-" {
+		_, err := os.Stdout.WriteString(script)
+		return err
+	}
+	if err := os.WriteFile(path, []byte(script), 0755); err != nil {
+		return err
+	}
+	fmt.Printf("Wrote standalone install script to %s (%d tools).\n", path, len(tools))
+	return nil
+}
+
+// scriptSSHKey renders preflightSSHKeyEnsure: permissions, a key that meets
+// sshKeyConfig, and loading it into ssh-agent.
+func scriptSSHKey() string {
+	files := sshKeyConfig.keyFiles()
+	key := "~/.ssh/" + filepath.Base(files[0])
+	other := "~/.ssh/" + filepath.Base(files[1])
+	keygen := "ssh-keygen -t " + sshKeyConfig.Type
+	if sshKeyConfig.Type == "rsa" {
+		keygen += " -b 4096"
+	}
+	keygen += ` -C "$chs_email" -f ` + key
+	if sshKeyConfig.Passphrase == "none" {
+		keygen += ` -N ""`
+	}
+	return fmt.Sprintf(`mkdir -p ~/.ssh && chmod 700 ~/.ssh
+find ~/.ssh -maxdepth 1 -type f \( -name 'id_*' ! -name '*.pub' -o -name config -o -name authorized_keys \) -exec chmod 600 {} +
+chs_key=%[1]s
+[[ ! -f $chs_key.pub && -f %[2]s.pub ]] && chs_key=%[2]s
+if [[ -f $chs_key.pub ]]; then
+  chs_keyinfo=(${(z)"$(ssh-keygen -lf $chs_key.pub)"})
+  if [[ $chs_keyinfo[-1] == "(DSA)" ]] || { [[ $chs_keyinfo[-1] == "(RSA)" ]] && (( chs_keyinfo[1] < %[3]d )); }; then
+    chs_warn "$chs_key is a $chs_keyinfo[1]-bit ${chs_keyinfo[-1]//[()]/} key, weaker than policy"
+    if read -q "?  [?] Generate a new %[4]s key? The old key is kept. [y/N] "; then
+      print
+      [[ -f %[1]s ]] && mv %[1]s{,.old-$(date +%%Y%%m%%d)} && mv %[1]s.pub{,.old-$(date +%%Y%%m%%d)}
+      chs_email=${(j: :)${(z)"$(<$chs_key.pub)"}[3,-1]}
+      %[5]s
+      chs_key=%[1]s
+    fi
+  fi
+else
+  read "chs_email?  [?] Enter your Oracle email for SSH key generation: "
+  %[5]s
+  chs_key=%[1]s
+fi
+if ! ssh-add -l 2>/dev/null | grep -qF -- "$(ssh-keygen -lf $chs_key.pub | awk '{print $2}')"; then
+  ssh-add --apple-use-keychain $chs_key || chs_warn "could not load $chs_key into ssh-agent; git may prompt for it"
+fi
+`, key, other, sshKeyConfig.MinRSABits, sshKeyConfig.Type, keygen)
+}
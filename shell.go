@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
 	"time"
 )
@@ -13,23 +14,30 @@ import (
 // baseEnv provides absolute paths for all tools without requiring .zshrc to be sourced.
 var baseEnv = func() []string {
 	home := os.Getenv("HOME")
-	return []string{
+	env := []string{
 		"HOME=" + home,
 		"USER=" + os.Getenv("USER"),
 		"LOGNAME=" + os.Getenv("LOGNAME"),
-		"PATH=/opt/homebrew/bin:/opt/homebrew/sbin:/opt/local/bin:/opt/local/sbin:" +
-			home + "/.pyenv/bin:" +
-			home + "/.pyenv/shims:" +
-			"/usr/local/bin:/usr/bin:/bin:/usr/sbin:/sbin",
+		"PATH=" + systemPath(home+"/.pyenv/bin", home+"/.pyenv/shims"),
 		"PYENV_ROOT=" + home + "/.pyenv",
-		"HOMEBREW_PREFIX=/opt/homebrew",
-		"HOMEBREW_CELLAR=/opt/homebrew/Cellar",
-		"HOMEBREW_REPOSITORY=/opt/homebrew",
+	}
+	env = append(env, platform.brewEnv()...)
+	if bundle := caBundlePath(); pathExists(bundle) {
+		env = append(env, caBundleEnv(bundle)...)
+	}
+	return append(env,
 		"TERM=xterm-256color",
 		"LANG=en_US.UTF-8",
-	}
+	)
 }()
 
+// systemPath is PATH with Homebrew first, then extra, then the system directories.
+func systemPath(extra ...string) string {
+	dirs := append(platform.pathDirs(), "/opt/local/bin", "/opt/local/sbin")
+	dirs = append(dirs, extra...)
+	return joinPath(append(dirs, "/usr/local/bin", "/usr/bin", "/bin", "/usr/sbin", "/sbin")...)
+}
+
 // pyenvEnv returns an env slice with a specific pyenv virtualenv activated.
 func pyenvEnv(venv string) []string {
 	home := os.Getenv("HOME")
@@ -43,10 +51,7 @@ func pyenvEnv(venv string) []string {
 	return append(env,
 		"PYENV_VERSION="+venv,
 		"VIRTUAL_ENV="+pyenvRoot+"/versions/"+venv,
-		"PATH="+pyenvRoot+"/versions/"+venv+"/bin:"+
-			"/opt/homebrew/bin:/opt/homebrew/sbin:/opt/local/bin:/opt/local/sbin:"+
-			pyenvRoot+"/bin:"+pyenvRoot+"/shims:"+
-			"/usr/local/bin:/usr/bin:/bin:/usr/sbin:/sbin",
+		"PATH="+pyenvRoot+"/versions/"+venv+"/bin:"+systemPath(pyenvRoot+"/bin", pyenvRoot+"/shims"),
 	)
 }
 
@@ -77,8 +82,16 @@ func runCmd(step string, env []string, name string, args ...string) (string, err
 	}
 	if err != nil {
 		fields["error"] = err.Error()
+		cmdErr := fmt.Errorf("%s %s: %w\n%s", name, strings.Join(args, " "), err, out)
+		if h := matchFailure(out); h != nil {
+			fields["hint"] = h.ID
+			logError(step, "command failed", fields)
+			logWarn(step, "known issue: "+h.Explain, map[string]string{"hint": h.ID, "fix": h.Fix})
+			fmt.Printf("      fix: %s\n", h.Fix)
+			return out, &hintedError{err: cmdErr, hint: h, cmd: append([]string{name}, args...)}
+		}
 		logError(step, "command failed", fields)
-		return out, fmt.Errorf("%s %s: %w\n%s", name, strings.Join(args, " "), err, out)
+		return out, cmdErr
 	}
 	logInfo(step, "command ok", fields)
 	return out, nil
@@ -111,12 +124,72 @@ func cmdOutput(name string, args ...string) string {
 	return strings.TrimSpace(string(out))
 }
 
+// firstLine returns the first line of s.
+func firstLine(s string) string {
+	line, _, _ := strings.Cut(s, "\n")
+	return strings.TrimSpace(line)
+}
+
+// pkgutilVersion returns the installed version of a macOS package receipt, or "".
+func pkgutilVersion(pkg string) string {
+	for _, line := range strings.Split(cmdOutput("pkgutil", "--pkg-info="+pkg), "\n") {
+		if v, ok := strings.CutPrefix(line, "version:"); ok {
+			return strings.TrimSpace(v)
+		}
+	}
+	return ""
+}
+
+// gitHead returns the short commit checked out in dir, or "".
+func gitHead(dir string) string {
+	if !pathExists(dir + "/.git") {
+		return ""
+	}
+	return cmdOutput("git", "-C", dir, "rev-parse", "--short", "HEAD")
+}
+
 // pathExists returns true if the path exists on disk.
 func pathExists(path string) bool {
 	_, err := os.Stat(path)
 	return err == nil
 }
 
+// writeFileAtomic replaces path with data so readers see either the old or the new
+// contents, never a partial write: temp file in the same dir, fsync, rename, fsync dir.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	defer os.Remove(tmpName) // no-op once renamed
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpName, path); err != nil {
+		return err
+	}
+	if d, err := os.Open(dir); err == nil {
+		_ = d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
 // fileContains returns true if the file contains substr.
 func fileContains(path, substr string) bool {
 	data, err := os.ReadFile(path)
@@ -174,18 +247,6 @@ func startSudoKeepalive(ctx context.Context) error {
 	return nil
 }
 
-// gitCloneOrPull clones remote into dir, or pulls if the repo already exists.
-func gitCloneOrPull(step, remote, dir string) error {
-	if pathExists(dir + "/.git") {
-		logInfo(step, "repo exists, pulling: "+dir, nil)
-		_, err := runCmd(step, nil, "git", "-C", dir, "pull")
-		return err
-	}
-	logInfo(step, fmt.Sprintf("cloning %s → %s", remote, dir), nil)
-	_, err := runCmd(step, nil, "git", "clone", remote, dir)
-	return err
-}
-
 func truncate(s string, n int) string {
 	if len(s) <= n {
 		return s
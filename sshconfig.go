@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// openscPKCS11 is the PKCS#11 module that exposes the Yubikey to ssh.
+const openscPKCS11 = "/usr/local/lib/opensc-pkcs11.so"
+
+// sshExpect is what `ssh -G` must resolve for a host once a managed block is in
+// place; option names are lower-case as ssh -G prints them.
+type sshExpect struct {
+	Host    string            `json:"host"`
+	Options map[string]string `json:"options,omitempty"`
+}
+
+func sshConfigPath() string {
+	return filepath.Join(os.Getenv("HOME"), ".ssh", "config")
+}
+
+func sshBlockMarkers(name string) (string, string) {
+	return "# BEGIN chs-onboard " + name, "# END chs-onboard " + name
+}
+
+// sshConfigBlock wraps body in the markers of the managed block name.
+func sshConfigBlock(name, body string) string {
+	begin, end := sshBlockMarkers(name)
+	return begin + " (managed; edits inside this block are overwritten)\n" + strings.TrimRight(body, "\n") + "\n" + end
+}
+
+// sshConfigStep maintains the managed block name in ~/.ssh/config. The config is
+// checked with `ssh -G` against expect before it replaces the real file.
+func sshConfigStep(log, name, body string, expect []sshExpect) step {
+	return step{Kind: stepSSHConfig, Log: log, Dst: sshConfigPath(), Guard: name, Block: sshConfigBlock(name, body), SSH: expect}
+}
+
+// managedBlock returns the block named name in config, or "" when there is none.
+func managedBlock(config, name string) string {
+	start, stop, ok := managedBlockRange(config, name)
+	if !ok {
+		return ""
+	}
+	return strings.TrimRight(config[start:stop], "\n")
+}
+
+// managedBlockRange finds the byte range of block name in config, end line included.
+func managedBlockRange(config, name string) (int, int, bool) {
+	begin, end := sshBlockMarkers(name)
+	start := -1
+	offset := 0
+	for _, line := range strings.SplitAfter(config, "\n") {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case start < 0 && strings.HasPrefix(trimmed, begin):
+			start = offset
+		case start >= 0 && trimmed == end:
+			return start, offset + len(line), true
+		}
+		offset += len(line)
+	}
+	return 0, 0, false
+}
+
+// replaceManagedBlock returns config with block name replaced by block. A new block
+// goes first: ssh uses the first value it finds, so earlier `Host *` entries would
+// otherwise override it.
+func replaceManagedBlock(config, name, block string) string {
+	if start, stop, ok := managedBlockRange(config, name); ok {
+		return config[:start] + block + "\n" + config[stop:]
+	}
+	if strings.TrimSpace(config) == "" {
+		return block + "\n"
+	}
+	return block + "\n\n" + config
+}
+
+// writeSSHConfig puts s.Block into s.Dst, validating the result first.
+func writeSSHConfig(s step) error {
+	if s.Block == "" {
+		return errors.New(s.Message)
+	}
+	if dryRun {
+		logInfo(s.Log, "DRY-RUN: would update the "+s.Guard+" block in "+s.Dst, nil)
+		return nil
+	}
+	old, err := os.ReadFile(s.Dst)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	updated := replaceManagedBlock(string(old), s.Guard, s.Block)
+	if updated == string(old) {
+		logInfo(s.Log, s.Guard+" block in "+s.Dst+" is up to date", nil)
+		return checkSSHConfig(s.Dst, s.SSH)
+	}
+	if err := os.MkdirAll(filepath.Dir(s.Dst), 0700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.Dst), ".config.chs-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.WriteString(updated)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err := checkSSHConfig(tmp.Name(), s.SSH); err != nil {
+		return fmt.Errorf("generated ssh config rejected, %s left unchanged: %w", s.Dst, err)
+	}
+	if err := writeFileAtomic(s.Dst, []byte(updated), 0600); err != nil {
+		return fmt.Errorf("writing %s: %w", s.Dst, err)
+	}
+	logInfo(s.Log, "updated the "+s.Guard+" block in "+s.Dst, map[string]string{"hosts": fmt.Sprint(len(s.SSH))})
+	return nil
+}
+
+// checkSSHConfig resolves each expected host with `ssh -G -F path`, which fails on
+// syntax errors and unknown options, and compares the options that must match.
+func checkSSHConfig(path string, expect []sshExpect) error {
+	for _, e := range expect {
+		got, err := sshResolve(path, e.Host)
+		if err != nil {
+			return err
+		}
+		keys := make([]string, 0, len(e.Options))
+		for k := range e.Options {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if want := e.Options[k]; !strings.EqualFold(got[k], want) {
+				return fmt.Errorf("ssh resolves %s %s to %q, want %q (is an earlier entry in the config overriding it?)", e.Host, k, got[k], want)
+			}
+		}
+	}
+	return nil
+}
+
+// sshResolve returns the options ssh would use for host, keyed by lower-case name.
+// Options ssh -G prints more than once (identityfile) keep the first value.
+func sshResolve(path, host string) (map[string]string, error) {
+	out, err := exec.Command("ssh", "-G", "-F", path, host).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("ssh -G %s: %s", host, firstLine(string(out)))
+	}
+	opts := map[string]string{}
+	sc := bufio.NewScanner(strings.NewReader(string(out)))
+	for sc.Scan() {
+		k, v, _ := strings.Cut(sc.Text(), " ")
+		if _, seen := opts[k]; !seen {
+			opts[k] = v
+		}
+	}
+	return opts, nil
+}
+
+// sshPatternSample turns a Host pattern into a host name it matches, for ssh -G.
+// Negated patterns match nothing on their own and yield "".
+func sshPatternSample(pattern string) string {
+	if strings.HasPrefix(pattern, "!") {
+		return ""
+	}
+	return strings.NewReplacer("*", "chs-probe", "?", "x").Replace(pattern)
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sshKeyPolicy is ~/.chs-onboard/ssh_key.json: how the SSH key used for Bitbucket
+// and the bastions is generated and vetted. Fields left empty keep the default.
+type sshKeyPolicy struct {
+	// Type is the kind of key to generate, "ed25519" or "rsa".
+	Type string `json:"type,omitempty"`
+	// Passphrase is "prompt" (ask; empty allowed), "require" or "none".
+	Passphrase string `json:"passphrase,omitempty"`
+	// MinRSABits is the smallest RSA key accepted without offering a rotation.
+	MinRSABits int `json:"min_rsa_bits,omitempty"`
+}
+
+var defaultSSHKeyPolicy = sshKeyPolicy{Type: "ed25519", Passphrase: "prompt", MinRSABits: 3072}
+
+// sshKeyConfig is defaultSSHKeyPolicy, or ~/.chs-onboard/ssh_key.json when present.
+var sshKeyConfig = loadSSHKeyPolicy()
+
+func loadSSHKeyPolicy() sshKeyPolicy {
+	path := filepath.Join(os.Getenv("HOME"), ".chs-onboard", "ssh_key.json")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return defaultSSHKeyPolicy
+	}
+	p := defaultSSHKeyPolicy
+	if err := json.Unmarshal(data, &p); err != nil {
+		fmt.Fprintf(os.Stderr, "  [!] ignoring %s: %v\n", path, err)
+		return defaultSSHKeyPolicy
+	}
+	switch {
+	case p.Type != "ed25519" && p.Type != "rsa":
+		fmt.Fprintf(os.Stderr, "  [!] ignoring %s: type must be ed25519 or rsa\n", path)
+		return defaultSSHKeyPolicy
+	case p.Passphrase != "prompt" && p.Passphrase != "require" && p.Passphrase != "none":
+		fmt.Fprintf(os.Stderr, "  [!] ignoring %s: passphrase must be prompt, require or none\n", path)
+		return defaultSSHKeyPolicy
+	}
+	return p
+}
+
+// keyFiles returns the private keys chs-onboard uses, the policy's type first.
+func (p sshKeyPolicy) keyFiles() []string {
+	dir := filepath.Join(os.Getenv("HOME"), ".ssh")
+	if p.Type == "rsa" {
+		return []string{filepath.Join(dir, "id_rsa"), filepath.Join(dir, "id_ed25519")}
+	}
+	return []string{filepath.Join(dir, "id_ed25519"), filepath.Join(dir, "id_rsa")}
+}
+
+// findSSHKey returns the first private key in keyFiles with a public key beside it,
+// or "" when there is none.
+func findSSHKey() string {
+	for _, k := range sshKeyConfig.keyFiles() {
+		if pathExists(k + ".pub") {
+			return k
+		}
+	}
+	return ""
+}
+
+// sshKeyPath is the private key used for Bitbucket and the bastions, as ~/.ssh
+// config spells it: the key preflight found, or the one it will generate.
+func sshKeyPath() string {
+	key := findSSHKey()
+	if key == "" {
+		key = sshKeyConfig.keyFiles()[0]
+	}
+	return "~/.ssh/" + filepath.Base(key)
+}
+
+// sshKeyInfo is what `ssh-keygen -l` reports for a key.
+type sshKeyInfo struct {
+	Type        string
+	Bits        int
+	Fingerprint string
+}
+
+func inspectSSHKey(pubPath string) (sshKeyInfo, error) {
+	out, err := exec.Command("ssh-keygen", "-l", "-f", pubPath).Output()
+	if err != nil {
+		return sshKeyInfo{}, fmt.Errorf("ssh-keygen -l %s: %w", pubPath, err)
+	}
+	// 3072 SHA256:abc... comment (RSA)
+	fields := strings.Fields(string(out))
+	if len(fields) < 3 {
+		return sshKeyInfo{}, fmt.Errorf("ssh-keygen -l %s: unexpected output %q", pubPath, firstLine(string(out)))
+	}
+	bits, _ := strconv.Atoi(fields[0])
+	return sshKeyInfo{
+		Type:        strings.Trim(fields[len(fields)-1], "()"),
+		Bits:        bits,
+		Fingerprint: fields[1],
+	}, nil
+}
+
+// weak reports whether the key falls short of the policy.
+func (p sshKeyPolicy) weak(info sshKeyInfo) bool {
+	switch info.Type {
+	case "RSA":
+		return info.Bits < p.MinRSABits
+	case "DSA":
+		return true
+	}
+	return false
+}
+
+// fixSSHPermissions tightens ~/.ssh to what ssh insists on: the directory and
+// private files readable by the owner only. Looser modes are fixed and logged.
+func fixSSHPermissions() {
+	dir := filepath.Join(os.Getenv("HOME"), ".ssh")
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return
+	}
+	tighten := func(path string, mode os.FileMode) {
+		fi, err := os.Stat(path)
+		if err != nil || fi.Mode().Perm()&^mode == 0 {
+			return
+		}
+		if dryRun {
+			logInfo("ssh_key", fmt.Sprintf("DRY-RUN: would chmod %o %s", mode, path), nil)
+			return
+		}
+		if err := os.Chmod(path, mode); err != nil {
+			logWarn("ssh_key", "could not fix permissions of "+path, map[string]string{"error": err.Error()})
+			return
+		}
+		logInfo("ssh_key", fmt.Sprintf("fixed permissions of %s (was %o)", path, fi.Mode().Perm()), nil)
+	}
+	if fi.IsDir() {
+		tighten(dir, 0700)
+	}
+	entries, _ := os.ReadDir(dir)
+	for _, e := range entries {
+		name := e.Name()
+		switch {
+		case e.IsDir():
+		case name == "config", name == "authorized_keys",
+			strings.HasPrefix(name, "id_") && !strings.HasSuffix(name, ".pub"):
+			tighten(filepath.Join(dir, name), 0600)
+		}
+	}
+}
+
+// askSSHPassphrase asks for the new key's passphrase as the policy says, twice so
+// a typo does not lock the key.
+func askSSHPassphrase() (string, error) {
+	if sshKeyConfig.Passphrase == "none" {
+		return "", nil
+	}
+	msg := "Choose a passphrase for your new SSH key. It is stored in your macOS keychain, so you will not be asked for it again."
+	if sshKeyConfig.Passphrase == "prompt" {
+		msg += " Leave it empty for no passphrase."
+	}
+	for {
+		pass, err := uiPassword("SSH Key Passphrase", msg)
+		if err != nil {
+			return "", err
+		}
+		if pass == "" && sshKeyConfig.Passphrase == "require" {
+			msg = "A passphrase is required for your SSH key. Choose a passphrase:"
+			continue
+		}
+		if pass == "" {
+			return "", nil
+		}
+		again, err := uiPassword("SSH Key Passphrase", "Enter the passphrase again:")
+		if err != nil {
+			return "", err
+		}
+		if again == pass {
+			return pass, nil
+		}
+		msg = "The passphrases did not match. Choose a passphrase for your new SSH key:"
+	}
+}
+
+// generateSSHKey creates a key of the policy's type at path. A key already there
+// (one being rotated out) is moved aside rather than overwritten.
+func generateSSHKey(path, email string) error {
+	pass, err := askSSHPassphrase()
+	if err != nil {
+		return fmt.Errorf("SSH key generation cancelled: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	if pathExists(path) {
+		old := path + ".old-" + time.Now().Format("20060102")
+		for _, suffix := range []string{"", ".pub"} {
+			if err := os.Rename(path+suffix, old+suffix); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		logInfo("ssh_key", "moved the old key aside", map[string]string{"path": old})
+	}
+	args := []string{"-q", "-t", sshKeyConfig.Type, "-C", email, "-f", path}
+	if sshKeyConfig.Type == "rsa" {
+		args = append(args, "-b", "4096")
+	}
+	cmd := exec.Command("ssh-keygen", args...)
+	if pass == "" {
+		cmd.Args = append(cmd.Args, "-N", "")
+	} else {
+		// The passphrase goes through SSH_ASKPASS, never argv, where ps would show it.
+		askpass, cleanup, err := passphraseAskpass(pass)
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+		cmd.Env = append(os.Environ(), "SSH_ASKPASS="+askpass, "SSH_ASKPASS_REQUIRE=force", "DISPLAY=:0")
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("ssh-keygen failed: %s", firstLine(string(out)))
+	}
+	logInfo("ssh_key", "SSH key generated", map[string]string{"path": path, "type": sshKeyConfig.Type, "passphrase": strconv.FormatBool(pass != "")})
+	return nil
+}
+
+// passphraseAskpass writes an SSH_ASKPASS program that prints pass, with pass in a
+// file beside it, both in a private temporary directory the returned func removes.
+func passphraseAskpass(pass string) (string, func(), error) {
+	dir, err := os.MkdirTemp("", "chs-askpass-")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() { _ = os.RemoveAll(dir) }
+	script := filepath.Join(dir, "askpass")
+	err = os.WriteFile(filepath.Join(dir, "pass"), []byte(pass), 0600)
+	if err == nil {
+		err = os.WriteFile(script, []byte("#!/bin/sh\nexec cat \"$(dirname \"$0\")/pass\"\n"), 0700)
+	}
+	if err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	return script, cleanup, nil
+}
+
+// offerKeyRotation asks to replace a key that falls short of the policy and returns
+// the key to use from now on.
+func offerKeyRotation(key string, info sshKeyInfo) (string, error) {
+	desc := fmt.Sprintf("%s is a %d-bit %s key", key, info.Bits, info.Type)
+	logWarn("ssh_key", desc+", weaker than policy", map[string]string{"min_rsa_bits": strconv.Itoa(sshKeyConfig.MinRSABits)})
+	if dryRun {
+		logInfo("ssh_key", "DRY-RUN: would offer to generate a new "+sshKeyConfig.Type+" key", nil)
+		return key, nil
+	}
+	if !attended() {
+		return key, nil
+	}
+	ok, _ := uiConfirm("Weak SSH Key", desc+", which is no longer considered safe.\n\nGenerate a new "+sshKeyConfig.Type+" key now? The old key is kept; remove it from Bitbucket once the new one is added.")
+	if !ok {
+		logWarn("ssh_key", "keeping the weak key", nil)
+		return key, nil
+	}
+	email := ""
+	if pub, err := os.ReadFile(key + ".pub"); err == nil {
+		if f := strings.Fields(string(pub)); len(f) > 2 {
+			email = strings.Join(f[2:], " ")
+		}
+	}
+	newKey := sshKeyConfig.keyFiles()[0]
+	if err := generateSSHKey(newKey, email); err != nil {
+		return "", err
+	}
+	return newKey, nil
+}
+
+// sshKeyHasPassphrase reports whether the private key is encrypted.
+func sshKeyHasPassphrase(key string) bool {
+	return exec.Command("ssh-keygen", "-y", "-P", "", "-f", key).Run() != nil
+}
+
+// loadSSHAgent adds key to ssh-agent, and on macOS stores its passphrase in the
+// keychain, so git can use it right away without prompting.
+func loadSSHAgent(key string, info sshKeyInfo) error {
+	if os.Getenv("SSH_AUTH_SOCK") == "" {
+		return fmt.Errorf("no ssh-agent running (SSH_AUTH_SOCK is unset)")
+	}
+	if strings.Contains(cmdOutput("ssh-add", "-l"), info.Fingerprint) {
+		logInfo("ssh_key", "key already loaded in ssh-agent", nil)
+		return nil
+	}
+	if dryRun {
+		logInfo("ssh_key", "DRY-RUN: would add "+key+" to ssh-agent", nil)
+		return nil
+	}
+	encrypted := sshKeyHasPassphrase(key)
+	if encrypted && !attended() {
+		return fmt.Errorf("%s has a passphrase and nobody is at the terminal to enter it", key)
+	}
+	args := []string{key}
+	if runtime.GOOS == "darwin" {
+		args = append([]string{"--apple-use-keychain"}, args...)
+	}
+	cmd := exec.Command("ssh-add", args...)
+	if encrypted {
+		fmt.Println("  [?] Enter the SSH key passphrase once more to store it in your keychain:")
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("ssh-add %s: %w", key, err)
+		}
+	} else if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("ssh-add %s: %s", key, firstLine(string(out)))
+	}
+	logInfo("ssh_key", "key loaded into ssh-agent", map[string]string{"key": key})
+	return nil
+}
+
+// sshAgentConfigStep keeps keys loaded into the agent, from the keychain after a
+// reboot. IgnoreUnknown keeps the config valid for ssh builds without UseKeychain.
+func sshAgentConfigStep(log string) step {
+	body := "Host *\n    IgnoreUnknown UseKeychain\n    AddKeysToAgent yes\n    UseKeychain yes\n"
+	return sshConfigStep(log, "ssh_agent", body, []sshExpect{{Host: "chs-probe", Options: map[string]string{"addkeystoagent": "true"}}})
+}
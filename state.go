@@ -1,22 +1,80 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 	"time"
 )
 
+// stateSchemaVersion is the state.json layout written by this build. Bump it
+// together with a new entry in stateMigrations.
+const stateSchemaVersion = 2
+
+const maxRunHistory = 50
+
 type runState struct {
-	CompletedTools map[string]string `json:"completed_tools"`
+	SchemaVersion int                   `json:"schema_version"`
+	Identity      stateIdentity         `json:"identity"`
+	Tools         map[string]*toolState `json:"tools"`
+	Runs          []runRecord           `json:"runs,omitempty"`
+	Progress      *runProgress          `json:"progress,omitempty"`
+	Repos         map[string]*repoState `json:"repos,omitempty"`
 }
 
+type stateIdentity struct {
+	User     string `json:"user,omitempty"`
+	Home     string `json:"home,omitempty"`
+	Hostname string `json:"hostname,omitempty"`
+	GUID     string `json:"guid,omitempty"`
+}
+
+// toolState is everything remembered about one tool across runs.
+type toolState struct {
+	CompletedAt     string  `json:"completed_at,omitempty"`
+	Version         string  `json:"version,omitempty"`
+	DurationSeconds float64 `json:"duration_seconds,omitempty"`
+	Attempts        int     `json:"attempts,omitempty"`
+	LastError       string  `json:"last_error,omitempty"`
+	LastErrorAt     string  `json:"last_error_at,omitempty"`
+	DefinitionHash  string  `json:"definition_hash,omitempty"`
+}
+
+type runRecord struct {
+	Started  string   `json:"started"`
+	Finished string   `json:"finished,omitempty"`
+	Mode     string   `json:"mode"`
+	Tools    []string `json:"tools,omitempty"`
+	Result   string   `json:"result"`
+	Error    string   `json:"error,omitempty"`
+}
+
+// stateMigrations upgrade state.json from version N (the key) to N+1.
+// Files written before versioning are treated as version 1.
+var stateMigrations = map[int]func([]byte) ([]byte, error){
+	1: migrateStateV1,
+}
+
+// errStateTooNew is returned for state files written by a newer chs-onboard; they
+// must not be overwritten.
+var errStateTooNew = errors.New("state file is from a newer chs-onboard")
+
 var (
-	stateData      = &runState{CompletedTools: map[string]string{}}
+	stateData      = newRunState()
 	forceReinstall bool
+	// stateMigrated is set when the loaded state came from an older schema. It is
+	// migrated in memory only; commands holding the run lock save it.
+	stateMigrated bool
 )
 
+func newRunState() *runState {
+	return &runState{SchemaVersion: stateSchemaVersion, Tools: map[string]*toolState{}}
+}
+
 func stateFilePath() (string, error) {
 	home, err := os.UserHomeDir()
 	if err != nil {
@@ -35,56 +93,230 @@ func loadRunState() error {
 		return err
 	}
 	if !pathExists(path) {
-		stateData = &runState{CompletedTools: map[string]string{}}
+		stateData = newRunState()
 		return nil
 	}
 	data, err := os.ReadFile(path)
 	if err != nil {
 		return err
 	}
-	var s runState
-	if err := json.Unmarshal(data, &s); err != nil {
-		return fmt.Errorf("invalid state file: %w", err)
-	}
-	if s.CompletedTools == nil {
-		s.CompletedTools = map[string]string{}
+	s, migrated, err := decodeRunState(data)
+	if err != nil {
+		return err
 	}
-	stateData = &s
+	stateData = s
+	stateMigrated = migrated
 	return nil
 }
 
+// decodeRunState parses state.json, migrating older schemas. It refuses files from newer builds.
+func decodeRunState(data []byte) (*runState, bool, error) {
+	var header struct {
+		SchemaVersion int `json:"schema_version"`
+	}
+	if err := json.Unmarshal(data, &header); err != nil {
+		return nil, false, fmt.Errorf("invalid state file: %w", err)
+	}
+	version := header.SchemaVersion
+	if version == 0 {
+		version = 1
+	}
+	if version > stateSchemaVersion {
+		return nil, false, fmt.Errorf("%w: file has schema %d, this chs-onboard supports %d; upgrade chs-onboard", errStateTooNew, version, stateSchemaVersion)
+	}
+	migrated := false
+	for ; version < stateSchemaVersion; version++ {
+		migrate, ok := stateMigrations[version]
+		if !ok {
+			return nil, false, fmt.Errorf("no migration from state schema %d", version)
+		}
+		var err error
+		if data, err = migrate(data); err != nil {
+			return nil, false, fmt.Errorf("migrating state schema %d: %w", version, err)
+		}
+		migrated = true
+	}
+	s := newRunState()
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, false, fmt.Errorf("invalid state file: %w", err)
+	}
+	if s.Tools == nil {
+		s.Tools = map[string]*toolState{}
+	}
+	return s, migrated, nil
+}
+
+// migrateStateV1 converts the original completed_tools name→timestamp map.
+func migrateStateV1(data []byte) ([]byte, error) {
+	var v1 struct {
+		CompletedTools map[string]string `json:"completed_tools"`
+	}
+	if err := json.Unmarshal(data, &v1); err != nil {
+		return nil, err
+	}
+	v2 := newRunState()
+	v2.SchemaVersion = 2
+	for name, ts := range v1.CompletedTools {
+		v2.Tools[name] = &toolState{CompletedAt: ts, Attempts: 1}
+	}
+	return json.Marshal(v2)
+}
+
 func saveRunState() error {
 	path, err := stateFilePath()
 	if err != nil {
 		return err
 	}
+	stateData.SchemaVersion = stateSchemaVersion
 	data, err := json.MarshalIndent(stateData, "", "  ")
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(path, data, 0640)
+	return writeFileAtomic(path, data, 0640)
 }
 
 func resetRunState() error {
-	stateData = &runState{CompletedTools: map[string]string{}}
+	stateData = newRunState()
 	return saveRunState()
 }
 
-func isToolCompleted(t toolID) bool {
-	if stateData == nil || stateData.CompletedTools == nil {
+func toolStateFor(t toolID) *toolState {
+	if stateData == nil {
+		stateData = newRunState()
+	}
+	if stateData.Tools == nil {
+		stateData.Tools = map[string]*toolState{}
+	}
+	ts, ok := stateData.Tools[string(t)]
+	if !ok {
+		ts = &toolState{}
+		stateData.Tools[string(t)] = ts
+	}
+	return ts
+}
+
+// isToolCompleted reports whether t finished in an earlier run with the tool
+// definition it has now. Tools whose definition changed since are not complete.
+func isToolCompleted(t toolID, guid string) bool {
+	if stateData == nil || stateData.Tools == nil {
+		return false
+	}
+	ts, ok := stateData.Tools[string(t)]
+	if !ok || ts.CompletedAt == "" {
 		return false
 	}
-	_, ok := stateData.CompletedTools[string(t)]
-	return ok
+	stale, _ := toolStale(t, guid)
+	return !stale
 }
 
-func markToolCompleted(t toolID) error {
-	if stateData == nil {
-		stateData = &runState{CompletedTools: map[string]string{}}
+// toolStale reports whether t was completed with a different definition than
+// the current one. Entries without a recorded fingerprint (from before
+// fingerprints existed) are trusted.
+func toolStale(t toolID, guid string) (bool, string) {
+	ts, ok := stateData.Tools[string(t)]
+	if !ok || ts.CompletedAt == "" {
+		return false, "not completed"
+	}
+	if ts.DefinitionHash == "" {
+		return false, "no fingerprint recorded"
 	}
-	if stateData.CompletedTools == nil {
-		stateData.CompletedTools = map[string]string{}
+	current := toolDefinitionHash(t, guid)
+	if current != ts.DefinitionHash {
+		return true, fmt.Sprintf("definition changed (%s → %s)", ts.DefinitionHash, current)
 	}
-	stateData.CompletedTools[string(t)] = time.Now().UTC().Format(time.RFC3339)
+	return false, "up to date"
+}
+
+// markToolCompleted records a successful install of t that took the given time.
+func markToolCompleted(t toolID, guid string, took time.Duration) error {
+	ts := toolStateFor(t)
+	ts.Attempts++
+	ts.DurationSeconds = took.Round(time.Second).Seconds()
+	ts.LastError = ""
+	ts.LastErrorAt = ""
+	return markToolPresent(t, guid)
+}
+
+// markToolPresent records t as done without an install attempt, e.g. because it was already installed.
+func markToolPresent(t toolID, guid string) error {
+	ts := toolStateFor(t)
+	ts.CompletedAt = time.Now().UTC().Format(time.RFC3339)
+	ts.Version = checkTool(t).Version
+	ts.DefinitionHash = toolDefinitionHash(t, guid)
+	return saveRunState()
+}
+
+// markToolFailed records a failed install attempt of t.
+func markToolFailed(t toolID, err error) error {
+	ts := toolStateFor(t)
+	ts.Attempts++
+	ts.LastError = truncate(err.Error(), 500)
+	ts.LastErrorAt = time.Now().UTC().Format(time.RFC3339)
 	return saveRunState()
 }
+
+// toolDefinitionHash fingerprints the steps used to install t. Notes are left
+// out so rewording a message does not force a reinstall.
+func toolDefinitionHash(t toolID, guid string) string {
+	steps, err := toolSteps(t, guid)
+	if err != nil {
+		return ""
+	}
+	hashed := make([]step, 0, len(steps))
+	for _, s := range steps {
+		if s.Kind != stepNote {
+			hashed = append(hashed, s)
+		}
+	}
+	data, err := json.Marshal(hashed)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:8])
+}
+
+// setStateIdentity records who and where this state belongs to.
+func setStateIdentity(guid string) {
+	host, _ := os.Hostname()
+	stateData.Identity = stateIdentity{
+		User:     currentUser(),
+		Home:     os.Getenv("HOME"),
+		Hostname: host,
+		GUID:     guid,
+	}
+}
+
+// beginRunRecord appends an in-progress entry to the run history.
+func beginRunRecord(mode string, tools []toolID) {
+	if dryRun {
+		return
+	}
+	stateData.Runs = append(stateData.Runs, runRecord{
+		Started: time.Now().UTC().Format(time.RFC3339),
+		Mode:    mode,
+		Tools:   toolIDsToNames(tools),
+		Result:  "running",
+	})
+	if len(stateData.Runs) > maxRunHistory {
+		stateData.Runs = stateData.Runs[len(stateData.Runs)-maxRunHistory:]
+	}
+	if err := saveRunState(); err != nil {
+		logWarn("state", fmt.Sprintf("failed to persist run history: %v", err), nil)
+	}
+}
+
+// finishRunRecord closes the in-progress run history entry, if any.
+func finishRunRecord(result, errMsg string) {
+	if dryRun || stateData == nil || len(stateData.Runs) == 0 {
+		return
+	}
+	r := &stateData.Runs[len(stateData.Runs)-1]
+	if r.Result != "running" {
+		return
+	}
+	r.Finished = time.Now().UTC().Format(time.RFC3339)
+	r.Result = result
+	r.Error = truncate(errMsg, 500)
+	_ = saveRunState()
+}
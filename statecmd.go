@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// runStateCommand implements `chs-onboard state <subcommand>`.
+func runStateCommand(args []string) {
+	if len(args) == 0 {
+		printStateUsage()
+		os.Exit(2)
+	}
+	if err := loadRunState(); err != nil {
+		fmt.Fprintf(os.Stderr, "could not load saved state: %v\n", err)
+		os.Exit(1)
+	}
+	switch args[0] {
+	case "show":
+		stateShowCommand(args[1:])
+	case "diff":
+		stateDiffCommand(args[1:])
+	case "forget":
+		stateForgetCommand(args[1:])
+	case "export":
+		stateExportCommand(args[1:])
+	case "import":
+		stateImportCommand(args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "unknown state subcommand %q\n", args[0])
+		printStateUsage()
+		os.Exit(2)
+	}
+}
+
+func printStateUsage() {
+	fmt.Fprintln(os.Stderr, `usage: chs-onboard state show [--json]
+       chs-onboard state diff [--guid guid]
+       chs-onboard state forget [--dependents] tool...
+       chs-onboard state export [file]
+       chs-onboard state import [--merge] file`)
+}
+
+// lockForStateChange takes the run lock before a state subcommand writes state.json.
+func lockForStateChange() {
+	if err := acquireRunLock(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func sortedStateToolNames() []string {
+	names := make([]string, 0, len(stateData.Tools))
+	for name := range stateData.Tools {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func stateShowCommand(args []string) {
+	fs := flag.NewFlagSet("state show", flag.ExitOnError)
+	jsonFlag := fs.Bool("json", false, "print the raw state file")
+	_ = fs.Parse(args)
+	if *jsonFlag {
+		data, err := json.MarshalIndent(stateData, "", "  ")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "encoding state: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println(string(data))
+		return
+	}
+
+	id := stateData.Identity
+	fmt.Printf("State schema %d — user %s, GUID %s, host %s\n\n", stateData.SchemaVersion, orDash(id.User), orDash(id.GUID), orDash(id.Hostname))
+	fmt.Printf("  %-18s %-21s %-22s %8s %8s  %s\n", "TOOL", "COMPLETED", "VERSION", "ATTEMPTS", "TOOK", "LAST ERROR")
+	for _, name := range sortedStateToolNames() {
+		ts := stateData.Tools[name]
+		took := "-"
+		if ts.DurationSeconds > 0 {
+			took = fmt.Sprintf("%.0fs", ts.DurationSeconds)
+		}
+		lastErr := "-"
+		if ts.LastError != "" {
+			lastErr = ts.LastErrorAt + " " + firstLine(ts.LastError)
+		}
+		fmt.Printf("  %-18s %-21s %-22s %8d %8s  %s\n", name, orDash(ts.CompletedAt), truncate(orDash(ts.Version), 22), ts.Attempts, took, lastErr)
+	}
+	if len(stateData.Runs) > 0 {
+		fmt.Println("\nRecent runs:")
+		start := len(stateData.Runs) - 5
+		if start < 0 {
+			start = 0
+		}
+		for _, r := range stateData.Runs[start:] {
+			line := fmt.Sprintf("  %s  %-8s %-10s %d tools", r.Started, r.Mode, r.Result, len(r.Tools))
+			if r.Error != "" {
+				line += "  " + firstLine(r.Error)
+			}
+			fmt.Println(line)
+		}
+	}
+}
+
+// stateForgetCommand drops completion entries so the tools run again next time.
+func stateForgetCommand(args []string) {
+	fs := flag.NewFlagSet("state forget", flag.ExitOnError)
+	dependentsFlag := fs.Bool("dependents", false, "also forget tools that depend on the named tools")
+	_ = fs.Parse(args)
+	if fs.NArg() == 0 {
+		printStateUsage()
+		os.Exit(2)
+	}
+	var targets []toolID
+	for _, name := range fs.Args() {
+		t, ok := validToolIDs[name]
+		if !ok {
+			fmt.Fprintf(os.Stderr, "unknown tool: %q (use --list)\n", name)
+			os.Exit(1)
+		}
+		targets = append(targets, t)
+	}
+	if *dependentsFlag {
+		targets = append(targets, dependentsOf(targets)...)
+	}
+
+	lockForStateChange()
+	defer releaseRunLock()
+	if err := loadRunState(); err != nil {
+		fmt.Fprintf(os.Stderr, "could not load saved state: %v\n", err)
+		os.Exit(1)
+	}
+	forgotten := 0
+	for _, t := range targets {
+		if _, ok := stateData.Tools[string(t)]; ok {
+			delete(stateData.Tools, string(t))
+			fmt.Printf("  [✓] forgot %s\n", t)
+			forgotten++
+		}
+	}
+	if forgotten == 0 {
+		fmt.Println("Nothing to forget.")
+		return
+	}
+	if err := saveRunState(); err != nil {
+		fmt.Fprintf(os.Stderr, "saving state: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func stateExportCommand(args []string) {
+	fs := flag.NewFlagSet("state export", flag.ExitOnError)
+	_ = fs.Parse(args)
+	data, err := json.MarshalIndent(stateData, "", "  ")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "encoding state: %v\n", err)
+		os.Exit(1)
+	}
+	data = append(data, '\n')
+	if fs.NArg() == 0 || fs.Arg(0) == "-" {
+		_, _ = os.Stdout.Write(data)
+		return
+	}
+	if err := os.WriteFile(fs.Arg(0), data, 0640); err != nil {
+		fmt.Fprintf(os.Stderr, "writing %s: %v\n", fs.Arg(0), err)
+		os.Exit(1)
+	}
+	fmt.Printf("State exported to %s.\n", fs.Arg(0))
+}
+
+// stateImportCommand replaces (or with --merge, overlays) saved state with an exported file.
+func stateImportCommand(args []string) {
+	fs := flag.NewFlagSet("state import", flag.ExitOnError)
+	mergeFlag := fs.Bool("merge", false, "merge into the current state instead of replacing it (imported entries win)")
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		printStateUsage()
+		os.Exit(2)
+	}
+	data, err := os.ReadFile(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "reading %s: %v\n", fs.Arg(0), err)
+		os.Exit(1)
+	}
+	imported, _, err := decodeRunState(data)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", fs.Arg(0), err)
+		os.Exit(1)
+	}
+
+	lockForStateChange()
+	defer releaseRunLock()
+	if err := loadRunState(); err != nil {
+		fmt.Fprintf(os.Stderr, "could not load saved state: %v\n", err)
+		os.Exit(1)
+	}
+	if home := os.Getenv("HOME"); imported.Identity.Home != "" && imported.Identity.Home != home {
+		fmt.Printf("  [!] state was exported from home %s; tools installed under a different home will show as stale\n", imported.Identity.Home)
+	}
+	if *mergeFlag {
+		for name, ts := range imported.Tools {
+			stateData.Tools[name] = ts
+		}
+		for name, rs := range imported.Repos {
+			if stateData.Repos == nil {
+				stateData.Repos = map[string]*repoState{}
+			}
+			stateData.Repos[name] = rs
+		}
+		stateData.Runs = append(stateData.Runs, imported.Runs...)
+		if len(stateData.Runs) > maxRunHistory {
+			stateData.Runs = stateData.Runs[len(stateData.Runs)-maxRunHistory:]
+		}
+	} else {
+		stateData = imported
+	}
+	if err := saveRunState(); err != nil {
+		fmt.Fprintf(os.Stderr, "saving state: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Imported %d tool entries from %s.\n", len(imported.Tools), fs.Arg(0))
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// stateGUID returns the GUID recorded in state, falling back to the current user.
+func stateGUID(flagValue string) string {
+	if g := strings.TrimSpace(flagValue); g != "" {
+		return g
+	}
+	if stateData.Identity.GUID != "" {
+		return stateData.Identity.GUID
+	}
+	return currentUser()
+}
+
+// stateDiffCommand lists completed tools whose definition changed since they were installed.
+func stateDiffCommand(args []string) {
+	fs := flag.NewFlagSet("state diff", flag.ExitOnError)
+	guidFlag := fs.String("guid", "", "GUID the tools were installed for (default: from state)")
+	_ = fs.Parse(args)
+	guid := stateGUID(*guidFlag)
+
+	staleCount := 0
+	for _, name := range sortedStateToolNames() {
+		t := toolID(name)
+		if _, ok := toolDefs[t]; !ok {
+			fmt.Printf("  [?] %-18s no longer a known tool\n", name)
+			continue
+		}
+		if stateData.Tools[name].CompletedAt == "" {
+			continue
+		}
+		stale, reason := toolStale(t, guid)
+		if stale {
+			staleCount++
+			fmt.Printf("  [!] %-18s stale: %s\n", name, reason)
+		} else {
+			fmt.Printf("  [✓] %-18s %s\n", name, reason)
+		}
+	}
+	if staleCount == 0 {
+		fmt.Println("\nNo stale tools.")
+		return
+	}
+	fmt.Printf("\n%d stale tool(s) will be re-run on the next chs-onboard run.\n", staleCount)
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const statusLogLines = 50
+
+type toolRunStatus string
+
+const (
+	toolPending toolRunStatus = "pending"
+	toolRunning toolRunStatus = "running"
+	toolDone    toolRunStatus = "done"
+	toolSkipped toolRunStatus = "skipped"
+	toolFailed  toolRunStatus = "failed"
+)
+
+type statusTool struct {
+	ID       string        `json:"id"`
+	Status   toolRunStatus `json:"status"`
+	Started  string        `json:"started,omitempty"`
+	Finished string        `json:"finished,omitempty"`
+	Error    string        `json:"error,omitempty"`
+}
+
+type statusPrompt struct {
+	Title   string `json:"title"`
+	Message string `json:"message"`
+	Since   string `json:"since"`
+}
+
+type statusSnapshot struct {
+	Started        string         `json:"started"`
+	ElapsedSeconds int64          `json:"elapsed_seconds"`
+	Phase          string         `json:"phase"`
+	DryRun         bool           `json:"dry_run"`
+	Tools          []statusTool   `json:"tools"`
+	Prompts        []statusPrompt `json:"prompts"`
+	Log            []logEntry     `json:"log"`
+}
+
+// status mirrors run progress for the optional --status-addr dashboard.
+// It is fed by logSetPhase, logWrite, runPhase and the ui* dialogs.
+var status struct {
+	mu       sync.Mutex
+	started  time.Time
+	phase    string
+	order    []string
+	tools    map[string]*statusTool
+	prompts  map[int]statusPrompt
+	promptID int
+	log      []logEntry
+}
+
+func init() {
+	status.started = time.Now()
+	status.tools = map[string]*statusTool{}
+	status.prompts = map[int]statusPrompt{}
+}
+
+func statusSetPhase(phase string) {
+	status.mu.Lock()
+	status.phase = phase
+	status.mu.Unlock()
+}
+
+func statusRecordLog(e logEntry) {
+	status.mu.Lock()
+	defer status.mu.Unlock()
+	status.log = append(status.log, e)
+	if len(status.log) > statusLogLines {
+		status.log = status.log[len(status.log)-statusLogLines:]
+	}
+}
+
+// statusSetTools registers the resolved tool list so the dashboard can show pending work.
+func statusSetTools(tools []toolID) {
+	status.mu.Lock()
+	defer status.mu.Unlock()
+	for _, t := range tools {
+		id := string(t)
+		if _, ok := status.tools[id]; ok {
+			continue
+		}
+		status.order = append(status.order, id)
+		status.tools[id] = &statusTool{ID: id, Status: toolPending}
+	}
+}
+
+func statusSetTool(t toolID, s toolRunStatus, err error) {
+	status.mu.Lock()
+	defer status.mu.Unlock()
+	id := string(t)
+	st, ok := status.tools[id]
+	if !ok {
+		st = &statusTool{ID: id}
+		status.tools[id] = st
+		status.order = append(status.order, id)
+	}
+	now := time.Now().UTC().Format(time.RFC3339)
+	st.Status = s
+	switch s {
+	case toolRunning:
+		st.Started = now
+		st.Finished = ""
+		st.Error = ""
+	case toolDone, toolSkipped, toolFailed:
+		st.Finished = now
+	}
+	if err != nil {
+		st.Error = err.Error()
+	}
+}
+
+// statusPromptStart records a dialog waiting on the user and returns a func that clears it.
+func statusPromptStart(title, message string) func() {
+	status.mu.Lock()
+	status.promptID++
+	id := status.promptID
+	status.prompts[id] = statusPrompt{
+		Title:   title,
+		Message: truncate(message, 300),
+		Since:   time.Now().UTC().Format(time.RFC3339),
+	}
+	status.mu.Unlock()
+	return func() {
+		status.mu.Lock()
+		delete(status.prompts, id)
+		status.mu.Unlock()
+	}
+}
+
+func statusSnapshotNow() statusSnapshot {
+	status.mu.Lock()
+	defer status.mu.Unlock()
+	snap := statusSnapshot{
+		Started:        status.started.UTC().Format(time.RFC3339),
+		ElapsedSeconds: int64(time.Since(status.started).Seconds()),
+		Phase:          status.phase,
+		DryRun:         dryRun,
+		Tools:          make([]statusTool, 0, len(status.order)),
+		Prompts:        make([]statusPrompt, 0, len(status.prompts)),
+		Log:            append([]logEntry(nil), status.log...),
+	}
+	for _, id := range status.order {
+		snap.Tools = append(snap.Tools, *status.tools[id])
+	}
+	for i := 1; i <= status.promptID; i++ {
+		if p, ok := status.prompts[i]; ok {
+			snap.Prompts = append(snap.Prompts, p)
+		}
+	}
+	return snap
+}
+
+// startStatusServer serves the dashboard page and JSON endpoint on addr until the process exits.
+func startStatusServer(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("status server listen on %s: %w", addr, err)
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+			logWarn("status", "status dashboard is not bound to loopback; anyone on the network can view progress", map[string]string{"addr": addr})
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = w.Write(statusPage)
+	})
+	mux.HandleFunc("/status.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		_ = json.NewEncoder(w).Encode(statusSnapshotNow())
+	})
+
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+	go func() {
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			logWarn("status", fmt.Sprintf("status server stopped: %v", err), nil)
+		}
+	}()
+	registerCleanup(func() { _ = srv.Close() })
+	logInfo("status", fmt.Sprintf("status dashboard at http://%s/", ln.Addr()), nil)
+	return nil
+}
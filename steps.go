@@ -0,0 +1,389 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type stepKind string
+
+const (
+	stepExec       stepKind = "exec"
+	stepGit        stepKind = "git"
+	stepZshrc      stepKind = "zshrc"
+	stepFile       stepKind = "file"
+	stepConfirm    stepKind = "confirm"
+	stepNote       stepKind = "note"
+	stepBrew       stepKind = "brew"
+	stepPipConf    stepKind = "pip_conf"
+	stepFetch      stepKind = "download"
+	stepSSHConfig  stepKind = "ssh_config"
+	stepKnownHosts stepKind = "known_hosts"
+	stepTrustRoots stepKind = "trust_roots"
+	stepSSHKeyAdd  stepKind = "ssh_key_add"
+)
+
+// step is a single action performed by an installer. Installers return their
+// steps instead of executing commands directly so that dry-run, plans and
+// emitted scripts describe exactly what a real run would do.
+type step struct {
+	Kind stepKind `json:"kind"`
+	Log  string   `json:"log"`
+
+	// exec
+	Args        []string `json:"args,omitempty"`
+	Sudo        bool     `json:"sudo,omitempty"`
+	Interactive bool     `json:"interactive,omitempty"`
+	Venv        string   `json:"venv,omitempty"`
+	Env         []string `json:"env,omitempty"`
+	IgnoreErr   bool     `json:"ignore_err,omitempty"`
+
+	// git (Remote → Dst, pinned by Repo), file (Asset → Dst), pip_conf (Pip → Dst).
+	// A file step with Content writes it instead of the embedded asset; Asset then
+	// only names it.
+	Remote  string   `json:"remote,omitempty"`
+	Repo    *gitRepo `json:"repo,omitempty"`
+	Asset   string   `json:"asset,omitempty"`
+	Content string   `json:"content,omitempty"`
+	Dst     string   `json:"dst,omitempty"`
+
+	// zshrc, ssh_config (managed block Guard in Dst, checked against SSH with ssh -G)
+	Guard string      `json:"guard,omitempty"`
+	Block string      `json:"block,omitempty"`
+	SSH   []sshExpect `json:"ssh,omitempty"`
+
+	// known_hosts: host keys of Host, checked against its pinned fingerprints, added to Dst
+	Host *sshHost `json:"host,omitempty"`
+
+	// trust_roots: CA certificates under Src validated into Dst and, with the
+	// system roots, into the PEM bundle Bundle
+	Src    string `json:"src,omitempty"`
+	Bundle string `json:"bundle,omitempty"`
+
+	// confirm, note
+	Title   string `json:"title,omitempty"`
+	Message string `json:"message,omitempty"`
+
+	// brew: Brewfile entries to install if missing
+	Brew []brewPackage `json:"brew,omitempty"`
+
+	// download (URL → Dst): fetched through the download cache, verified against
+	// SHA256 when set, and unzipped into Dst when Unzip is set
+	URL    string `json:"url,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+	Unzip  bool   `json:"unzip,omitempty"`
+
+	// pip_conf: managed pip configuration, written for the first reachable index
+	Pip *pipIndexConfig `json:"pip,omitempty"`
+
+	// Creates skips the step when the path already exists; Requires skips it when the path is missing.
+	Creates  string `json:"creates,omitempty"`
+	Requires string `json:"requires,omitempty"`
+}
+
+// assets maps step asset names to embedded file contents.
+var assets = map[string][]byte{
+	"iterm2.plist": iterm2Plist,
+}
+
+func execStep(log, name string, args ...string) step {
+	return step{Kind: stepExec, Log: log, Args: append([]string{name}, args...)}
+}
+
+// gitStep syncs the repository registry entry name into its clone directory.
+func gitStep(log, name string) step {
+	r, ok := repos[name]
+	if !ok {
+		panic("no repository registry entry for " + name)
+	}
+	return step{Kind: stepGit, Log: log, Remote: r.Remote, Dst: repoDir(name), Repo: &r}
+}
+
+func zshrcStep(guard, block string) step {
+	return step{Kind: stepZshrc, Log: "zshrc", Guard: guard, Block: block}
+}
+
+func fileStep(log, asset, dst string) step {
+	return step{Kind: stepFile, Log: log, Asset: asset, Dst: dst}
+}
+
+// contentStep writes content, named name, to dst. The content travels in the step,
+// so plans, definition hashes and scripts all see exactly what is written.
+func contentStep(log, name, content, dst string) step {
+	return step{Kind: stepFile, Log: log, Asset: name, Content: content, Dst: dst}
+}
+
+// downloadStep fetches the download manifest entry name to dst.
+func downloadStep(log, name, dst string) step {
+	dl, ok := downloads[name]
+	if !ok {
+		panic("no download manifest entry for " + name)
+	}
+	return step{Kind: stepFetch, Log: log, URL: dl.URL, SHA256: dl.SHA256, Dst: dst}
+}
+
+func trustRootsStep(log, src, dst, bundle string) step {
+	return step{Kind: stepTrustRoots, Log: log, Src: src, Dst: dst, Bundle: bundle}
+}
+
+// sshKeyAddStep gets the preflight SSH public key added to Bitbucket.
+func sshKeyAddStep(log string) step {
+	return step{Kind: stepSSHKeyAdd, Log: log}
+}
+
+func confirmStep(log, title, message string) step {
+	return step{Kind: stepConfirm, Log: log, Title: title, Message: message}
+}
+
+func noteStep(log, message string) step {
+	return step{Kind: stepNote, Log: log, Message: message}
+}
+
+func brewStep(log string, pkgs []brewPackage) step {
+	return step{Kind: stepBrew, Log: log, Brew: pkgs}
+}
+
+func (s step) sudo() step { s.Sudo = true; return s }
+
+func (s step) interactive() step { s.Interactive = true; return s }
+
+func (s step) ignoreErr() step { s.IgnoreErr = true; return s }
+
+func (s step) inVenv(venv string) step { s.Venv = venv; return s }
+
+func (s step) withEnv(env ...string) step {
+	s.Env = append(append([]string(nil), s.Env...), env...)
+	return s
+}
+
+// unzip makes a download step extract the zip into its destination directory.
+func (s step) unzip() step { s.Unzip = true; return s }
+
+func (s step) creates(path string) step { s.Creates = path; return s }
+
+func (s step) requires(path string) step { s.Requires = path; return s }
+
+// fileData returns what a file step writes.
+func (s step) fileData() ([]byte, error) {
+	if s.Content != "" {
+		return []byte(s.Content), nil
+	}
+	data, ok := assets[s.Asset]
+	if !ok {
+		return nil, fmt.Errorf("unknown asset %q", s.Asset)
+	}
+	return data, nil
+}
+
+// skipReason returns why the step would be skipped right now, or "" if it would run.
+func (s step) skipReason() string {
+	if s.Creates != "" && pathExists(s.Creates) {
+		return s.Creates + " already exists"
+	}
+	if s.Requires != "" && !pathExists(s.Requires) {
+		return s.Requires + " not found"
+	}
+	if s.Kind == stepZshrc && fileContains(os.Getenv("HOME")+"/.zshrc", s.Guard) {
+		return "block already present in ~/.zshrc"
+	}
+	if s.Kind == stepBrew && len(loadBrewInventory().missing(s.Brew)) == 0 {
+		return "all packages installed"
+	}
+	return ""
+}
+
+// describe renders the step as a single human-readable line.
+func (s step) describe() string {
+	switch s.Kind {
+	case stepExec:
+		cmd := shellJoin(s.Args)
+		if s.Sudo {
+			cmd = "sudo " + cmd
+		}
+		if s.Venv != "" {
+			cmd += "  (venv " + s.Venv + ")"
+		}
+		if len(s.Env) > 0 {
+			cmd = strings.Join(s.Env, " ") + " " + cmd
+		}
+		return "$ " + cmd
+	case stepGit:
+		return fmt.Sprintf("git sync %s (%s, local changes: %s) → %s", s.Remote, s.repo().ref(), s.repo().localChanges(), s.Dst)
+	case stepZshrc:
+		return "append ~/.zshrc block: " + s.Guard
+	case stepFile:
+		return fmt.Sprintf("write %s (embedded %s)", s.Dst, s.Asset)
+	case stepConfirm:
+		return "confirm with user: " + s.Title
+	case stepNote:
+		return "note: " + s.Message
+	case stepBrew:
+		names := make([]string, 0, len(s.Brew))
+		for _, p := range s.Brew {
+			names = append(names, p.String())
+		}
+		return "brew bundle (install missing): " + strings.Join(names, ", ")
+	case stepFetch:
+		verb := "download"
+		if s.Unzip {
+			verb = "download and unzip"
+		}
+		pin := "unpinned"
+		if s.SHA256 != "" {
+			pin = "sha256 " + s.SHA256[:min(12, len(s.SHA256))]
+		}
+		return fmt.Sprintf("%s %s → %s (%s)", verb, s.URL, s.Dst, pin)
+	case stepPipConf:
+		return fmt.Sprintf("write %s (first reachable of %s)", s.Dst, strings.Join(s.Pip.indexes(), ", "))
+	case stepSSHConfig:
+		if s.Block == "" {
+			return "cannot update " + s.Dst + ": " + s.Message
+		}
+		return fmt.Sprintf("update the %s block in %s (%d hosts checked with ssh -G)", s.Guard, s.Dst, len(s.SSH))
+	case stepKnownHosts:
+		pin := "unpinned"
+		if len(s.Host.Fingerprints) > 0 {
+			pin = "pinned " + strings.Join(s.Host.Fingerprints, ", ")
+		}
+		return fmt.Sprintf("add host keys of %s to %s (%s)", s.Host.knownHostsName(), s.Dst, pin)
+	case stepSSHKeyAdd:
+		return "add the SSH public key to Bitbucket (through the API with an access token, or by hand)"
+	case stepTrustRoots:
+		return fmt.Sprintf("validate CA certificates in %s → %s, combined with the system roots into %s", s.Src, s.Dst, s.Bundle)
+	}
+	return "unknown step kind " + string(s.Kind)
+}
+
+// runSteps executes steps in order, honouring Creates/Requires guards.
+func runSteps(steps []step) error {
+	for _, s := range steps {
+		if reason := s.skipReason(); reason != "" {
+			logInfo(s.Log, "skipping ("+reason+"): "+s.describe(), nil)
+			continue
+		}
+		err := runStep(s)
+		if s.Kind == stepExec {
+			// any command may have installed or removed brew packages
+			forgetBrewInventory()
+		}
+		if err != nil {
+			if s.IgnoreErr {
+				logWarn(s.Log, fmt.Sprintf("ignoring failure: %s", s.describe()), nil)
+				continue
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func runStep(s step) error {
+	if activeBundle != nil {
+		s = activeBundle.rewrite(s)
+	}
+	switch s.Kind {
+	case stepExec:
+		env := baseEnv
+		if s.Venv != "" {
+			env = pyenvEnv(s.Venv)
+		}
+		if len(s.Env) > 0 {
+			env = append(append([]string(nil), env...), s.Env...)
+		}
+		if s.Interactive {
+			return runInteractive(s.Log, s.Args[0], s.Args[1:]...)
+		}
+		if s.Sudo {
+			_, err := sudoCmd(s.Log, env, s.Args[0], s.Args[1:]...)
+			return err
+		}
+		_, err := runCmd(s.Log, env, s.Args[0], s.Args[1:]...)
+		return err
+	case stepGit:
+		source := s.Remote
+		if activeBundle != nil {
+			if bundle, ok := activeBundle.gitBundle(s.Remote); ok {
+				source = bundle
+			}
+		}
+		return syncRepo(s.Log, s.repo(), s.Dst, source)
+	case stepZshrc:
+		return appendToZshrc(s.Guard, s.Block)
+	case stepFile:
+		data, err := s.fileData()
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(s.Dst), 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(s.Dst, data, 0644); err != nil {
+			return fmt.Errorf("writing %s: %w", s.Dst, err)
+		}
+		return nil
+	case stepConfirm:
+		ok, _ := uiConfirm(s.Title, s.Message)
+		if !ok {
+			return fmt.Errorf("%s not confirmed", s.Title)
+		}
+		return nil
+	case stepNote:
+		logInfo(s.Log, s.Message, nil)
+		return nil
+	case stepBrew:
+		_, err := brewSync(s.Log, s.Brew)
+		return err
+	case stepFetch:
+		return installDownload(s.Log, download{URL: s.URL, SHA256: s.SHA256}, s.Dst, s.Unzip)
+	case stepPipConf:
+		return writePipConf(s.Log, s.Dst, *s.Pip)
+	case stepSSHConfig:
+		return writeSSHConfig(s)
+	case stepKnownHosts:
+		return seedKnownHosts(s.Log, s.Dst, *s.Host)
+	case stepSSHKeyAdd:
+		return postVPNSSHKeyStep()
+	case stepTrustRoots:
+		return installTrustRoots(s.Log, s.Src, s.Dst, s.Bundle)
+	}
+	return fmt.Errorf("unknown step kind %q", s.Kind)
+}
+
+// printStepPlan prints what runSteps would do without doing it.
+func printStepPlan(steps []step) {
+	for _, s := range steps {
+		if reason := s.skipReason(); reason != "" {
+			fmt.Printf("      skip  %s  (%s)\n", s.describe(), reason)
+			continue
+		}
+		fmt.Printf("      run   %s\n", s.describe())
+	}
+}
+
+// shellQuote quotes arg for POSIX shells when it contains anything beyond safe characters.
+func shellQuote(arg string) string {
+	if arg == "" {
+		return "''"
+	}
+	safe := true
+	for _, r := range arg {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_./:=@,+%", r)) {
+			safe = false
+			break
+		}
+	}
+	if safe {
+		return arg
+	}
+	return "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+}
+
+func shellJoin(args []string) string {
+	quoted := make([]string, 0, len(args))
+	for _, a := range args {
+		quoted = append(quoted, shellQuote(a))
+	}
+	return strings.Join(quoted, " ")
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// toolFailure is a tool that failed under --keep-going, with the tools skipped because they depend on it.
+type toolFailure struct {
+	Tool     toolID
+	Phase    string
+	Err      error
+	Blocked  []toolID
+	Resolved bool
+}
+
+var (
+	keepGoing   bool
+	runFailures []*toolFailure
+)
+
+func recordFailure(phase string, t toolID, err error) {
+	runFailures = append(runFailures, &toolFailure{Tool: t, Phase: phase, Err: err})
+}
+
+// failedDependency returns the unresolved failure that t depends on, directly or transitively.
+func failedDependency(t toolID) (*toolFailure, bool) {
+	seen := map[toolID]bool{}
+	var walk func(toolID) *toolFailure
+	walk = func(cur toolID) *toolFailure {
+		for _, dep := range depMap[cur] {
+			if seen[dep] {
+				continue
+			}
+			seen[dep] = true
+			for _, f := range runFailures {
+				if f.Resolved {
+					continue
+				}
+				if f.Tool == dep || hasTool(f.Blocked, dep) {
+					return f
+				}
+			}
+			if f := walk(dep); f != nil {
+				return f
+			}
+		}
+		return nil
+	}
+	f := walk(t)
+	return f, f != nil
+}
+
+// phaseFailed reports whether phase still has unresolved failures.
+func phaseFailed(phase string) bool {
+	for _, f := range runFailures {
+		if f.Phase == phase && !f.Resolved {
+			return true
+		}
+	}
+	return false
+}
+
+func unresolvedFailures() []*toolFailure {
+	var out []*toolFailure
+	for _, f := range runFailures {
+		if !f.Resolved {
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+// triagePhase asks, for each failure in phase, whether to retry the tool, skip it or abort.
+// It runs while the phase's network is still connected, so retries can succeed. Unattended
+// runs leave failures for the summary.
+func triagePhase(phase string, tools []toolID, guid string) {
+	if !attended() {
+		return
+	}
+	// runPhase may append new failures while retrying dependents, so index the slice.
+	for i := 0; i < len(runFailures); i++ {
+		f := runFailures[i]
+		if f.Phase != phase || f.Resolved {
+			continue
+		}
+		for !f.Resolved {
+			msg := fmt.Sprintf("%s failed:\n\n%s", f.Tool, truncate(f.Err.Error(), 400))
+			if len(f.Blocked) > 0 {
+				msg += fmt.Sprintf("\n\nSkipped because of it: %s", strings.Join(toolIDsToNames(f.Blocked), ", "))
+			}
+			choice, err := uiChoose("Install Failed", msg, []string{"Abort", "Skip", "Retry"}, "Retry")
+			if err != nil || choice == "Skip" {
+				logWarn(string(f.Tool), fmt.Sprintf("%s failed; skipped by user", f.Tool), nil)
+				break
+			}
+			if choice == "Abort" {
+				printFailureSummary()
+				logFatal(phase, fmt.Sprintf("aborted after %s failed", f.Tool), nil)
+			}
+			fmt.Printf("\n  [→] Retrying %s\n", f.Tool)
+			if err := installTool(f.Tool, guid); err != nil {
+				fmt.Printf("  [✗] %s failed again: %v\n", f.Tool, err)
+				f.Err = err
+				continue
+			}
+			f.Resolved = true
+			var rerun []toolID
+			for _, t := range tools {
+				if hasTool(f.Blocked, t) {
+					rerun = append(rerun, t)
+				}
+			}
+			if len(rerun) > 0 {
+				fmt.Printf("\n  [→] Running tools that were waiting on %s\n", f.Tool)
+				_ = runPhase(phase, rerun, guid)
+			}
+		}
+	}
+}
+
+// printFailureSummary lists failed tools and what was skipped because of them.
+func printFailureSummary() {
+	failures := unresolvedFailures()
+	if len(failures) == 0 {
+		return
+	}
+	fmt.Println("\n── Failure Summary ───────────────────────────────────────────")
+	for _, f := range failures {
+		fmt.Printf("  [✗] %s (%s): %s\n", f.Tool, f.Phase, firstLine(f.Err.Error()))
+		if h, _, ok := failureHintFor(f.Err); ok {
+			fmt.Printf("      known issue: %s\n      fix: %s\n", h.Explain, h.Fix)
+		}
+		if len(f.Blocked) > 0 {
+			fmt.Printf("      skipped dependents: %s\n", strings.Join(toolIDsToNames(f.Blocked), ", "))
+		}
+		logError(string(f.Tool), "tool failed", map[string]string{"phase": f.Phase, "error": f.Err.Error(), "blocked": strings.Join(toolIDsToNames(f.Blocked), ",")})
+	}
+}
+
+// finishKeepGoing ends a --keep-going run with a summary; it exits non-zero if anything failed.
+func finishKeepGoing() {
+	failures := unresolvedFailures()
+	if len(failures) == 0 {
+		return
+	}
+	printFailureSummary()
+	logFatal("keep_going", fmt.Sprintf("%d tool(s) failed", len(failures)), nil)
+}
+
+// attended reports whether someone is at the terminal to answer prompts.
+func attended() bool {
+	fi, err := os.Stdin.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
@@ -8,6 +8,7 @@ import (
 )
 
 func uiChoose(title, message string, buttons []string, defaultButton string) (string, error) {
+	defer statusPromptStart(title, message)()
 	if len(buttons) == 0 {
 		return "", fmt.Errorf("buttons required")
 	}
@@ -33,6 +34,7 @@ func uiChoose(title, message string, buttons []string, defaultButton string) (st
 }
 
 func uiAlert(title, message string) error {
+	defer statusPromptStart(title, message)()
 	script := fmt.Sprintf(
 		`display alert %q message %q buttons {"OK"} default button "OK"`,
 		title, message,
@@ -41,6 +43,7 @@ func uiAlert(title, message string) error {
 }
 
 func uiConfirm(title, message string) (bool, error) {
+	defer statusPromptStart(title, message)()
 	script := fmt.Sprintf(
 		`display dialog %q with title %q buttons {"No", "Yes"} default button "Yes"`,
 		message, title,
@@ -53,6 +56,7 @@ func uiConfirm(title, message string) (bool, error) {
 }
 
 func uiPrompt(title, message, defaultValue string) (string, error) {
+	defer statusPromptStart(title, message)()
 	fmt.Println("  [!] If you are fullscreened in Terminal, a prompt may appear behind it.")
 	script := fmt.Sprintf(
 		`display dialog %q with title %q default answer %q`,
@@ -71,7 +75,23 @@ func uiPrompt(title, message, defaultValue string) (string, error) {
 	return "", fmt.Errorf("could not parse dialog output: %q", out)
 }
 
+// uiPassword is uiPrompt with the answer hidden as it is typed. The answer is
+// returned exactly as typed, leading and trailing spaces included.
+func uiPassword(title, message string) (string, error) {
+	defer statusPromptStart(title, message)()
+	script := fmt.Sprintf(
+		`text returned of (display dialog %q with title %q default answer "" with hidden answer)`,
+		message, title,
+	)
+	out, err := osascriptRaw(script)
+	if err != nil {
+		return "", fmt.Errorf("dialog cancelled: %w", err)
+	}
+	return out, nil
+}
+
 func uiChooseFromList(title, message string, options, defaultOptions []string) ([]string, error) {
+	defer statusPromptStart(title, message)()
 	if len(options) == 0 {
 		return nil, nil
 	}
@@ -108,6 +128,7 @@ return chosen as string`, appleScriptList(options), appleScriptList(defaultOptio
 // uiChooseOptionalCheckboxes renders a checkbox-style selector using JXA/Cocoa.
 // Falls back to choose-from-list if JXA dialog fails.
 func uiChooseOptionalCheckboxes(title, message string, options, defaultOptions []string) ([]string, error) {
+	defer statusPromptStart(title, message)()
 	if len(options) == 0 {
 		return nil, nil
 	}
@@ -204,12 +225,17 @@ func appleScriptList(items []string) string {
 }
 
 // uiShowSSHKey shows the public key and blocks until user confirms it's been added to Bitbucket.
-func uiShowSSHKey(pubKey string) error {
+// When register is set the user may instead have it add the key (with an access token).
+func uiShowSSHKey(pubKey string, register func(pubKey string) error) error {
+	buttons := []string{"Open Bitbucket", "Already added"}
+	if register != nil {
+		buttons = []string{"Use access token", "Open Bitbucket", "Already added"}
+	}
 	for {
 		selection, err := uiChoose(
 			"SSH Public Key",
 			fmt.Sprintf("Your SSH public key — add this to Bitbucket:\n\n%s", pubKey),
-			[]string{"Open Bitbucket", "Already added"},
+			buttons,
 			"Already added",
 		)
 		if err != nil {
@@ -218,6 +244,14 @@ func uiShowSSHKey(pubKey string) error {
 		if selection == "Already added" {
 			return nil
 		}
+		if selection == "Use access token" {
+			err := register(pubKey)
+			if err == nil {
+				return nil
+			}
+			_ = uiAlert("SSH Key", "Could not add the key with the access token: "+err.Error())
+			continue
+		}
 		_ = exec.Command("pbcopy").Run()
 		cmd := exec.Command("zsh", "-lc", "printf %s \"$1\" | pbcopy", "--", pubKey)
 		_ = cmd.Run()
@@ -242,6 +276,13 @@ func osascriptOutput(script string) (string, error) {
 	return strings.TrimSpace(string(out)), err
 }
 
+// osascriptRaw is osascriptOutput without trimming: only the newline osascript
+// ends its output with is removed.
+func osascriptRaw(script string) (string, error) {
+	out, err := exec.Command("osascript", "-e", `tell application "Terminal" to activate`, "-e", script).Output()
+	return strings.TrimSuffix(string(out), "\n"), err
+}
+
 func osascriptOutputLang(lang, script string) (string, error) {
 	if strings.EqualFold(lang, "JavaScript") {
 		script = `Application("Terminal").activate();` + "\n" + script